@@ -6,10 +6,15 @@ import (
 	certmgr "github.com/aws/aws-cdk-go/awscdk/v2/awscertificatemanager"
 	cloudfront "github.com/aws/aws-cdk-go/awscdk/v2/awscloudfront"
 	origins "github.com/aws/aws-cdk-go/awscdk/v2/awscloudfrontorigins"
+	dynamodb "github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	events "github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	targets "github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	iam "github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	lambda "github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	eventsources "github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
 	route53 "github.com/aws/aws-cdk-go/awscdk/v2/awsroute53"
 	s3 "github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	sqs "github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 	golambda "github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/constructs-go/constructs/v10"
@@ -63,6 +68,33 @@ func NewAssumeRoleIdFunction(stack cdk.Stack) (cloudfront.Distribution, route53.
 		AccessControl: s3.BucketAccessControl_PRIVATE,
 	})
 
+	table := dynamodb.NewTable(scope, j.String("table"), &dynamodb.TableProps{
+		PartitionKey: &dynamodb.Attribute{
+			Name: j.String("pk"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: j.String("sk"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		BillingMode:         dynamodb.BillingMode_PAY_PER_REQUEST,
+		RemovalPolicy:       cdk.RemovalPolicy_RETAIN,
+		TimeToLiveAttribute: j.String("expires_at"),
+	})
+
+	// The store's ListRoles queries this for the roles that haven't expired, see pkg.DynamoDBLiveRolesIndex.
+	table.AddGlobalSecondaryIndex(&dynamodb.GlobalSecondaryIndexProps{
+		IndexName: j.String("live-roles"),
+		PartitionKey: &dynamodb.Attribute{
+			Name: j.String("live"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: j.String("expires_at"),
+			Type: dynamodb.AttributeType_NUMBER,
+		},
+	})
+
 	cert := certmgr.NewCertificate(scope, j.String("cert"), &certmgr.CertificateProps{
 		DomainName: j.String(DomainName),
 		Validation: certmgr.CertificateValidation_FromEmail(&map[string]*string{
@@ -73,6 +105,12 @@ func NewAssumeRoleIdFunction(stack cdk.Stack) (cloudfront.Distribution, route53.
 	secretName := "/assume-role-id/secret"
 	secretArn := fmt.Sprintf("arn:aws:ssm:%s:%s:parameter%s", *cdk.Aws_REGION(), *cdk.Aws_ACCOUNT_ID(), secretName)
 
+	// Failed webhook deliveries are retried from here, see web/pkg/webhook_queue.go.
+	webhookQueue := sqs.NewQueue(scope, j.String("webhook-queue"), &sqs.QueueProps{
+		// Lambda recommends six times the function timeout.
+		VisibilityTimeout: cdk.Duration_Minutes(j.Number(6)),
+	})
+
 	function := golambda.NewGoFunction(scope, j.String("function-id"), &golambda.GoFunctionProps{
 		Architecture: lambda.Architecture_ARM_64(),
 		Entry:        j.String("web"),
@@ -83,17 +121,34 @@ func NewAssumeRoleIdFunction(stack cdk.Stack) (cloudfront.Distribution, route53.
 			"SANDBOX_ROLE_ARN":         aws.String(SandboxRoleArn),
 			"SUPER_SECRET_PATH_PREFIX": aws.String(SuperSecretPathPrefix),
 			"SECRET_NAME":              aws.String(secretName),
+			"TABLE_NAME":               table.TableName(),
+			"WEBHOOK_QUEUE_URL":        webhookQueue.QueueUrl(),
 		},
 		Timeout: cdk.Duration_Seconds(j.Number(60)),
 	})
 
+	table.GrantReadWriteData(function)
+	webhookQueue.GrantSendMessages(function)
+	// Each message is a single attempt of up to 10 seconds and a batch is delivered in order, so a batch has to fit in
+	// the function timeout with room to spare.
+	function.AddEventSource(eventsources.NewSqsEventSource(webhookQueue, &eventsources.SqsEventSourceProps{
+		BatchSize:               j.Number(4),
+		ReportBatchItemFailures: j.Bool(true),
+	}))
+	bucket.GrantReadWrite(function, j.String("principals/*"))
+
 	function.AddToRolePolicy(iam.NewPolicyStatement(&iam.PolicyStatementProps{
 		Actions: &[]*string{
 			j.String("ssm:GetParameter"),
+			j.String("ssm:GetParametersByPath"),
 			j.String("ssm:PutParameter"),
+			j.String("ssm:DeleteParameter"),
 		},
+		// The keyring is stored under <secret>/keys, the secret itself is the legacy key.
 		Resources: &[]*string{
 			j.String(secretArn),
+			j.String(secretArn + "/keys"),
+			j.String(secretArn + "/keys/*"),
 		},
 	}))
 
@@ -117,6 +172,24 @@ func NewAssumeRoleIdFunction(stack cdk.Stack) (cloudfront.Distribution, route53.
 		},
 	}))
 
+	// The same function runs the scheduled jobs, see web/lambda.go.
+	for _, job := range []struct {
+		id, name string
+		rate     cdk.Duration
+	}{
+		{id: "reaper-schedule", name: "reap", rate: cdk.Duration_Minutes(j.Number(15))},
+		{id: "sweep-schedule", name: "sweep", rate: cdk.Duration_Minutes(j.Number(5))},
+		{id: "webhooks-schedule", name: "webhooks", rate: cdk.Duration_Minutes(j.Number(5))},
+		{id: "rotate-keys-schedule", name: "rotate-keys", rate: cdk.Duration_Days(j.Number(30))},
+	} {
+		events.NewRule(scope, j.String(job.id), &events.RuleProps{
+			Schedule: events.Schedule_Rate(job.rate),
+			Targets: &[]events.IRuleTarget{targets.NewLambdaFunction(function, &targets.LambdaFunctionProps{
+				Event: events.RuleTargetInput_FromObject(map[string]string{"job": job.name}),
+			})},
+		})
+	}
+
 	fnUrl := lambda.NewFunctionUrl(scope, j.String("url-id"), &lambda.FunctionUrlProps{
 		AuthType:   lambda.FunctionUrlAuthType_AWS_IAM,
 		InvokeMode: lambda.InvokeMode_RESPONSE_STREAM,
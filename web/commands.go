@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ryanjarv/assume-role-id/web/pkg"
+	"net/http"
+	"os"
+)
+
+// commands are what the binary can be run as, the first argument after the config flags picks one and the rest are
+// passed to it. Without arguments it's "lambda" in lambda and "serve" everywhere else.
+//
+// The config is validated before running any command but "config".
+var commands = map[string]func(ctx *pkg.Context, conf *pkg.Config, args []string) error{
+	"serve":      Serve,
+	"lambda":     StartLambda,
+	"reap":       Reap,
+	"rotate-key": RotateKey,
+	"resolve":    Resolve,
+	"poll":       Poll,
+	"config":     Config,
+}
+
+// Serve runs the web server on the Listen address, along with the sweeper, webhooks, reaper and webhook retries that
+// lambda runs on demand, from schedules and from the queue. The keyring is reloaded to pick up rotations.
+func Serve(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	h, err := NewHandler(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	mux, err := h.mux()
+	if err != nil {
+		return err
+	}
+
+	ctx.Debug.Printf("running in web server mode")
+
+	go h.sweeper.Run(ctx)
+	go h.notifier.Run(ctx)
+	go pkg.RunWebhooks(ctx, h.pollEventsInput(""), conf.WebhookPollInterval)
+	go pkg.RunReaper(ctx, h.reapRolesInput(), conf.ReaperInterval)
+	go pkg.RunKeyringReloader(ctx, h.keyring, conf.KeyringReloadInterval)
+	if h.notifier.QueueUrl != "" {
+		go pkg.RunWebhookQueue(ctx, h.notifier)
+	}
+
+	ctx.Info.Printf("listening on %s", conf.Listen)
+	if err := http.ListenAndServe(conf.Listen, mux); err != nil {
+		return fmt.Errorf("listening and serving: %w", err)
+	}
+	return nil
+}
+
+// Reap deletes expired roles once, see pkg.ReapRoles. With -dry-run it only logs the roles that would be deleted.
+func Reap(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	flags := flag.NewFlagSet("reap", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only log the roles that would be deleted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	h, err := NewHandler(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	input := h.reapRolesInput()
+	input.DryRun = *dryRun
+
+	report, err := pkg.ReapRoles(ctx, input)
+	ctx.Info.Println(report)
+	if err != nil {
+		return fmt.Errorf("reaping roles: %w", err)
+	}
+	return nil
+}
+
+// RotateKey adds a token encryption key to the keyring at SecretName and deletes retired ones, see
+// pkg.RotateKeyring.
+func RotateKey(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	h, err := NewHandler(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return h.rotateKeys(ctx)
+}
+
+// Resolve looks up the ARNs of the principal IDs given as arguments, printing them as JSON.
+func Resolve(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: resolve <principal id>...")
+	}
+
+	h, err := NewHandler(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	resolved, err := h.resolver.LookupPrincipalIds(ctx, args)
+	if err != nil {
+		return fmt.Errorf("looking up principal ids: %w", err)
+	}
+	return printJSON(resolved)
+}
+
+// Poll prints the events of the role a token was issued for as JSON, like /poll/{token}.
+func Poll(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: poll <token>")
+	}
+
+	h, err := NewHandler(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	result, err := pkg.PollEvents(ctx, h.pollEventsInput(args[0]))
+	if err != nil {
+		return fmt.Errorf("polling events: %w", err)
+	}
+	return printJSON(result)
+}
+
+// Config prints the effective config with "config print", secrets are redacted. Unlike the other commands it runs with
+// an invalid config, printing it before what's wrong with it.
+func Config(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+
+	if err := conf.Print(os.Stdout); err != nil {
+		return fmt.Errorf("printing config: %w", err)
+	}
+	return conf.Validate()
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
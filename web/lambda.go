@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdaurl"
+	"github.com/ryanjarv/assume-role-id/web/pkg"
+	"net/http"
+	"strconv"
+)
+
+// Jobs run from EventBridge schedules, the rule's input is {"job": "<job>"}.
+const (
+	JobReap       = "reap"
+	JobSweep      = "sweep"
+	JobWebhooks   = "webhooks"
+	JobRotateKeys = "rotate-keys"
+)
+
+// StartLambda handles lambda invocations, it doesn't return.
+func StartLambda(ctx *pkg.Context, conf *pkg.Config, args []string) error {
+	h, err := NewHandler(ctx, conf)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	mux, err := h.mux()
+	if err != nil {
+		return err
+	}
+
+	ctx.Debug.Printf("running in lambda mode")
+	lambda.StartHandlerFunc(h.invoke(mux))
+	return nil
+}
+
+// invocation holds the fields used to tell apart what lambda was invoked with.
+type invocation struct {
+	Job        string `json:"job"`
+	DetailType string `json:"detail-type"`
+	Records    []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	RequestContext struct {
+		HTTP struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// invoke dispatches each invocation, function URL requests are served by mux, scheduled events run a job and SQS
+// messages are webhook retries.
+func (h *handler) invoke(mux http.Handler) func(context.Context, json.RawMessage) (any, error) {
+	serve := lambdaurl.Wrap(mux)
+
+	return func(ctx context.Context, payload json.RawMessage) (any, error) {
+		var inv invocation
+		if err := json.Unmarshal(payload, &inv); err != nil {
+			return nil, fmt.Errorf("unmarshalling invocation: %w", err)
+		}
+
+		switch {
+		case inv.Job != "":
+			return h.runJob(h.ctx.WithContext(ctx), inv.Job)
+		case inv.DetailType == "Scheduled Event":
+			// Schedules without a job are from before there was more than one.
+			return h.runJob(h.ctx.WithContext(ctx), JobReap)
+		case len(inv.Records) > 0 && inv.Records[0].EventSource == "aws:sqs":
+			var event events.SQSEvent
+			if err := json.Unmarshal(payload, &event); err != nil {
+				return nil, fmt.Errorf("unmarshalling sqs event: %w", err)
+			}
+			return h.redeliverWebhooks(h.ctx.WithContext(ctx), &event), nil
+		case inv.RequestContext.HTTP.Method != "":
+			var request events.LambdaFunctionURLRequest
+			if err := json.Unmarshal(payload, &request); err != nil {
+				return nil, fmt.Errorf("unmarshalling function url request: %w", err)
+			}
+			return serve(ctx, &request)
+		default:
+			return nil, errors.New("unknown invocation")
+		}
+	}
+}
+
+// runJob runs a scheduled job, lambda logs what's returned.
+func (h *handler) runJob(ctx *pkg.Context, job string) (any, error) {
+	ctx.Debug.Printf("running job %s", job)
+
+	switch job {
+	case JobReap:
+		report, err := pkg.ReapRoles(ctx, h.reapRolesInput())
+		ctx.Info.Println(report)
+		return report, err
+	case JobSweep:
+		h.sweeper.Refresh(ctx)
+		return h.sweeper.Regions(), nil
+	case JobWebhooks:
+		// Roles with webhooks are notified without anyone polling them.
+		return nil, pkg.NotifyWebhooks(ctx, h.pollEventsInput(""))
+	case JobRotateKeys:
+		return nil, h.rotateKeys(ctx)
+	default:
+		return nil, fmt.Errorf("unknown job %q", job)
+	}
+}
+
+// rotateKeys rotates the keyring at SecretName, this instance uses the new keyring straight away.
+func (h *handler) rotateKeys(ctx *pkg.Context) error {
+	keyring, err := pkg.RotateKeyring(ctx, h.ssm, h.conf.SecretName, pkg.MaxRoleTokenLifetime(h.conf.MaxRetention))
+	if err != nil {
+		return fmt.Errorf("rotating keys: %w", err)
+	}
+	h.keyring.Replace(keyring)
+
+	for _, key := range keyring.Keys() {
+		ctx.Info.Printf("key %s: created %s, active at %s, retiring at %s", key.Id, key.Created, key.ActiveAt, key.RetireAt)
+	}
+	return nil
+}
+
+// redeliverWebhooks retries each queued webhook, the ones that failed are reported so only they're received again.
+func (h *handler) redeliverWebhooks(ctx *pkg.Context, event *events.SQSEvent) events.SQSEventResponse {
+	resp := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, record := range event.Records {
+		receives, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+		if err := h.notifier.Redeliver(ctx, record.Body, receives); err != nil {
+			ctx.Info.Printf("redelivering webhook %s: %v", record.MessageId, err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return resp
+}
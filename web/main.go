@@ -3,62 +3,84 @@ package main
 import (
 	"context"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/aws/aws-lambda-go/lambdaurl"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/ryanjarv/assume-role-id/web/pkg"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 )
 
 //go:embed html
 var htmlFs embed.FS
 
-var (
-	accountId      = pkg.MustGetenv("ACCOUNT_ID")
-	bucket         = pkg.MustGetenv("BUCKET")
-	sandboxRoleArn = pkg.MustGetenv("SANDBOX_ROLE_ARN")
-	secretName     = pkg.MustGetenv("SECRET_NAME")
-
-	// Don't go looking around for this, it's a secret.
-	superSecretPathPrefix = pkg.MustGetenv("SUPER_SECRET_PATH_PREFIX")
-)
-
 func main() {
-	err := Run()
+	ctx := pkg.NewContext(context.Background())
+
+	// Flags before the command are config, see pkg.LoadConfig.
+	conf, args, err := pkg.LoadConfig(os.Args[1:], os.Getenv)
 	if err != nil {
 		log.Fatalln(err)
 	}
-}
+	if conf.Debug {
+		ctx.SetLoggingLevel(pkg.DebugLogLevel)
+	}
 
-func Run() error {
-	ctx := pkg.NewContext(context.Background())
+	// Lambda starts the binary without any arguments.
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	} else if _, ok := os.LookupEnv("AWS_LAMBDA_FUNCTION_NAME"); ok {
+		name = "lambda"
+	}
 
-	svcArn, err := arn.Parse(sandboxRoleArn)
-	if err != nil {
-		return fmt.Errorf("parsing svc role arn: %w", err)
+	command, ok := commands[name]
+	if !ok {
+		names := pkg.Keys(commands)
+		sort.Strings(names)
+		log.Fatalf("unknown command %q, expected one of: %s", name, strings.Join(names, ", "))
 	}
 
-	svcAccountCfg, err := config.LoadDefaultConfig(ctx)
+	// The config command shows what's wrong with the config itself.
+	if name != "config" {
+		if err := conf.Validate(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := command(ctx, conf, args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// NewSandboxConfig returns a config using the sandbox role, checking it's actually in the sandbox account.
+func NewSandboxConfig(ctx *pkg.Context, sandboxRoleArn string) (aws.Config, error) {
+	svcArn, err := arn.Parse(sandboxRoleArn)
 	if err != nil {
-		return fmt.Errorf("loading default config: %w", err)
+		return aws.Config{}, fmt.Errorf("parsing svc role arn: %w", err)
 	}
 
 	sandboxAccountCfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		return fmt.Errorf("loading default config: %w", err)
+		return aws.Config{}, fmt.Errorf("loading default config: %w", err)
 	}
 
 	sandboxCreds := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(sandboxAccountCfg), sandboxRoleArn, func(o *stscreds.AssumeRoleOptions) {
@@ -67,64 +89,152 @@ func Run() error {
 	sandboxAccountCfg.Credentials = aws.NewCredentialsCache(sandboxCreds)
 
 	if identity, err := sts.NewFromConfig(sandboxAccountCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}); err != nil {
-		return fmt.Errorf("getting caller identity: %w", err)
+		return aws.Config{}, fmt.Errorf("getting caller identity: %w", err)
 	} else if *identity.Account != svcArn.AccountID {
-		return fmt.Errorf("not in the sandbox account: currently using %s", *identity.Account)
+		return aws.Config{}, fmt.Errorf("not in the sandbox account: currently using %s", *identity.Account)
 	} else {
 		ctx.Debug.Printf("running in account: %s", *identity.Account)
 	}
 
-	if os.Getenv("DEBUG") != "" {
-		ctx.SetLoggingLevel(pkg.DebugLogLevel)
+	return sandboxAccountCfg, nil
+}
+
+// NewHandler loads the AWS config and sets up the clients, store and principal resolvers every command uses.
+func NewHandler(ctx *pkg.Context, conf *pkg.Config) (*handler, error) {
+	svcAccountCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading default config: %w", err)
 	}
 
-	scanner, err := pkg.NewScanner(&pkg.NewScannerInput{
-		Config:    svcAccountCfg,
-		AccountId: accountId,
-		Bucket:    bucket,
-	})
+	sandboxAccountCfg, err := NewSandboxConfig(ctx, conf.SandboxRoleArn)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewStore(svcAccountCfg, conf)
+	if err != nil {
+		return nil, fmt.Errorf("creating store: %w", err)
+	}
+
+	principalCache, err := NewPrincipalCache(svcAccountCfg, conf, store)
 	if err != nil {
-		return fmt.Errorf("creating scanner: %w", err)
+		return nil, fmt.Errorf("creating principal cache: %w", err)
 	}
 
+	resolvers, err := NewPrincipalResolvers(svcAccountCfg, sandboxAccountCfg, conf)
+	if err != nil {
+		return nil, fmt.Errorf("creating principal resolvers: %w", err)
+	}
+
+	resolver := pkg.NewChainResolver(&pkg.NewChainResolverInput{
+		Cache:       principalCache,
+		PositiveTTL: conf.PrincipalCacheTTL,
+		NegativeTTL: conf.PrincipalCacheNegativeTTL,
+		Resolvers:   resolvers,
+	})
+
 	regions, err := GetEnabledRegions(sandboxAccountCfg, ctx)
 	if err != nil {
-		return fmt.Errorf("getting enabled regions: %w", err)
+		return nil, fmt.Errorf("getting enabled regions: %w", err)
 	}
 
-	h := &handler{
+	cloudtrailClients := GetCloudtrailClients(sandboxAccountCfg, regions)
+
+	ssmClient := ssm.NewFromConfig(svcAccountCfg)
+	keyring, err := pkg.GetOrGenerateKeyring(ctx, ssmClient, conf.SecretName)
+	if err != nil {
+		return nil, fmt.Errorf("getting keyring: %w", err)
+	}
+	keyring.SetReload(func() (*pkg.Keyring, error) {
+		return pkg.GetKeyring(ctx, ssmClient, conf.SecretName)
+	})
+
+	notifier := pkg.NewNotifier(store, keyring)
+	if conf.WebhookQueueUrl != "" {
+		notifier.Sqs = sqs.NewFromConfig(svcAccountCfg)
+		notifier.QueueUrl = conf.WebhookQueueUrl
+	}
+
+	ctx.Debug.Printf("account id: %s, bucket: %s", conf.AccountId, conf.Bucket)
+
+	return &handler{
 		ctx:        ctx,
+		conf:       conf,
 		iam:        iam.NewFromConfig(sandboxAccountCfg),
-		cloudtrail: GetCloudtrailClients(sandboxAccountCfg, regions),
-		scanner:    scanner,
-		secret:     pkg.Must(pkg.GetOrGenerateSecret(ctx, ssm.NewFromConfig(svcAccountCfg), secretName)),
-	}
-	ctx.Debug.Printf("account id: %s, bucket: %s", h.scanner.AccountId, h.scanner.BucketName)
+		ssm:        ssmClient,
+		cloudtrail: cloudtrailClients,
+		resolver:   resolver,
+		store:      store,
+		// Roles can be kept for up to MaxRetention, so the sweeper needs to look back that far.
+		sweeper: pkg.NewSweeper(&pkg.NewSweeperInput{
+			CloudTrail: cloudtrailClients,
+			Interval:   conf.SweepInterval,
+			Lookback:   conf.MaxRetention,
+		}),
+		notifier: notifier,
+		keyring:  keyring,
+	}, nil
+}
 
-	sub, err := fs.Sub(htmlFs, "html")
-	if err != nil {
-		return fmt.Errorf("getting sub filesystem: %w", err)
+// NewStore uses DynamoDB when TableName is set, otherwise a local database at StorePath.
+func NewStore(cfg aws.Config, conf *pkg.Config) (pkg.Store, error) {
+	if conf.TableName != "" {
+		return pkg.NewDynamoDBStore(dynamodb.NewFromConfig(cfg), conf.TableName), nil
 	}
-	prefix := "/" + superSecretPathPrefix
-	mux := http.NewServeMux()
+	return pkg.NewBoltStore(conf.StorePath)
+}
 
-	mux.Handle(prefix+"/", http.StripPrefix(prefix, http.FileServerFS(sub)))
-	mux.HandleFunc(prefix+"/role/", h.provisionRole)
-	mux.HandleFunc(prefix+"/role/{name}", h.provisionRole)
-	mux.HandleFunc(prefix+"/poll/{token}", h.pollEvents)
+// NewPrincipalCache picks the principal cache backend from PrincipalCache, either "store" (the default), "s3" for
+// objects under principals/ in Bucket, or "file" for a JSON file at PrincipalCachePath.
+func NewPrincipalCache(cfg aws.Config, conf *pkg.Config, store pkg.Store) (pkg.PrincipalCache, error) {
+	switch backend := conf.PrincipalCache; backend {
+	case "", "store":
+		return store, nil
+	case "s3":
+		return pkg.NewS3PrincipalCache(s3.NewFromConfig(cfg), conf.Bucket, "principals"), nil
+	case "file":
+		return pkg.NewFilePrincipalCache(conf.PrincipalCachePath)
+	default:
+		return nil, fmt.Errorf("unknown principal cache %q", backend)
+	}
+}
 
-	if _, ok := os.LookupEnv("AWS_LAMBDA_FUNCTION_NAME"); ok {
-		ctx.Debug.Printf("running in lambda mode")
-		lambdaurl.Start(mux)
-	} else {
-		ctx.Debug.Printf("running in web server mode")
-		err := http.ListenAndServe(":8090", mux)
-		if err != nil {
-			return fmt.Errorf("listening and serving: %w", err)
+// NewPrincipalResolvers returns the resolvers named in PrincipalResolvers, in order. They're "access-point", using
+// access points named AccessPointName on Bucket, "iam-role", using the trust policy of PrincipalResolverRole in the
+// sandbox account, and "sqs", using the policy of the queue at PrincipalResolverQueueUrl.
+func NewPrincipalResolvers(svcCfg, sandboxCfg aws.Config, conf *pkg.Config) ([]pkg.PrincipalResolver, error) {
+	var resolvers []pkg.PrincipalResolver
+	for _, name := range conf.PrincipalResolvers {
+		switch name {
+		case "access-point":
+			scanner, err := pkg.NewScanner(&pkg.NewScannerInput{
+				Config:    svcCfg,
+				AccountId: conf.AccountId,
+				Bucket:    conf.Bucket,
+				Name:      conf.AccessPointName,
+				Region:    conf.ScannerRegion,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("creating scanner: %w", err)
+			}
+			resolvers = append(resolvers, scanner)
+		case "iam-role":
+			resolvers = append(resolvers, pkg.NewIamRoleResolver(&pkg.NewIamRoleResolverInput{
+				Iam:         iam.NewFromConfig(sandboxCfg),
+				RoleName:    conf.PrincipalResolverRole,
+				BoundaryArn: conf.SandboxBoundaryArn(),
+			}))
+		case "sqs":
+			resolvers = append(resolvers, pkg.NewSqsResolver(&pkg.NewSqsResolverInput{
+				Sqs:      sqs.NewFromConfig(svcCfg),
+				QueueUrl: conf.PrincipalResolverQueueUrl,
+			}))
+		default:
+			return nil, fmt.Errorf("unknown principal resolver %q", name)
 		}
 	}
 
-	return nil
+	return resolvers, nil
 }
 
 func GetCloudtrailClients(cfg aws.Config, regions []string) map[string]*cloudtrail.Client {
@@ -139,27 +249,123 @@ func GetCloudtrailClients(cfg aws.Config, regions []string) map[string]*cloudtra
 
 type handler struct {
 	ctx        *pkg.Context
+	conf       *pkg.Config
 	iam        *iam.Client
+	ssm        *ssm.Client
 	cloudtrail map[string]*cloudtrail.Client
-	accountId  string
-	scanner    *pkg.Scanner
-	secret     []byte
+	resolver   pkg.PrincipalResolver
+	store      pkg.Store
+	sweeper    *pkg.Sweeper
+	notifier   *pkg.Notifier
+	keyring    *pkg.Keyring
+}
+
+// Close closes the store.
+func (h *handler) Close() error {
+	return h.store.Close()
+}
+
+// mux routes the web endpoints, under PathPrefix.
+func (h *handler) mux() (*http.ServeMux, error) {
+	sub, err := fs.Sub(htmlFs, "html")
+	if err != nil {
+		return nil, fmt.Errorf("getting sub filesystem: %w", err)
+	}
+	// Don't go looking around for this, it's a secret.
+	prefix := "/" + h.conf.PathPrefix
+	mux := http.NewServeMux()
+
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, http.FileServerFS(sub)))
+	mux.HandleFunc(prefix+"/role/", h.provisionRole)
+	mux.HandleFunc(prefix+"/role/{name}", h.provisionRole)
+	mux.HandleFunc(prefix+"/role/{token}/delete", h.deleteRole)
+	mux.HandleFunc(prefix+"/role/{token}/extend", h.extendRole)
+	mux.HandleFunc(prefix+"/poll/{token}", h.pollEvents)
+	mux.HandleFunc(prefix+"/watch/{token}", h.watchEvents)
+	mux.HandleFunc(prefix+"/id/{value}", h.decodeId)
+
+	return mux, nil
 }
 
 // NOTE: We're using GET requests here because cloudFront + lambda urls seem to have issues with POST requests.
 //
 //	See: https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/private-content-restricting-access-to-lambda.html#create-oac-overview-lambda
+//
+// The one exception is SAML metadata, which is often too large for a URL, it can be POSTed as the raw XML with
+// trust=saml and the rest of the parameters in the query. Behind CloudFront the x-amz-content-sha256 header must be set
+// to the hex SHA-256 of the body.
 func (h *handler) provisionRole(w http.ResponseWriter, r *http.Request) {
 	roleName := r.PathValue("name")
 	h.ctx.Debug.Printf("got request to create role %s", roleName)
 
-	requireExternalId := false
-	if v := r.URL.Query().Get("requireExternalId"); strings.ToLower(v) != "true" {
-		requireExternalId = true
+	query := r.URL.Query()
+	requireExternalId := strings.ToLower(query.Get("requireExternalId")) == "true"
+	ownerSecret := r.Header.Get(pkg.OwnerSecretHeader)
+	if query.Has("owner") {
+		http.Error(w, "the owner secret must be passed in the "+pkg.OwnerSecretHeader+" header", http.StatusBadRequest)
+		return
+	}
+
+	trust := pkg.TrustPolicyFromQuery(query)
+	if r.Method == http.MethodPost {
+		if trust == nil || trust.Template != "saml" || trust.Params["metadata"] != "" {
+			http.Error(w, "a request body is only accepted as the metadata of trust=saml", http.StatusBadRequest)
+			return
+		}
+		metadata, err := io.ReadAll(http.MaxBytesReader(w, r.Body, pkg.MaxSAMLMetadataSize))
+		if err != nil {
+			h.ctx.Info.Printf("reading saml metadata: %v", err)
+			http.Error(w, "metadata is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		trust.Params["metadata"] = base64.RawURLEncoding.EncodeToString(metadata)
 	}
 
-	result, err := pkg.CreateRole(h.ctx, h.iam, roleName, requireExternalId, h.secret)
-	if err != nil {
+	var webhook *pkg.Webhook
+	if v := query.Get("webhook"); v != "" {
+		webhook = &pkg.Webhook{URL: v, Secret: query.Get("webhook_secret")}
+	}
+
+	result, err := pkg.CreateRole(h.ctx, &pkg.CreateRoleInput{
+		Iam:               h.iam,
+		Store:             h.store,
+		Keyring:           h.keyring,
+		RoleName:          roleName,
+		RequireExternalId: requireExternalId,
+		Trust:             trust,
+		PermissionProfile: query.Get("profile"),
+		Webhook:           webhook,
+		OwnerSecret:       ownerSecret,
+		Retention:         query.Get("retention"),
+		DefaultRetention:  h.conf.DefaultRetention,
+		MaxRetention:      h.conf.MaxRetention,
+		BoundaryArn:       h.conf.SandboxBoundaryArn(),
+		ReservedRoleNames: []string{h.conf.PrincipalResolverRole},
+		TrustOptions: &pkg.TrustOptions{
+			AccountId:        h.conf.SandboxAccountId(),
+			OIDCIssuers:      h.conf.OIDCIssuers,
+			MaxSAMLProviders: h.conf.MaxSAMLProviders,
+		},
+	})
+	if errors.Is(err, pkg.ErrInvalidTrustPolicy) || errors.Is(err, pkg.ErrInvalidPermissionProfile) ||
+		errors.Is(err, pkg.ErrInvalidWebhook) || errors.Is(err, pkg.ErrInvalidRetention) ||
+		errors.Is(err, pkg.ErrInvalidOwnerSecret) {
+		h.ctx.Info.Printf("creating role: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, pkg.ErrRoleOwnedByOther) {
+		h.ctx.Info.Printf("creating role: %v", err)
+		http.Error(w, "role name is already in use", http.StatusConflict)
+		return
+	} else if errors.Is(err, pkg.ErrReservedRoleName) {
+		h.ctx.Info.Printf("creating role: %v", err)
+		http.Error(w, "role name is reserved", http.StatusConflict)
+		return
+	} else if errors.Is(err, pkg.ErrProviderLimit) {
+		h.ctx.Info.Printf("creating role: %v", err)
+		http.Error(w, "too many identity providers, try again later", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		h.ctx.Error.Printf("creating role: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
@@ -182,14 +388,10 @@ func (h *handler) provisionRole(w http.ResponseWriter, r *http.Request) {
 func (h *handler) pollEvents(w http.ResponseWriter, r *http.Request) {
 	h.ctx.Debug.Printf("got request to poll events with token %s", r.PathValue("token"))
 
-	result, err := pkg.PollEvents(h.ctx, &pkg.PollEventsInput{
-		Token:      r.PathValue("token"),
-		Iam:        h.iam,
-		CloudTrail: h.cloudtrail,
-		Scanner:    h.scanner,
-		Secret:     h.secret,
-	})
-	if err != nil {
+	result, err := pkg.PollEvents(h.ctx.WithContext(r.Context()), h.pollEventsInput(r.PathValue("token")))
+	if h.tokenError(w, err) {
+		return
+	} else if err != nil {
 		h.ctx.Error.Printf("polling events: %v", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
@@ -211,6 +413,164 @@ func (h *handler) pollEvents(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// watchEvents streams new events as Server-Sent Events, see pkg.WatchEvents.
+func (h *handler) watchEvents(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	h.ctx.Debug.Printf("got request to watch events with token %s", token)
+
+	// Check the token before committing to a streaming response.
+	if _, err := pkg.CheckRoleToken(h.ctx.WithContext(r.Context()), h.store, token, h.keyring); h.tokenError(w, err) {
+		return
+	} else if err != nil {
+		h.ctx.Error.Printf("checking token: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	stream := pkg.NewEventStream(w)
+
+	if err := pkg.WatchEvents(h.ctx.WithContext(r.Context()), &pkg.WatchEventsInput{
+		PollEventsInput: h.pollEventsInput(token),
+		LastEventId:     r.Header.Get("Last-Event-ID"),
+	}, stream); err != nil {
+		h.ctx.Error.Printf("watching events: %v", err)
+	}
+}
+
+// deleteRole deletes the role an owner token was issued for and revokes it, see pkg.DeleteRoleWithToken.
+//
+// This is a GET for the same reason as provisionRole.
+func (h *handler) deleteRole(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	h.ctx.Debug.Printf("got request to delete role with token %s", token)
+
+	result, err := pkg.DeleteRoleWithToken(h.ctx.WithContext(r.Context()), &pkg.DeleteRoleWithTokenInput{
+		PollEventsInput: h.pollEventsInput(token),
+	})
+	if h.tokenError(w, err) {
+		return
+	} else if err != nil {
+		h.ctx.Error.Printf("deleting role: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	resp, err := json.Marshal(result)
+	if err != nil {
+		h.ctx.Error.Printf("marshalling result: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resp); err != nil {
+		h.ctx.Error.Printf("writing response: %v", err)
+	}
+}
+
+// extendRole keeps the role an owner token was issued for longer, see pkg.ExtendRole.
+//
+// This is a GET for the same reason as provisionRole.
+func (h *handler) extendRole(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	h.ctx.Debug.Printf("got request to extend role with token %s", token)
+
+	result, err := pkg.ExtendRole(h.ctx.WithContext(r.Context()), &pkg.ExtendRoleInput{
+		Token:            token,
+		Iam:              h.iam,
+		Store:            h.store,
+		Keyring:          h.keyring,
+		Retention:        r.URL.Query().Get("retention"),
+		DefaultRetention: h.conf.DefaultRetention,
+		MaxRetention:     h.conf.MaxRetention,
+	})
+	if h.tokenError(w, err) {
+		return
+	} else if errors.Is(err, pkg.ErrInvalidRetention) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, pkg.ErrRoleNotFound) {
+		http.Error(w, "role no longer exists", http.StatusNotFound)
+		return
+	} else if err != nil {
+		h.ctx.Error.Printf("extending role: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	resp, err := json.Marshal(result)
+	if err != nil {
+		h.ctx.Error.Printf("marshalling result: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resp); err != nil {
+		h.ctx.Error.Printf("writing response: %v", err)
+	}
+}
+
+// tokenError writes the response for errors about the token itself, returning false for any other error.
+func (h *handler) tokenError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, pkg.ErrRoleTokenExpired):
+		http.Error(w, "token has expired", http.StatusBadRequest)
+	case errors.Is(err, pkg.ErrRoleTokenRevoked):
+		http.Error(w, "token has been revoked", http.StatusForbidden)
+	case errors.Is(err, pkg.ErrRoleTokenScope):
+		http.Error(w, "token doesn't allow this", http.StatusForbidden)
+	case errors.Is(err, pkg.ErrInvalidRoleToken):
+		h.ctx.Info.Printf("invalid token: %v", err)
+		http.Error(w, "invalid token", http.StatusBadRequest)
+	default:
+		return false
+	}
+	return true
+}
+
+// decodeId classifies a unique ID or access key ID offline, see pkg.DecodeUniqueId.
+func (h *handler) decodeId(w http.ResponseWriter, r *http.Request) {
+	id, err := pkg.DecodeUniqueId(r.PathValue("value"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	resp, err := json.Marshal(id)
+	if err != nil {
+		h.ctx.Error.Printf("marshalling id: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := w.Write(resp); err != nil {
+		h.ctx.Error.Printf("writing response: %v", err)
+	}
+}
+
+func (h *handler) reapRolesInput() *pkg.ReapRolesInput {
+	return &pkg.ReapRolesInput{Iam: h.iam}
+}
+
+func (h *handler) pollEventsInput(token string) *pkg.PollEventsInput {
+	return &pkg.PollEventsInput{
+		Token:      token,
+		Iam:        h.iam,
+		CloudTrail: h.cloudtrail,
+		Resolver:   h.resolver,
+		Sweeper:    h.sweeper,
+		Store:      h.store,
+		Keyring:    h.keyring,
+		Notifier:   h.notifier,
+	}
+}
+
 func GetEnabledRegions(cfg aws.Config, ctx *pkg.Context) ([]string, error) {
 	var regions []string
 	ec2Client := ec2.NewFromConfig(cfg)
@@ -0,0 +1,375 @@
+package pkg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidConfig is wrapped by the error Config.Validate returns.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// ConfigFileEnv names the config file when the -config flag isn't given.
+const ConfigFileEnv = "CONFIG_FILE"
+
+// Redacted replaces secret values in Config.Print.
+const Redacted = "<redacted>"
+
+var (
+	PrincipalResolverNames = []string{"access-point", "iam-role", "sqs"}
+	PrincipalCacheNames    = []string{"store", "s3", "file"}
+)
+
+// Config is everything the binary can be configured with.
+//
+// Each field is set from, in increasing precedence, its default in NewConfig, the yaml key in the config file, the
+// environment variable and the flag, which is the yaml key with dashes. Lists are comma separated in the environment
+// and flags.
+type Config struct {
+	AccountId      string `yaml:"account_id" env:"ACCOUNT_ID" help:"ID of the service account"`
+	Bucket         string `yaml:"bucket" env:"BUCKET" help:"bucket in the service account used by the access-point resolver"`
+	SandboxRoleArn string `yaml:"sandbox_role_arn" env:"SANDBOX_ROLE_ARN" help:"role assumed in the sandbox account"`
+	SecretName     string `yaml:"secret_name" env:"SECRET_NAME" help:"SSM parameter the token keyring is kept under"`
+	PathPrefix     string `yaml:"path_prefix" env:"SUPER_SECRET_PATH_PREFIX" secret:"true" help:"path every endpoint is served under"`
+	Listen         string `yaml:"listen" env:"LISTEN_ADDR" help:"address the web server listens on"`
+	Debug          bool   `yaml:"debug" env:"DEBUG" help:"log debug messages"`
+
+	TableName string `yaml:"table_name" env:"TABLE_NAME" help:"DynamoDB table to store roles and events in, store_path is used when empty"`
+	StorePath string `yaml:"store_path" env:"STORE_PATH" help:"local database to store roles and events in"`
+
+	BoundaryArn      string        `yaml:"boundary_arn" env:"BOUNDARY_ARN" help:"permissions boundary of created roles, SandboxBoundaryPolicy in the sandbox role's account when empty"`
+	DefaultRetention time.Duration `yaml:"default_retention" env:"DEFAULT_ROLE_RETENTION" help:"how long roles are kept when no retention is asked for"`
+	MaxRetention     time.Duration `yaml:"max_retention" env:"MAX_ROLE_RETENTION" help:"the longest retention that can be asked for"`
+	OIDCIssuers      []string      `yaml:"oidc_issuers" env:"OIDC_ISSUERS" help:"issuers the oidc trust template accepts, without https://"`
+	MaxSAMLProviders int           `yaml:"max_saml_providers" env:"MAX_SAML_PROVIDERS" help:"how many SAML providers the saml trust template can create"`
+
+	PrincipalResolvers        []string      `yaml:"principal_resolvers" env:"PRINCIPAL_RESOLVERS" help:"principal resolvers to try in order, access-point, iam-role or sqs"`
+	PrincipalResolverRole     string        `yaml:"principal_resolver_role" env:"PRINCIPAL_RESOLVER_ROLE" help:"role used by the iam-role resolver"`
+	PrincipalResolverQueueUrl string        `yaml:"principal_resolver_queue_url" env:"PRINCIPAL_RESOLVER_QUEUE_URL" help:"queue used by the sqs resolver"`
+	PrincipalCache            string        `yaml:"principal_cache" env:"PRINCIPAL_CACHE" help:"where resolved principals are cached, store, s3 or file"`
+	PrincipalCachePath        string        `yaml:"principal_cache_path" env:"PRINCIPAL_CACHE_PATH" help:"file used by the file principal cache"`
+	PrincipalCacheTTL         time.Duration `yaml:"principal_cache_ttl" env:"PRINCIPAL_CACHE_TTL" help:"how long resolved principals are cached"`
+	PrincipalCacheNegativeTTL time.Duration `yaml:"principal_cache_negative_ttl" env:"PRINCIPAL_CACHE_NEGATIVE_TTL" help:"how long principals that didn't resolve are cached"`
+	ScannerRegion             string        `yaml:"scanner_region" env:"SCANNER_REGION" help:"region the access-point resolver uses, the AWS config's region when empty"`
+	AccessPointName           string        `yaml:"access_point_name" env:"ACCESS_POINT_NAME" help:"prefix of the access-point resolver's access points"`
+
+	SweepInterval         time.Duration `yaml:"sweep_interval" env:"SWEEP_INTERVAL" help:"minimum time between CloudTrail sweeps"`
+	WebhookPollInterval   time.Duration `yaml:"webhook_poll_interval" env:"WEBHOOK_POLL_INTERVAL" help:"how often the web server polls roles with webhooks"`
+	ReaperInterval        time.Duration `yaml:"reaper_interval" env:"REAPER_INTERVAL" help:"how often the web server deletes expired roles"`
+	KeyringReloadInterval time.Duration `yaml:"keyring_reload_interval" env:"KEYRING_RELOAD_INTERVAL" help:"how often the web server reloads the keyring, under a day so rotated keys are seen before they're used"`
+	WebhookQueueUrl       string        `yaml:"webhook_queue_url" env:"WEBHOOK_QUEUE_URL" help:"queue failed webhooks are retried from"`
+}
+
+// NewConfig returns the defaults.
+func NewConfig() *Config {
+	return &Config{
+		Listen:                    ":8090",
+		StorePath:                 "assume-role-id.db",
+		DefaultRetention:          KeepRolesFor,
+		MaxRetention:              DefaultMaxRoleRetention,
+		OIDCIssuers:               []string{DefaultOIDCIssuer},
+		MaxSAMLProviders:          DefaultMaxSAMLProviders,
+		PrincipalResolvers:        []string{"access-point"},
+		PrincipalResolverRole:     DefaultResolverRoleName,
+		PrincipalCache:            "store",
+		PrincipalCachePath:        "principals.json",
+		PrincipalCacheTTL:         PrincipalPositiveTTL,
+		PrincipalCacheNegativeTTL: PrincipalNegativeTTL,
+		AccessPointName:           "assume-role-id",
+		SweepInterval:             SweepInterval,
+		WebhookPollInterval:       WebhookPollInterval,
+		ReaperInterval:            ReaperInterval,
+		KeyringReloadInterval:     KeyringReloadInterval,
+	}
+}
+
+// LoadConfig loads the config from the defaults, the file named by the -config flag or ConfigFileEnv, the environment
+// from getenv and the flags at the start of args. The arguments after the flags are returned.
+//
+// The config isn't validated, see Validate.
+func LoadConfig(args []string, getenv func(string) string) (*Config, []string, error) {
+	config := NewConfig()
+
+	// Flags are parsed first to find the file, but applied last.
+	flags := flag.NewFlagSet("assume-role-id", flag.ContinueOnError)
+	path := flags.String("config", getenv(ConfigFileEnv), "yaml or json config file")
+
+	var flagValues [][2]string
+	config.fields(func(field reflect.StructField, _ reflect.Value) {
+		name := strings.ReplaceAll(field.Tag.Get("yaml"), "_", "-")
+		set := func(value string) error {
+			flagValues = append(flagValues, [2]string{field.Name, value})
+			return nil
+		}
+		if field.Type.Kind() == reflect.Bool {
+			flags.BoolFunc(name, field.Tag.Get("help"), set)
+		} else {
+			flags.Func(name, field.Tag.Get("help"), set)
+		}
+	})
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, fmt.Errorf("parsing flags: %w", err)
+	}
+
+	if *path != "" {
+		if err := config.loadFile(*path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var errs []error
+	config.fields(func(field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		if v := getenv(env); v != "" {
+			if err := setConfigValue(value, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	})
+	for _, flagValue := range flagValues {
+		field, _ := reflect.TypeOf(config).Elem().FieldByName(flagValue[0])
+		value := reflect.ValueOf(config).Elem().FieldByName(flagValue[0])
+		if err := setConfigValue(value, flagValue[1]); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", strings.ReplaceAll(field.Tag.Get("yaml"), "_", "-"), err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	return config, flags.Args(), nil
+}
+
+// loadFile reads yaml, or json since it's also yaml, from path over the current values.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) fields(fn func(field reflect.StructField, value reflect.Value)) {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		fn(v.Type().Field(i), v.Field(i))
+	}
+}
+
+func setConfigValue(value reflect.Value, s string) error {
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", s)
+		}
+		value.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", s)
+		}
+		value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't a duration like 1h30m", s)
+		}
+		value.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+var accountIdRegex = regexp.MustCompile(`^\d{12}$`)
+
+// Validate returns everything wrong with the config at once, one problem per line.
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(name, format string, args ...any) {
+		field, _ := reflect.TypeOf(c).Elem().FieldByName(name)
+		problems = append(problems, fmt.Sprintf("%s (%s) %s", field.Tag.Get("yaml"), field.Tag.Get("env"), fmt.Sprintf(format, args...)))
+	}
+	required := func(name, value string) bool {
+		if value == "" {
+			invalid(name, "is required")
+		}
+		return value != ""
+	}
+
+	if required("AccountId", c.AccountId) && !accountIdRegex.MatchString(c.AccountId) {
+		invalid("AccountId", "must be 12 digits, got %q", c.AccountId)
+	}
+	required("Bucket", c.Bucket)
+	if required("SandboxRoleArn", c.SandboxRoleArn) {
+		if parsed, err := arn.Parse(c.SandboxRoleArn); err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+			invalid("SandboxRoleArn", "must be an IAM role ARN, got %q", c.SandboxRoleArn)
+		}
+	}
+	if required("SecretName", c.SecretName) && !strings.HasPrefix(c.SecretName, "/") {
+		invalid("SecretName", "must start with /, got %q", c.SecretName)
+	}
+	if required("PathPrefix", c.PathPrefix) && strings.Contains(c.PathPrefix, "/") {
+		invalid("PathPrefix", "must not contain /")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		invalid("Listen", "must be a host:port address, got %q", c.Listen)
+	}
+	if c.TableName == "" {
+		required("StorePath", c.StorePath)
+	}
+
+	if c.BoundaryArn != "" {
+		if parsed, err := arn.Parse(c.BoundaryArn); err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "policy/") {
+			invalid("BoundaryArn", "must be an IAM policy ARN, got %q", c.BoundaryArn)
+		}
+	}
+	if c.MaxRetention <= 0 {
+		invalid("MaxRetention", "must be positive, got %s", c.MaxRetention)
+	}
+	if c.DefaultRetention <= 0 || c.DefaultRetention > c.MaxRetention {
+		invalid("DefaultRetention", "must be positive and at most max_retention (%s), got %s", c.MaxRetention, c.DefaultRetention)
+	}
+	for _, issuer := range c.OIDCIssuers {
+		if !oidcIssuerPattern.MatchString(issuer) {
+			invalid("OIDCIssuers", "must be issuers without https://, got %q", issuer)
+		}
+	}
+	if c.MaxSAMLProviders < 0 {
+		invalid("MaxSAMLProviders", "must not be negative, got %d", c.MaxSAMLProviders)
+	}
+
+	if len(c.PrincipalResolvers) == 0 {
+		invalid("PrincipalResolvers", "needs at least one resolver")
+	}
+	for _, name := range c.PrincipalResolvers {
+		if !slices.Contains(PrincipalResolverNames, name) {
+			invalid("PrincipalResolvers", "has unknown resolver %q, expected one of %s", name, strings.Join(PrincipalResolverNames, ", "))
+		}
+	}
+	if slices.Contains(c.PrincipalResolvers, "iam-role") {
+		required("PrincipalResolverRole", c.PrincipalResolverRole)
+	}
+	if slices.Contains(c.PrincipalResolvers, "sqs") && required("PrincipalResolverQueueUrl", c.PrincipalResolverQueueUrl) {
+		if u, err := url.Parse(c.PrincipalResolverQueueUrl); err != nil || u.Scheme != "https" {
+			invalid("PrincipalResolverQueueUrl", "must be an https URL, got %q", c.PrincipalResolverQueueUrl)
+		}
+	}
+	if slices.Contains(c.PrincipalResolvers, "access-point") {
+		required("AccessPointName", c.AccessPointName)
+	}
+	if !slices.Contains(PrincipalCacheNames, c.PrincipalCache) {
+		invalid("PrincipalCache", "must be one of %s, got %q", strings.Join(PrincipalCacheNames, ", "), c.PrincipalCache)
+	} else if c.PrincipalCache == "file" {
+		required("PrincipalCachePath", c.PrincipalCachePath)
+	}
+	if c.PrincipalCacheTTL <= 0 {
+		invalid("PrincipalCacheTTL", "must be positive, got %s", c.PrincipalCacheTTL)
+	}
+	if c.PrincipalCacheNegativeTTL <= 0 {
+		invalid("PrincipalCacheNegativeTTL", "must be positive, got %s", c.PrincipalCacheNegativeTTL)
+	}
+
+	if c.SweepInterval <= 0 {
+		invalid("SweepInterval", "must be positive, got %s", c.SweepInterval)
+	}
+	if c.WebhookPollInterval <= 0 {
+		invalid("WebhookPollInterval", "must be positive, got %s", c.WebhookPollInterval)
+	}
+	if c.ReaperInterval <= 0 {
+		invalid("ReaperInterval", "must be positive, got %s", c.ReaperInterval)
+	}
+	if c.KeyringReloadInterval <= 0 || c.KeyringReloadInterval >= KeyActivationDelay {
+		invalid("KeyringReloadInterval", "must be positive and under %s, got %s", KeyActivationDelay, c.KeyringReloadInterval)
+	}
+	if c.WebhookQueueUrl != "" {
+		if u, err := url.Parse(c.WebhookQueueUrl); err != nil || u.Scheme != "https" {
+			invalid("WebhookQueueUrl", "must be an https URL, got %q", c.WebhookQueueUrl)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w:\n\t%s", ErrInvalidConfig, strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// SandboxAccountId returns the account of SandboxRoleArn, which roles and identity providers are created in.
+func (c *Config) SandboxAccountId() string {
+	parsed, err := arn.Parse(c.SandboxRoleArn)
+	if err != nil {
+		return ""
+	}
+	return parsed.AccountID
+}
+
+// SandboxBoundaryArn returns BoundaryArn, or SandboxBoundaryPolicyName in the sandbox account when it's empty.
+func (c *Config) SandboxBoundaryArn() string {
+	if c.BoundaryArn != "" {
+		return c.BoundaryArn
+	}
+	return SandboxBoundaryArn(c.SandboxAccountId())
+}
+
+// Print writes the config as yaml that can be loaded again, with secret values replaced by Redacted.
+func (c *Config) Print(w io.Writer) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	var errs []error
+	c.fields(func(field reflect.StructField, value reflect.Value) {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: field.Tag.Get("yaml"), HeadComment: field.Tag.Get("help")}
+
+		var node yaml.Node
+		switch v := value.Interface().(type) {
+		case time.Duration:
+			node.SetString(v.String())
+		case string:
+			if v != "" && field.Tag.Get("secret") == "true" {
+				v = Redacted
+			}
+			node.SetString(v)
+		default:
+			if err := node.Encode(v); err != nil {
+				errs = append(errs, fmt.Errorf("encoding %s: %w", field.Name, err))
+				return
+			}
+		}
+		doc.Content = append(doc.Content, key, &node)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(doc)
+}
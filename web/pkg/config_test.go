@@ -0,0 +1,275 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testConfigEnv = map[string]string{
+	"ACCOUNT_ID":               "123456789012",
+	"BUCKET":                   "bucket",
+	"SANDBOX_ROLE_ARN":         "arn:aws:iam::210987654321:role/sandbox",
+	"SECRET_NAME":              "/assume-role-id/keyring",
+	"SUPER_SECRET_PATH_PREFIX": "hunter2",
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("bucket: from-file\nmax_retention: 48h\nprincipal_resolvers: [sqs]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		want     func(c *Config)
+		wantArgs []string
+		wantErr  bool
+	}{
+		{
+			name: "Defaults",
+			env:  testConfigEnv,
+			want: func(c *Config) {},
+		},
+		{
+			name:     "Env and flags",
+			args:     []string{"-listen", ":9000", "-debug", "-principal-resolvers", "iam-role, sqs", "-max-saml-providers", "10", "reap", "-dry-run"},
+			env:      map[string]string{"LISTEN_ADDR": ":8080", "MAX_ROLE_RETENTION": "72h"},
+			wantArgs: []string{"reap", "-dry-run"},
+			want: func(c *Config) {
+				c.Listen = ":9000"
+				c.Debug = true
+				c.PrincipalResolvers = []string{"iam-role", "sqs"}
+				c.MaxSAMLProviders = 10
+				c.MaxRetention = 72 * time.Hour
+			},
+		},
+		{
+			name: "File under env and flags",
+			args: []string{"-config", file, "-bucket", "from-flag"},
+			env:  map[string]string{"MAX_ROLE_RETENTION": "24h"},
+			want: func(c *Config) {
+				c.Bucket = "from-flag"
+				c.MaxRetention = 24 * time.Hour
+				c.PrincipalResolvers = []string{"sqs"}
+			},
+		},
+		{
+			name: "File from env",
+			env:  map[string]string{ConfigFileEnv: file},
+			want: func(c *Config) {
+				c.Bucket = "from-file"
+				c.MaxRetention = 48 * time.Hour
+				c.PrincipalResolvers = []string{"sqs"}
+			},
+		},
+		{
+			name:    "Bad values",
+			args:    []string{"-reaper-interval", "often"},
+			env:     map[string]string{"DEBUG": "yes"},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown flag",
+			args:    []string{"-nope"},
+			wantErr: true,
+		},
+		{
+			name:    "Missing file",
+			args:    []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, args, err := LoadConfig(tt.args, func(name string) string { return tt.env[name] })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			} else if err != nil {
+				return
+			}
+
+			want := NewConfig()
+			for name, value := range tt.env {
+				if name != ConfigFileEnv {
+					want.fields(func(field reflect.StructField, v reflect.Value) {
+						if field.Tag.Get("env") == name {
+							_ = setConfigValue(v, value)
+						}
+					})
+				}
+			}
+			tt.want(want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("LoadConfig() = %+v, want %+v", got, want)
+			}
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("LoadConfig() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnknownFileKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"bukket": "typo"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := LoadConfig([]string{"-config", file}, func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), "bukket") {
+		t.Errorf("LoadConfig() error = %v, want one naming bukket", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		c, _, err := LoadConfig(nil, func(name string) string { return testConfigEnv[name] })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{
+			name:   "Valid",
+			modify: func(c *Config) {},
+		},
+		{
+			name: "Missing",
+			modify: func(c *Config) {
+				c.AccountId = ""
+				c.PathPrefix = ""
+			},
+			want: []string{
+				"account_id (ACCOUNT_ID) is required",
+				"path_prefix (SUPER_SECRET_PATH_PREFIX) is required",
+			},
+		},
+		{
+			name: "Invalid",
+			modify: func(c *Config) {
+				c.SandboxRoleArn = "arn:aws:iam::210987654321:user/sandbox"
+				c.DefaultRetention = 8 * 24 * time.Hour
+				c.PrincipalResolvers = []string{"access-point", "dns"}
+				c.ReaperInterval = 0
+				c.OIDCIssuers = []string{"https://gitlab.com"}
+				c.MaxSAMLProviders = -1
+				c.KeyringReloadInterval = 48 * time.Hour
+			},
+			want: []string{
+				"sandbox_role_arn (SANDBOX_ROLE_ARN) must be an IAM role ARN",
+				"default_retention (DEFAULT_ROLE_RETENTION) must be positive and at most max_retention (168h0m0s)",
+				`principal_resolvers (PRINCIPAL_RESOLVERS) has unknown resolver "dns"`,
+				"reaper_interval (REAPER_INTERVAL) must be positive",
+				`oidc_issuers (OIDC_ISSUERS) must be issuers without https://, got "https://gitlab.com"`,
+				"max_saml_providers (MAX_SAML_PROVIDERS) must not be negative, got -1",
+				"keyring_reload_interval (KEYRING_RELOAD_INTERVAL) must be positive and under 24h0m0s, got 48h0m0s",
+			},
+		},
+		{
+			name: "Resolver settings",
+			modify: func(c *Config) {
+				c.PrincipalResolvers = []string{"sqs"}
+				c.PrincipalCache = "redis"
+			},
+			want: []string{
+				"principal_resolver_queue_url (PRINCIPAL_RESOLVER_QUEUE_URL) is required",
+				`principal_cache (PRINCIPAL_CACHE) must be one of store, s3, file, got "redis"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("Validate() error = %v, want %v", err, ErrInvalidConfig)
+			}
+			// The first line is the ErrInvalidConfig header.
+			if lines := strings.Split(err.Error(), "\n"); len(lines)-1 != len(tt.want) {
+				t.Errorf("Validate() returned %d problems, want %d:\n%v", len(lines)-1, len(tt.want), err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %v, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigPrint(t *testing.T) {
+	c, _, err := LoadConfig(nil, func(name string) string { return testConfigEnv[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Print(&buf); err != nil {
+		t.Fatalf("Print() error = %v", err)
+	}
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("Print() included the path prefix:\n%s", out)
+	}
+	for _, want := range []string{"path_prefix: " + Redacted, "max_retention: 168h0m0s", "principal_resolvers:\n    - access-point"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Print() = %s, want it to contain %q", out, want)
+		}
+	}
+
+	// The printed config loads back to the same config, other than the redacted secret.
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err := LoadConfig([]string{"-config", file, "-path-prefix", c.PathPrefix}, func(string) string { return "" })
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	} else if !reflect.DeepEqual(loaded, c) {
+		t.Errorf("LoadConfig() = %+v, want %+v", loaded, c)
+	}
+}
+
+func TestConfigSandboxAccount(t *testing.T) {
+	c, _, err := LoadConfig(nil, func(name string) string { return testConfigEnv[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.SandboxAccountId(); got != "210987654321" {
+		t.Errorf("SandboxAccountId() = %s, want 210987654321", got)
+	}
+	if got, want := c.SandboxBoundaryArn(), "arn:aws:iam::210987654321:policy/SandboxBoundaryPolicy"; got != want {
+		t.Errorf("SandboxBoundaryArn() = %s, want %s", got, want)
+	}
+
+	c.BoundaryArn = "arn:aws:iam::210987654321:policy/Other"
+	if got := c.SandboxBoundaryArn(); got != c.BoundaryArn {
+		t.Errorf("SandboxBoundaryArn() = %s, want %s", got, c.BoundaryArn)
+	}
+}
@@ -8,11 +8,33 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
-// Encrypt a plaintext string using AES-GCM
-func Encrypt(plaintext string, key []byte) (string, error) {
-	// Convert key and plaintext to byte slices
+// Encrypt a plaintext string using AES-GCM with the keyring's current key
+//
+// The result is the key's ID, a '.', and the Base64-encoded nonce and ciphertext.
+func Encrypt(plaintext string, keyring *Keyring) (string, error) {
+	return EncryptWithAdditionalData(plaintext, nil, keyring)
+}
+
+// EncryptWithAdditionalData encrypts a plaintext string like Encrypt, the ciphertext only decrypts when given the same
+// additional data.
+func EncryptWithAdditionalData(plaintext string, additionalData []byte, keyring *Keyring) (string, error) {
+	key, err := keyring.Current()
+	if err != nil {
+		return "", fmt.Errorf("getting current key: %w", err)
+	}
+
+	ciphertext, err := seal(plaintext, additionalData, key.Secret)
+	if err != nil {
+		return "", err
+	}
+
+	return key.Id + "." + ciphertext, nil
+}
+
+func seal(plaintext string, additionalData, key []byte) (string, error) {
 	// Create a new AES cipher block
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -32,7 +54,7 @@ func Encrypt(plaintext string, key []byte) (string, error) {
 	}
 
 	// Encrypt the plaintext
-	ciphertext := aesGCM.Seal(nil, nonce, []byte(plaintext), nil)
+	ciphertext := aesGCM.Seal(nil, nonce, []byte(plaintext), additionalData)
 
 	// Concatenate nonce and ciphertext
 	finalCiphertext := append(nonce, ciphertext...)
@@ -41,8 +63,30 @@ func Encrypt(plaintext string, key []byte) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(finalCiphertext), nil
 }
 
-// Decrypt a Base64-encoded ciphertext using AES-GCM
-func Decrypt(ciphertext string, key []byte) (string, error) {
+// Decrypt a ciphertext from Encrypt using the key it names
+//
+// Ciphertexts without a key ID are from before the keyring and use the LegacyKeyId key.
+func Decrypt(ciphertext string, keyring *Keyring) (string, error) {
+	return DecryptWithAdditionalData(ciphertext, nil, keyring)
+}
+
+// DecryptWithAdditionalData decrypts a ciphertext like Decrypt, authenticating the additional data it was encrypted
+// with.
+func DecryptWithAdditionalData(ciphertext string, additionalData []byte, keyring *Keyring) (string, error) {
+	keyId, rest, ok := strings.Cut(ciphertext, ".")
+	if !ok {
+		keyId, rest = LegacyKeyId, ciphertext
+	}
+
+	key, err := keyring.Get(keyId)
+	if err != nil {
+		return "", err
+	}
+
+	return open(rest, additionalData, key.Secret)
+}
+
+func open(ciphertext string, additionalData, key []byte) (string, error) {
 	cipherBytes, err := base64.RawURLEncoding.DecodeString(ciphertext)
 	if err != nil {
 		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
@@ -68,7 +112,7 @@ func Decrypt(ciphertext string, key []byte) (string, error) {
 	nonce, cipherText := cipherBytes[:nonceSize], cipherBytes[nonceSize:]
 
 	// Decrypt the ciphertext
-	plainBytes, err := aesGCM.Open(nil, nonce, cipherText, nil)
+	plainBytes, err := aesGCM.Open(nil, nonce, cipherText, additionalData)
 	if err != nil {
 		return "", fmt.Errorf("decryption failed: %w", err)
 	}
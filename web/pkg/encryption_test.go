@@ -41,7 +41,7 @@ func TestEncrypt(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := Encrypt(tt.args.plaintext, tt.args.key)
+			got, err := Encrypt(tt.args.plaintext, NewStaticKeyring([]byte(tt.args.key)))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Encrypt() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -96,14 +96,14 @@ func TestDecrypt(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// If valid ciphertext is needed, encrypt it first
 			if tt.encrypt.ciphertext == "" && !tt.wantErr {
-				encrypted, err := Encrypt(tt.want, tt.encrypt.key)
+				encrypted, err := Encrypt(tt.want, NewStaticKeyring([]byte(tt.encrypt.key)))
 				if err != nil {
 					t.Fatalf("Failed to encrypt during setup: %v", err)
 				}
 				tt.encrypt.ciphertext = encrypted
 			}
 
-			got, err := Decrypt(tt.encrypt.ciphertext, tt.encrypt.key)
+			got, err := Decrypt(tt.encrypt.ciphertext, NewStaticKeyring([]byte(tt.encrypt.key)))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
 				return
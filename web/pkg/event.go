@@ -1,6 +1,19 @@
 package pkg
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// The STS calls the sweeper looks for.
+const (
+	EventAssumeRole                = "AssumeRole"
+	EventAssumeRoleWithWebIdentity = "AssumeRoleWithWebIdentity"
+	EventAssumeRoleWithSAML        = "AssumeRoleWithSAML"
+)
+
+// AssumeRoleEventNames are the events that hand out sessions for a role.
+var AssumeRoleEventNames = []string{EventAssumeRole, EventAssumeRoleWithWebIdentity, EventAssumeRoleWithSAML}
 
 type Event struct {
 	EventVersion      string            `json:"eventVersion"`
@@ -11,6 +24,8 @@ type Event struct {
 	AwsRegion         string            `json:"awsRegion"`
 	SourceIPAddress   string            `json:"sourceIPAddress"`
 	UserAgent         string            `json:"userAgent"`
+	ErrorCode         string            `json:"errorCode,omitempty"`
+	ErrorMessage      string            `json:"errorMessage,omitempty"`
 	RequestParameters RequestParameters `json:"requestParameters"`
 	ResponseElements  struct {
 		Credentials struct {
@@ -22,6 +37,17 @@ type Event struct {
 			AssumedRoleId string `json:"assumedRoleId"`
 			Arn           string `json:"arn"`
 		} `json:"assumedRoleUser"`
+
+		// These are only set for AssumeRoleWithWebIdentity, Provider is the identity provider's ARN.
+		SubjectFromWebIdentityToken string `json:"subjectFromWebIdentityToken,omitempty"`
+		Audience                    string `json:"audience,omitempty"`
+		Provider                    string `json:"provider,omitempty"`
+
+		// These are only set for AssumeRoleWithSAML, Audience is shared with AssumeRoleWithWebIdentity.
+		Subject       string `json:"subject,omitempty"`
+		SubjectType   string `json:"subjectType,omitempty"`
+		Issuer        string `json:"issuer,omitempty"`
+		NameQualifier string `json:"nameQualifier,omitempty"`
 	} `json:"responseElements"`
 	RequestID string `json:"requestID"`
 	EventID   string `json:"eventID"`
@@ -47,26 +73,91 @@ type RequestParameters struct {
 	RoleArn         string `json:"roleArn"`
 	RoleSessionName string `json:"roleSessionName"`
 	ExternalId      string `json:"externalId,omitempty"`
+	DurationSeconds int    `json:"durationSeconds,omitempty"`
+
+	// Policy is the inline session policy as a JSON string.
+	Policy            string             `json:"policy,omitempty"`
+	PolicyArns        []PolicyDescriptor `json:"policyArns,omitempty"`
+	Tags              []SessionTag       `json:"tags,omitempty"`
+	TransitiveTagKeys []string           `json:"transitiveTagKeys,omitempty"`
+	SourceIdentity    string             `json:"sourceIdentity,omitempty"`
+
+	// SerialNumber is the caller's MFA device, TokenCodeProvided is set when they passed a token code along with it.
+	SerialNumber      string `json:"serialNumber,omitempty"`
+	TokenCodeProvided bool   `json:"tokenCodeProvided,omitempty"`
+
+	ProvidedContexts []ProvidedContext `json:"providedContexts,omitempty"`
+
+	// PrincipalArn is the SAML provider and SAMLAssertionID the assertion's ID, both only for AssumeRoleWithSAML.
+	PrincipalArn    string `json:"principalArn,omitempty"`
+	SAMLAssertionID string `json:"sAMLAssertionID,omitempty"`
+}
+
+// UnmarshalJSON records whether CloudTrail's tokenCode is set without keeping the code itself.
+func (p *RequestParameters) UnmarshalJSON(b []byte) error {
+	type requestParameters RequestParameters
+	var params struct {
+		requestParameters
+		TokenCode json.RawMessage `json:"tokenCode"`
+	}
+	if err := json.Unmarshal(b, &params); err != nil {
+		return err
+	}
+
+	*p = RequestParameters(params.requestParameters)
+	if len(params.TokenCode) != 0 && string(params.TokenCode) != "null" {
+		p.TokenCodeProvided = true
+	}
+	return nil
+}
+
+// PolicyDescriptor is a managed session policy.
+type PolicyDescriptor struct {
+	Arn string `json:"arn"`
+}
+
+type SessionTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ProvidedContext is a trusted context assertion, like the ones used by IAM Identity Center.
+type ProvidedContext struct {
+	ProviderArn      string `json:"providerArn"`
+	ContextAssertion string `json:"contextAssertion"`
 }
 
 type UserIdentity struct {
-	Type           string         `json:"type,omitempty"`
-	PrincipalId    string         `json:"principalId,omitempty"`
-	AccountId      string         `json:"accountId,omitempty"`
-	InvokedBy      string         `json:"invokedBy,omitempty"`
+	Type        string `json:"type,omitempty"`
+	PrincipalId string `json:"principalId,omitempty"`
+	Arn         string `json:"arn,omitempty"`
+	AccountId   string `json:"accountId,omitempty"`
+	AccessKeyId string `json:"accessKeyId,omitempty"`
+	InvokedBy   string `json:"invokedBy,omitempty"`
+
+	// UserName and IdentityProvider are only set for web identity and SAML users.
+	UserName         string `json:"userName,omitempty"`
+	IdentityProvider string `json:"identityProvider,omitempty"`
+
 	SessionContext SessionContext `json:"sessionContext,omitempty"`
 }
 
 type SessionContext struct {
-	SessionIssuer       SessionIssuer `json:"sessionIssuer"`
-	WebIdFederationData struct {
-	} `json:"webIdFederationData"`
-	Attributes struct {
+	SessionIssuer       SessionIssuer       `json:"sessionIssuer"`
+	WebIdFederationData WebIdFederationData `json:"webIdFederationData"`
+	Attributes          struct {
 		CreationDate     time.Time `json:"creationDate"`
 		MfaAuthenticated string    `json:"mfaAuthenticated"`
 	} `json:"attributes"`
 }
 
+// WebIdFederationData is set for sessions from AssumeRoleWithWebIdentity, Attributes holds the token's claims keyed by
+// "<issuer>:<claim>".
+type WebIdFederationData struct {
+	FederatedProvider string            `json:"federatedProvider,omitempty"`
+	Attributes        map[string]string `json:"attributes,omitempty"`
+}
+
 type SessionIssuer struct {
 	Type        string `json:"type"`
 	PrincipalId string `json:"principalId"`
@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRequestParametersUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want RequestParameters
+	}{
+		{
+			name: "CloudTrail",
+			json: `{
+				"roleArn": "arn:aws:iam::123456789012:role/test",
+				"roleSessionName": "vendor",
+				"externalId": "abc",
+				"durationSeconds": 900,
+				"policy": "{\"Version\":\"2012-10-17\"}",
+				"policyArns": [{"arn": "arn:aws:iam::aws:policy/ReadOnlyAccess"}],
+				"tags": [{"key": "team", "value": "sec"}],
+				"transitiveTagKeys": ["team"],
+				"sourceIdentity": "alice",
+				"serialNumber": "arn:aws:iam::123456789012:mfa/alice",
+				"tokenCode": "123456",
+				"providedContexts": [{"providerArn": "arn:aws:iam::aws:contextProvider/IdentityCenter", "contextAssertion": "abc"}]
+			}`,
+			want: RequestParameters{
+				RoleArn:           "arn:aws:iam::123456789012:role/test",
+				RoleSessionName:   "vendor",
+				ExternalId:        "abc",
+				DurationSeconds:   900,
+				Policy:            `{"Version":"2012-10-17"}`,
+				PolicyArns:        []PolicyDescriptor{{Arn: "arn:aws:iam::aws:policy/ReadOnlyAccess"}},
+				Tags:              []SessionTag{{Key: "team", Value: "sec"}},
+				TransitiveTagKeys: []string{"team"},
+				SourceIdentity:    "alice",
+				SerialNumber:      "arn:aws:iam::123456789012:mfa/alice",
+				TokenCodeProvided: true,
+				ProvidedContexts:  []ProvidedContext{{ProviderArn: "arn:aws:iam::aws:contextProvider/IdentityCenter", ContextAssertion: "abc"}},
+			},
+		},
+		{
+			name: "Minimal",
+			json: `{"roleArn": "arn:aws:iam::123456789012:role/test", "roleSessionName": "vendor", "tokenCode": null}`,
+			want: RequestParameters{RoleArn: "arn:aws:iam::123456789012:role/test", RoleSessionName: "vendor"},
+		},
+		{
+			name: "Stored",
+			json: `{"roleArn": "arn:aws:iam::123456789012:role/test", "roleSessionName": "vendor", "tokenCodeProvided": true}`,
+			want: RequestParameters{RoleArn: "arn:aws:iam::123456789012:role/test", RoleSessionName: "vendor", TokenCodeProvided: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got RequestParameters
+			if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() got = %+v, want %+v", got, tt.want)
+			}
+
+			// The token code itself should never make it into the output.
+			var fields map[string]any
+			if err := json.Unmarshal(Must(json.Marshal(got)), &fields); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if _, ok := fields["tokenCode"]; ok {
+				t.Errorf("Marshal() got = %v, should not contain tokenCode", fields)
+			}
+		})
+	}
+}
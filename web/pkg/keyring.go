@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LegacyKeyId is the ID of the single secret used before the keyring, ciphertexts without a key ID were encrypted
+// with it.
+const LegacyKeyId = "0"
+
+// KeyActivationDelay is how long a new key is only accepted for decryption before it's used for encryption.
+//
+// Instances that loaded the keyring before the key was added can't decrypt anything encrypted with it, this gives them
+// time to be replaced.
+const KeyActivationDelay = 24 * time.Hour
+
+// KeyringReloadInterval is how often RunKeyringReloader reloads the keyring, it has to be well under
+// KeyActivationDelay.
+const KeyringReloadInterval = time.Hour
+
+// KeyringReloadBackoff is the least time between reloads caused by a token for a key newer than any in the keyring.
+const KeyringReloadBackoff = time.Minute
+
+var (
+	// ErrNoKeys is returned when the keyring doesn't have a key to encrypt with.
+	ErrNoKeys = errors.New("keyring is empty")
+
+	// ErrUnknownKey is returned when decrypting with a key that isn't in the keyring, or has been retired.
+	ErrUnknownKey = errors.New("unknown key")
+)
+
+// Key is a versioned token encryption key.
+type Key struct {
+	Id     string `json:"-"`
+	Secret []byte `json:"secret"`
+
+	Created  time.Time `json:"created"`
+	ActiveAt time.Time `json:"active_at"`
+
+	// RetireAt is set once a newer key is added, after it the key is no longer accepted and can be deleted.
+	RetireAt time.Time `json:"retire_at"`
+}
+
+// Retired returns whether the key is no longer accepted at now.
+func (k *Key) Retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// Keyring holds the keys tokens are encrypted with, the newest active key encrypts and any unretired key decrypts.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []*Key
+
+	// reload loads the keys again, see SetReload.
+	reload     func() (*Keyring, error)
+	reloadedAt time.Time
+}
+
+// NewKeyring returns a keyring of keys, whose IDs must be integers.
+func NewKeyring(keys ...*Key) (*Keyring, error) {
+	for _, key := range keys {
+		if _, err := strconv.Atoi(key.Id); err != nil {
+			return nil, fmt.Errorf("invalid key id %q: %w", key.Id, err)
+		}
+	}
+
+	keyring := &Keyring{keys: keys}
+	sort.Slice(keyring.keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(keyring.keys[i].Id)
+		b, _ := strconv.Atoi(keyring.keys[j].Id)
+		return a < b
+	})
+
+	return keyring, nil
+}
+
+// NewStaticKeyring returns a keyring holding only secret, as the legacy key.
+func NewStaticKeyring(secret []byte) *Keyring {
+	return Must(NewKeyring(&Key{Id: LegacyKeyId, Secret: secret}))
+}
+
+// Keys returns the keys oldest first.
+func (k *Keyring) Keys() []*Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return slices.Clone(k.keys)
+}
+
+// SetReload sets how the keyring is loaded again by Reload. Once set, Current reloads when every key is retired and
+// Get when asked for a key newer than any in the keyring, at most once per KeyringReloadBackoff.
+func (k *Keyring) SetReload(reload func() (*Keyring, error)) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.reload, k.reloadedAt = reload, time.Now()
+}
+
+// Reload replaces the keys with the ones loaded by the function given to SetReload, it does nothing if there isn't
+// one.
+func (k *Keyring) Reload() error {
+	k.mu.RLock()
+	reload := k.reload
+	k.mu.RUnlock()
+	if reload == nil {
+		return nil
+	}
+
+	loaded, err := reload()
+	if err != nil {
+		return fmt.Errorf("reloading keyring: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.reloadedAt = loaded.Keys(), time.Now()
+	return nil
+}
+
+// Replace swaps in the keys of other, everything holding k sees them from then on.
+func (k *Keyring) Replace(other *Keyring) {
+	keys := other.Keys()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
+
+// reloadIfStale calls Reload unless it was called in the last KeyringReloadBackoff, and returns whether it did.
+func (k *Keyring) reloadIfStale() bool {
+	k.mu.RLock()
+	stale := k.reload != nil && time.Since(k.reloadedAt) >= KeyringReloadBackoff
+	k.mu.RUnlock()
+	if !stale {
+		return false
+	}
+	return k.Reload() == nil
+}
+
+// Current returns the key to encrypt with, the newest active key or the oldest unretired key if none are active yet.
+// ErrNoKeys is returned when every key has been retired.
+func (k *Keyring) Current() (*Key, error) {
+	key, err := k.current()
+	if errors.Is(err, ErrNoKeys) && k.reloadIfStale() {
+		return k.current()
+	}
+	return key, err
+}
+
+func (k *Keyring) current() (*Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(k.keys) - 1; i >= 0; i-- {
+		if key := k.keys[i]; !now.Before(key.ActiveAt) && !key.Retired(now) {
+			return key, nil
+		}
+	}
+
+	for _, key := range k.keys {
+		if !key.Retired(now) {
+			return key, nil
+		}
+	}
+	return nil, ErrNoKeys
+}
+
+// Get returns the key with the given ID, unless it's missing or retired.
+func (k *Keyring) Get(id string) (*Key, error) {
+	key, err := k.get(id)
+	if errors.Is(err, ErrUnknownKey) && k.newerThanKeys(id) && k.reloadIfStale() {
+		return k.get(id)
+	}
+	return key, err
+}
+
+func (k *Keyring) get(id string) (*Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.Id != id {
+			continue
+		} else if key.Retired(time.Now()) {
+			return nil, fmt.Errorf("%w: %s was retired at %s", ErrUnknownKey, id, key.RetireAt)
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+}
+
+// newerThanKeys reports whether id could be a key added since the keyring was loaded.
+func (k *Keyring) newerThanKeys(id string) bool {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return false
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return true
+	}
+	newest, _ := strconv.Atoi(k.keys[len(k.keys)-1].Id)
+	return n > newest
+}
+
+// RunKeyringReloader reloads the keyring every interval until ctx is done, so long running servers see rotations.
+func RunKeyringReloader(ctx *Context, keyring *Keyring, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := keyring.Reload(); err != nil {
+			ctx.Error.Printf("%v", err)
+		}
+	}
+}
+
+// Rotate adds a new key that becomes active after KeyActivationDelay, and removes keys retired by now.
+//
+// Keys that didn't have a retirement date are retired tokenLifetime after the new key becomes active, which should be
+// MaxRoleTokenLifetime so every token they encrypted has expired by then. Keys whose retirement date was changed are
+// returned in updated.
+func (k *Keyring) Rotate(now time.Time, tokenLifetime time.Duration) (added *Key, updated, removed []*Key, err error) {
+	secret, err := GenerateSecret(32)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	next := 1
+	var kept []*Key
+	for _, key := range k.keys {
+		id, _ := strconv.Atoi(key.Id)
+		next = max(next, id+1)
+
+		if key.Retired(now) {
+			removed = append(removed, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+
+	added = &Key{
+		Id:       strconv.Itoa(next),
+		Secret:   secret,
+		Created:  now,
+		ActiveAt: now.Add(KeyActivationDelay),
+	}
+	// The first key is used straight away, there aren't any instances that don't know about it.
+	if len(kept) == 0 {
+		added.ActiveAt = now
+	}
+
+	for _, key := range kept {
+		if key.RetireAt.IsZero() {
+			key.RetireAt = added.ActiveAt.Add(tokenLifetime)
+			updated = append(updated, key)
+		}
+	}
+
+	k.keys = append(kept, added)
+	return added, updated, removed, nil
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotate(t *testing.T) {
+	keyring := NewStaticKeyring([]byte("thisis32byteslongpassphrase!!!##"))
+
+	legacy, err := Encrypt("legacy", keyring)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	// Old keys are kept until tokens for the longest kept roles have expired.
+	lifetime := MaxRoleTokenLifetime(DefaultMaxRoleRetention)
+
+	// Rotating a day ago leaves the new key active now.
+	rotated := time.Now().Add(-KeyActivationDelay - time.Minute)
+	added, updated, removed, err := keyring.Rotate(rotated, lifetime)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if added.Id != "1" || len(added.Secret) != 32 {
+		t.Errorf("Rotate() added key %s with %d bytes, want key 1 with 32", added.Id, len(added.Secret))
+	}
+	if len(updated) != 1 || updated[0].Id != LegacyKeyId || !updated[0].RetireAt.Equal(added.ActiveAt.Add(lifetime)) {
+		t.Errorf("Rotate() updated = %+v, want the legacy key retiring %s after %s", updated, lifetime, added.ActiveAt)
+	}
+	if len(removed) != 0 {
+		t.Errorf("Rotate() removed = %+v, want none", removed)
+	}
+
+	current, err := keyring.Current()
+	if err != nil {
+		t.Fatalf("Current() error = %v", err)
+	} else if current.Id != "1" {
+		t.Errorf("Current() = %s, want 1", current.Id)
+	}
+
+	ciphertext, err := Encrypt("rotated", keyring)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	} else if !strings.HasPrefix(ciphertext, "1.") {
+		t.Errorf("Encrypt() = %s, want it tagged with key 1", ciphertext)
+	}
+	for ciphertext, want := range map[string]string{ciphertext: "rotated", legacy: "legacy"} {
+		if got, err := Decrypt(ciphertext, keyring); err != nil || got != want {
+			t.Errorf("Decrypt() = %q, %v, want %q", got, err, want)
+		}
+	}
+
+	// A key added now isn't used until it's active, and the legacy key is removed once it's retired.
+	added, updated, removed, err = keyring.Rotate(added.ActiveAt.Add(lifetime), lifetime)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if added.Id != "2" {
+		t.Errorf("Rotate() added key %s, want 2", added.Id)
+	}
+	if len(updated) != 1 || updated[0].Id != "1" {
+		t.Errorf("Rotate() updated = %+v, want key 1", updated)
+	}
+	if len(removed) != 1 || removed[0].Id != LegacyKeyId {
+		t.Errorf("Rotate() removed = %+v, want the legacy key", removed)
+	}
+	if _, err := Decrypt(legacy, keyring); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt() with a removed key error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestKeyringCurrent(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		keys    []*Key
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "Empty",
+			wantErr: ErrNoKeys,
+		},
+		{
+			name: "Newest active",
+			keys: []*Key{
+				{Id: "10", ActiveAt: now.Add(time.Hour)},
+				{Id: "9", ActiveAt: now.Add(-time.Hour)},
+				{Id: "8", ActiveAt: now.Add(-2 * time.Hour)},
+			},
+			want: "9",
+		},
+		{
+			name: "None active",
+			keys: []*Key{
+				{Id: "2", ActiveAt: now.Add(2 * time.Hour)},
+				{Id: "1", ActiveAt: now.Add(time.Hour)},
+			},
+			want: "1",
+		},
+		{
+			name: "Active retired",
+			keys: []*Key{
+				{Id: "2", ActiveAt: now.Add(time.Hour)},
+				{Id: "1", ActiveAt: now.Add(-2 * time.Hour), RetireAt: now.Add(-time.Hour)},
+			},
+			want: "2",
+		},
+		{
+			name: "All retired",
+			keys: []*Key{
+				{Id: "2", ActiveAt: now.Add(-2 * time.Hour), RetireAt: now.Add(-time.Hour)},
+				{Id: "1", ActiveAt: now.Add(-3 * time.Hour), RetireAt: now.Add(-time.Hour)},
+			},
+			wantErr: ErrNoKeys,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := NewKeyring(tt.keys...)
+			if err != nil {
+				t.Fatalf("NewKeyring() error = %v", err)
+			}
+
+			got, err := keyring.Current()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Current() error = %v, want %v", err, tt.wantErr)
+			} else if err == nil && got.Id != tt.want {
+				t.Errorf("Current() = %s, want %s", got.Id, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyringReload(t *testing.T) {
+	now := time.Now()
+	old := &Key{Id: "1", Secret: []byte("old"), ActiveAt: now.Add(-time.Hour)}
+	added := &Key{Id: "2", Secret: []byte("added"), ActiveAt: now.Add(time.Hour)}
+
+	keyring, err := NewKeyring(old)
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	reloads := 0
+	keyring.SetReload(func() (*Keyring, error) {
+		reloads++
+		return NewKeyring(old, added)
+	})
+
+	// Reloads on demand wait for KeyringReloadBackoff after the last one.
+	if _, err := keyring.Get("2"); !errors.Is(err, ErrUnknownKey) || reloads != 0 {
+		t.Fatalf("Get() error = %v, reloads = %d, want ErrUnknownKey without reloading", err, reloads)
+	}
+
+	keyring.reloadedAt = now.Add(-KeyringReloadBackoff)
+	if _, err := keyring.Get("0"); !errors.Is(err, ErrUnknownKey) || reloads != 0 {
+		t.Fatalf("Get() error = %v, reloads = %d, want ErrUnknownKey without reloading for an older key", err, reloads)
+	}
+	if got, err := keyring.Get("2"); err != nil || got.Id != "2" || reloads != 1 {
+		t.Fatalf("Get() = %v, %v, reloads = %d, want key 2 after reloading once", got, err, reloads)
+	}
+}
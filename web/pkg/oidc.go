@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"slices"
+	"strings"
+)
+
+const (
+	// DefaultOIDCIssuer is GitHub Actions' issuer, the usual suspect for roles any repository can assume.
+	DefaultOIDCIssuer = "token.actions.githubusercontent.com"
+
+	// DefaultOIDCAudience is the audience GitHub's configure-aws-credentials action requests.
+	DefaultOIDCAudience = "sts.amazonaws.com"
+)
+
+// OIDCIssuer returns the issuer parameter of the oidc trust template, or DefaultOIDCIssuer.
+func OIDCIssuer(params map[string]string) string {
+	if v := params["issuer"]; v != "" {
+		return v
+	}
+	return DefaultOIDCIssuer
+}
+
+// OIDCAudience returns the audience parameter of the oidc trust template, or DefaultOIDCAudience.
+func OIDCAudience(params map[string]string) string {
+	if v := params["audience"]; v != "" {
+		return v
+	}
+	return DefaultOIDCAudience
+}
+
+// OIDCProviderArn returns the ARN of the provider for issuer in the sandbox account accountId.
+func OIDCProviderArn(accountId, issuer string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:oidc-provider/%s", accountId, issuer)
+}
+
+// EnsureOIDCProvider creates the OIDC provider for issuer with audience as its client ID if it doesn't exist.
+//
+// Existing providers are shared by every role trusting the issuer, and may not be ours, so their client IDs are left
+// alone. STS rejects tokens whose audience isn't one of them before the trust policy is even checked, so an audience
+// that's missing is an ErrInvalidTrustPolicy rather than a role nobody can assume.
+func EnsureOIDCProvider(ctx *Context, client *iam.Client, accountId, issuer, audience string) error {
+	providerArn := OIDCProviderArn(accountId, issuer)
+
+	provider, err := client.GetOpenIDConnectProvider(ctx, &iam.GetOpenIDConnectProviderInput{
+		OpenIDConnectProviderArn: aws.String(providerArn),
+	})
+	var notFoundErr *types.NoSuchEntityException
+	if errors.As(err, &notFoundErr) {
+		ctx.Debug.Printf("creating oidc provider %s", providerArn)
+
+		// The thumbprint is left out so IAM looks it up itself.
+		if _, err := client.CreateOpenIDConnectProvider(ctx, &iam.CreateOpenIDConnectProviderInput{
+			Url:          aws.String("https://" + issuer),
+			ClientIDList: []string{audience},
+			Tags: []types.Tag{
+				{
+					Key:   aws.String("assume-role-id"),
+					Value: aws.String("true"),
+				},
+			},
+		}); err != nil {
+			return fmt.Errorf("creating oidc provider %s: %w", issuer, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("getting oidc provider %s: %w", issuer, err)
+	}
+
+	if !slices.Contains(provider.ClientIDList, audience) {
+		return fmt.Errorf("%w: audience %s isn't a client id of the %s provider, expected one of %s", ErrInvalidTrustPolicy,
+			audience, issuer, strings.Join(provider.ClientIDList, ", "))
+	}
+	return nil
+}
+
+// WebIdentityClaims are the claims of the token an AssumeRoleWithWebIdentity call was made with.
+type WebIdentityClaims struct {
+	Issuer   string `json:"issuer"`
+	Subject  string `json:"subject"`
+	Audience string `json:"audience"`
+
+	// ProviderArn is the IAM identity provider the token was checked against.
+	ProviderArn string `json:"provider_arn,omitempty"`
+}
+
+// NewWebIdentityClaims returns the web identity claims of an AssumeRoleWithWebIdentity event, or nil for other events.
+//
+// Successful calls have the claims in their response elements, otherwise they're taken from the caller's identity,
+// whose principal ID looks like "<identity provider>:<aud>:<sub>".
+func NewWebIdentityClaims(event Event) *WebIdentityClaims {
+	if event.EventName != EventAssumeRoleWithWebIdentity {
+		return nil
+	}
+
+	identity := event.UserIdentity
+	federation := identity.SessionContext.WebIdFederationData
+
+	claims := &WebIdentityClaims{
+		Subject:     event.ResponseElements.SubjectFromWebIdentityToken,
+		Audience:    event.ResponseElements.Audience,
+		ProviderArn: event.ResponseElements.Provider,
+	}
+
+	// Identity providers are usually the provider's ARN, but well known ones like accounts.google.com are the issuer.
+	for _, provider := range []string{identity.IdentityProvider, federation.FederatedProvider} {
+		if strings.HasPrefix(provider, "arn:") {
+			claims.ProviderArn = cmp.Or(claims.ProviderArn, provider)
+		} else {
+			claims.Issuer = cmp.Or(claims.Issuer, provider)
+		}
+	}
+	if _, issuer, ok := strings.Cut(claims.ProviderArn, ":oidc-provider/"); ok {
+		claims.Issuer = cmp.Or(claims.Issuer, issuer)
+	}
+
+	var aud, sub string
+	if rest, ok := strings.CutPrefix(identity.PrincipalId, identity.IdentityProvider+":"); ok && identity.IdentityProvider != "" {
+		aud, sub, _ = strings.Cut(rest, ":")
+	}
+	claims.Audience = cmp.Or(claims.Audience, federation.Attributes[claims.Issuer+":aud"], aud)
+	claims.Subject = cmp.Or(claims.Subject, federation.Attributes[claims.Issuer+":sub"], identity.UserName, sub)
+
+	return claims
+}
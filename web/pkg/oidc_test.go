@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewWebIdentityClaims(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  *WebIdentityClaims
+	}{
+		{
+			name: "Success",
+			event: `{
+				"eventName": "AssumeRoleWithWebIdentity",
+				"userIdentity": {
+					"type": "WebIdentityUser",
+					"principalId": "arn:aws:iam::137068222704:oidc-provider/token.actions.githubusercontent.com:sts.amazonaws.com:repo:octo-org/octo-repo:ref:refs/heads/main",
+					"userName": "repo:octo-org/octo-repo:ref:refs/heads/main",
+					"identityProvider": "arn:aws:iam::137068222704:oidc-provider/token.actions.githubusercontent.com"
+				},
+				"responseElements": {
+					"subjectFromWebIdentityToken": "repo:octo-org/octo-repo:ref:refs/heads/main",
+					"audience": "sts.amazonaws.com",
+					"provider": "arn:aws:iam::137068222704:oidc-provider/token.actions.githubusercontent.com"
+				}
+			}`,
+			want: &WebIdentityClaims{
+				Issuer:      "token.actions.githubusercontent.com",
+				Subject:     "repo:octo-org/octo-repo:ref:refs/heads/main",
+				Audience:    "sts.amazonaws.com",
+				ProviderArn: "arn:aws:iam::137068222704:oidc-provider/token.actions.githubusercontent.com",
+			},
+		},
+		{
+			name: "Failed",
+			event: `{
+				"eventName": "AssumeRoleWithWebIdentity",
+				"errorCode": "AccessDenied",
+				"userIdentity": {
+					"type": "WebIdentityUser",
+					"principalId": "token.actions.githubusercontent.com:sts.amazonaws.com:repo:evil/repo:ref:refs/heads/main",
+					"userName": "repo:evil/repo:ref:refs/heads/main",
+					"identityProvider": "token.actions.githubusercontent.com"
+				}
+			}`,
+			want: &WebIdentityClaims{
+				Issuer:   "token.actions.githubusercontent.com",
+				Subject:  "repo:evil/repo:ref:refs/heads/main",
+				Audience: "sts.amazonaws.com",
+			},
+		},
+		{
+			name: "Federation data",
+			event: `{
+				"eventName": "AssumeRoleWithWebIdentity",
+				"userIdentity": {
+					"type": "WebIdentityUser",
+					"sessionContext": {
+						"webIdFederationData": {
+							"federatedProvider": "arn:aws:iam::137068222704:oidc-provider/gitlab.com",
+							"attributes": {"gitlab.com:aud": "https://gitlab.com", "gitlab.com:sub": "project_path:group/project"}
+						}
+					}
+				}
+			}`,
+			want: &WebIdentityClaims{
+				Issuer:      "gitlab.com",
+				Subject:     "project_path:group/project",
+				Audience:    "https://gitlab.com",
+				ProviderArn: "arn:aws:iam::137068222704:oidc-provider/gitlab.com",
+			},
+		},
+		{
+			name:  "AssumeRole",
+			event: `{"eventName": "AssumeRole", "userIdentity": {"type": "AWSAccount", "principalId": "AIDAEXAMPLE1"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event Event
+			if err := json.Unmarshal([]byte(tt.event), &event); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			got := NewWebIdentityClaims(event)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("NewWebIdentityClaims() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrInvalidPermissionProfile is returned for unknown profiles, or ones that fail CheckPermissionProfile.
+var ErrInvalidPermissionProfile = errors.New("invalid permission profile")
+
+// DefaultPermissionProfile is what roles used before profiles existed.
+const DefaultPermissionProfile = "audit"
+
+// PermissionAllowList holds every action a generated role may be left with once its policies are applied.
+var PermissionAllowList = []string{
+	"dynamodb:ListTables",
+	"ec2:DescribeInstances",
+	"ec2:DescribeRegions",
+	"iam:GetRole",
+	"iam:GetRolePolicy",
+	"iam:ListAttachedRolePolicies",
+	"iam:ListRolePolicies",
+	"lambda:ListFunctions",
+	"s3:ListAllMyBuckets",
+	"sts:GetCallerIdentity",
+}
+
+// PermissionProfile is the set of policies attached to a generated role. Roles always get the sandbox permissions
+// boundary (CreateRoleInput.BoundaryArn) regardless of the profile.
+type PermissionProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	ManagedPolicyArns []string `json:"managed_policy_arns"`
+
+	// InlinePolicies returns the inline policies for the role with the given ARN.
+	InlinePolicies func(roleArn string) []InlinePolicy `json:"-"`
+}
+
+type InlinePolicy struct {
+	Name     string
+	Document PolicyDocument2
+}
+
+// PermissionProfiles are the profiles roles can be created with, keyed by name.
+var PermissionProfiles = map[string]*PermissionProfile{
+	"nothing": {
+		Name:        "nothing",
+		Description: "Every action is denied.",
+		InlinePolicies: func(roleArn string) []InlinePolicy {
+			return []InlinePolicy{
+				{
+					Name: "DenyAll",
+					Document: PolicyDocument2{
+						Version: "2012-10-17",
+						Statement: []PolicyStatement2{
+							{
+								Sid:      "DenyAll",
+								Effect:   "Deny",
+								Action:   []string{"*"},
+								Resource: []string{"*"},
+							},
+						},
+					},
+				},
+			}
+		},
+	},
+	"self-introspection": {
+		Name:        "self-introspection",
+		Description: "Can look up its own role and policies.",
+		InlinePolicies: func(roleArn string) []InlinePolicy {
+			actions := []string{"iam:GetRole", "iam:ListRolePolicies", "iam:GetRolePolicy", "iam:ListAttachedRolePolicies"}
+			return []InlinePolicy{
+				{
+					Name: "AllowSelfIntrospection",
+					Document: PolicyDocument2{
+						Version: "2012-10-17",
+						Statement: []PolicyStatement2{
+							{
+								Sid:      "AllowSelfIntrospection",
+								Effect:   "Allow",
+								Action:   actions,
+								Resource: []string{roleArn},
+							},
+						},
+					},
+				},
+				denyUnnecessaryAccess(roleArn, actions),
+			}
+		},
+	},
+	"read-only-decoy": {
+		Name:        "read-only-decoy",
+		Description: "Looks like a read only role but can only list a few resource types.",
+		ManagedPolicyArns: []string{
+			"arn:aws:iam::aws:policy/job-function/ViewOnlyAccess",
+		},
+		InlinePolicies: func(roleArn string) []InlinePolicy {
+			return []InlinePolicy{
+				denyUnnecessaryAccess(roleArn, []string{
+					"dynamodb:ListTables",
+					"ec2:DescribeInstances",
+					"ec2:DescribeRegions",
+					"lambda:ListFunctions",
+					"s3:ListAllMyBuckets",
+				}),
+			}
+		},
+	},
+	"audit": {
+		Name:        "audit",
+		Description: "SecurityAudit, limited to listing its own attached policies and describing regions.",
+		ManagedPolicyArns: []string{
+			"arn:aws:iam::aws:policy/SecurityAudit",
+		},
+		InlinePolicies: func(roleArn string) []InlinePolicy {
+			return []InlinePolicy{
+				{
+					// Some stuff checks the current role for attached policies.
+					Name: "ListAttachedRolePolicies",
+					Document: PolicyDocument2{
+						Version: "2012-10-17",
+						Statement: []PolicyStatement2{
+							{
+								Sid:      "AllowSelfListAttachedRolePolicies",
+								Effect:   "Allow",
+								Action:   []string{"iam:ListAttachedRolePolicies"},
+								Resource: []string{roleArn},
+							},
+							{
+								Sid:      "AllowDescribeRegions",
+								Effect:   "Allow",
+								Action:   []string{"ec2:DescribeRegions"},
+								Resource: []string{"*"},
+							},
+						},
+					},
+				},
+				denyUnnecessaryAccess(roleArn, []string{"iam:ListAttachedRolePolicies", "ec2:DescribeRegions"}),
+			}
+		},
+	},
+}
+
+// denyUnnecessaryAccess is a single deny policy covering everything other than actions, IAM actions are limited to the
+// role itself.
+func denyUnnecessaryAccess(roleArn string, actions []string) InlinePolicy {
+	var iamActions []string
+	for _, action := range actions {
+		if strings.HasPrefix(action, "iam:") {
+			iamActions = append(iamActions, action)
+		}
+	}
+
+	statements := []PolicyStatement2{
+		{
+			Sid:       "DenyUnnecessaryActions",
+			Effect:    "Deny",
+			NotAction: actions,
+			Resource:  []string{"*"},
+		},
+	}
+	if len(iamActions) > 0 {
+		statements = append(statements, PolicyStatement2{
+			Sid:         "DenyOtherRoles",
+			Effect:      "Deny",
+			Action:      iamActions,
+			NotResource: []string{roleArn},
+		})
+	}
+
+	return InlinePolicy{
+		Name: "DenyUnnecessaryAccess",
+		Document: PolicyDocument2{
+			Version:   "2012-10-17",
+			Statement: statements,
+		},
+	}
+}
+
+// GetPermissionProfile returns the named profile after checking it with CheckPermissionProfile.
+func GetPermissionProfile(name string) (*PermissionProfile, error) {
+	profile, ok := PermissionProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown profile %q", ErrInvalidPermissionProfile, name)
+	}
+
+	if err := CheckPermissionProfile(profile); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// CheckPermissionProfile rejects profiles that could leave the role with actions outside PermissionAllowList.
+//
+// Managed policies can't be inspected here, so they're only allowed alongside an unconditional deny of everything not
+// listed in NotAction. Without one every allowed action is checked instead.
+func CheckPermissionProfile(profile *PermissionProfile) error {
+	var statements []PolicyStatement2
+	if profile.InlinePolicies != nil {
+		for _, policy := range profile.InlinePolicies("arn:aws:iam::000000000000:role/check") {
+			statements = append(statements, policy.Document.Statement...)
+		}
+	}
+
+	var effective []string
+	guarded := false
+	for _, statement := range statements {
+		if statement.Effect != "Deny" || len(statement.Condition) != 0 || !slices.Equal(statement.Resource, []string{"*"}) {
+			continue
+		}
+
+		if slices.Contains(statement.Action, "*") {
+			// Nothing is allowed at all.
+			return nil
+		} else if len(statement.NotAction) != 0 && (!guarded || len(statement.NotAction) < len(effective)) {
+			effective = statement.NotAction
+			guarded = true
+		}
+	}
+
+	if !guarded {
+		if len(profile.ManagedPolicyArns) != 0 {
+			return fmt.Errorf("%w: %s has managed policies without a deny limiting them", ErrInvalidPermissionProfile, profile.Name)
+		}
+
+		for _, statement := range statements {
+			if statement.Effect != "Allow" {
+				continue
+			} else if len(statement.NotAction) != 0 {
+				return fmt.Errorf("%w: %s allows NotAction", ErrInvalidPermissionProfile, profile.Name)
+			}
+			effective = append(effective, statement.Action...)
+		}
+	}
+
+	var errs []error
+	for _, action := range effective {
+		if !slices.ContainsFunc(PermissionAllowList, func(allowed string) bool {
+			return strings.EqualFold(allowed, action)
+		}) {
+			errs = append(errs, fmt.Errorf("%w: %s allows %s", ErrInvalidPermissionProfile, profile.Name, action))
+		}
+	}
+
+	return errors.Join(errs...)
+}
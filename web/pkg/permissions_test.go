@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckPermissionProfile(t *testing.T) {
+	allow := func(actions ...string) func(string) []InlinePolicy {
+		return func(roleArn string) []InlinePolicy {
+			return []InlinePolicy{
+				{
+					Name: "Allow",
+					Document: PolicyDocument2{
+						Version:   "2012-10-17",
+						Statement: []PolicyStatement2{{Effect: "Allow", Action: actions, Resource: []string{"*"}}},
+					},
+				},
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		profile *PermissionProfile
+		wantErr bool
+	}{
+		{
+			name: "Allowed actions",
+			profile: &PermissionProfile{
+				Name:           "allowed",
+				InlinePolicies: allow("s3:ListAllMyBuckets", "ec2:describeregions"),
+			},
+		},
+		{
+			name: "Action outside the allow list",
+			profile: &PermissionProfile{
+				Name:           "s3",
+				InlinePolicies: allow("s3:GetObject"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Wildcard action",
+			profile: &PermissionProfile{
+				Name:           "wildcard",
+				InlinePolicies: allow("s3:List*"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "Managed policy without a deny",
+			profile: &PermissionProfile{
+				Name:              "managed",
+				ManagedPolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Managed policy with a deny",
+			profile: &PermissionProfile{
+				Name:              "managed",
+				ManagedPolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+				InlinePolicies: func(roleArn string) []InlinePolicy {
+					return []InlinePolicy{denyUnnecessaryAccess(roleArn, []string{"iam:GetRole"})}
+				},
+			},
+		},
+		{
+			name: "Deny leaving too much",
+			profile: &PermissionProfile{
+				Name:              "managed",
+				ManagedPolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+				InlinePolicies: func(roleArn string) []InlinePolicy {
+					return []InlinePolicy{denyUnnecessaryAccess(roleArn, []string{"iam:GetRole", "s3:GetObject"})}
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPermissionProfile(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckPermissionProfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidPermissionProfile) {
+				t.Errorf("CheckPermissionProfile() error = %v, want ErrInvalidPermissionProfile", err)
+			}
+		})
+	}
+}
+
+func TestPermissionProfiles(t *testing.T) {
+	if _, ok := PermissionProfiles[DefaultPermissionProfile]; !ok {
+		t.Fatalf("default profile %s doesn't exist", DefaultPermissionProfile)
+	}
+
+	for name := range PermissionProfiles {
+		t.Run(name, func(t *testing.T) {
+			if _, err := GetPermissionProfile(name); err != nil {
+				t.Errorf("GetPermissionProfile() error = %v", err)
+			}
+		})
+	}
+}
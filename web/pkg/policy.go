@@ -28,10 +28,16 @@ type PolicyStatement2 struct {
 	NotAction   []string         `json:"NotAction,omitempty"`
 	Resource    []string         `json:"Resource,omitempty"`
 	NotResource []string         `json:"NotResource,omitempty"`
+	Condition   PolicyCondition  `json:"Condition,omitempty"`
 }
 
+// PolicyCondition maps condition operators to condition keys and their values, e.g. StringEquals -> sts:ExternalId.
+type PolicyCondition map[string]map[string][]string
+
 type PolicyPrincipal struct {
-	AWS string `json:"AWS"`
+	AWS       string   `json:"AWS,omitempty"`
+	Service   []string `json:"Service,omitempty"`
+	Federated string   `json:"Federated,omitempty"`
 }
 
 type Info struct {
@@ -1,13 +1,17 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
 	cloudtrailTypes "github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
-	"strings"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/smithy-go"
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,22 +20,86 @@ type PollEventsInput struct {
 	Token      string                        `json:"token"`
 	Iam        *iam.Client                   `json:"-"`
 	CloudTrail map[string]*cloudtrail.Client `json:"-"`
-	Scanner    *Scanner                      `json:"-"`
-	Secret     []byte                        `json:"-"`
+	Resolver   PrincipalResolver             `json:"-"`
+	Sweeper    *Sweeper                      `json:"-"`
+	Store      Store                         `json:"-"`
+	Keyring    *Keyring                      `json:"-"`
+
+	// Notifier is given new events to send webhooks for when set, see Notifier.Enqueue.
+	Notifier *Notifier `json:"-"`
 }
 
+// PollTimeout bounds how long a poll may run when the request doesn't have an earlier deadline.
+//
+// This is kept under the lambda and CloudFront timeouts so we can still return partial results.
+const PollTimeout = 50 * time.Second
+
 type PollEventsOutput struct {
-	RoleName string            `json:"role_name"`
-	Results  []AssumeRoleEvent `json:"results"`
+	RoleName string `json:"role_name"`
+
+	// RoleExpires is when the role will be, or was, deleted.
+	RoleExpires time.Time `json:"role_expires"`
+
+	// RoleDeleted is set when the role no longer exists and Results only contains stored events.
+	RoleDeleted bool                    `json:"role_deleted"`
+	Results     []AssumeRoleEvent       `json:"results"`
+	Attempts    []AssumeRoleAttempt     `json:"attempts"`
+	Regions     map[string]RegionResult `json:"regions"`
+}
+
+type RegionStatus string
+
+const (
+	RegionStatusOk           RegionStatus = "ok"
+	RegionStatusThrottled    RegionStatus = "throttled"
+	RegionStatusAccessDenied RegionStatus = "access-denied"
+	RegionStatusTimedOut     RegionStatus = "timed-out"
+	RegionStatusError        RegionStatus = "error"
+
+	// RegionStatusBackfilling regions are still indexing older events, results may be missing some until it's done.
+	RegionStatusBackfilling RegionStatus = "backfilling"
+)
+
+// RegionResult is the outcome of polling a single region.
+type RegionResult struct {
+	Status   RegionStatus `json:"status"`
+	Events   int          `json:"events"`
+	Attempts int          `json:"attempts"`
+}
+
+// GetRegionStatus classifies the error returned when polling a region.
+func GetRegionStatus(err error) RegionStatus {
+	if err == nil {
+		return RegionStatusOk
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return RegionStatusTimedOut
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded":
+			return RegionStatusThrottled
+		case "AccessDeniedException", "AccessDenied", "UnauthorizedOperation", "OptInRequired":
+			return RegionStatusAccessDenied
+		}
+	}
+
+	return RegionStatusError
 }
 
 func PollEvents(ctx *Context, params *PollEventsInput) (*PollEventsOutput, error) {
-	role, err := GetRoleFromToken(ctx, params.Iam, params.Token, params.Secret)
-	if err != nil {
+	role, err := GetRoleFromToken(ctx, params.Iam, params.Store, params.Token, params.Keyring)
+	if errors.Is(err, ErrRoleNotFound) {
+		ctx.Debug.Printf("role is gone, returning stored events: %v", err)
+		return pollStoredEvents(ctx, params)
+	} else if err != nil {
 		return nil, fmt.Errorf("getting role from Token: %w", err)
 	}
 
-	result, err := pollEvents(ctx, params, *role.Role.RoleName, *role.Role.RoleId, role.Role.CreateDate.UTC())
+	result, err := pollEvents(ctx, params, role.Role)
 	if err != nil {
 		return nil, fmt.Errorf("polling events: %w", err)
 	}
@@ -39,49 +107,156 @@ func PollEvents(ctx *Context, params *PollEventsInput) (*PollEventsOutput, error
 	if result == nil {
 		return nil, fmt.Errorf("assume role events not found for: %s", *role.Role.RoleName)
 	}
+
+	if params.Notifier != nil {
+		if record, err := params.Store.GetRole(ctx, *role.Role.RoleId); err != nil {
+			ctx.Error.Printf("getting stored role: %v", err)
+		} else {
+			params.Notifier.Enqueue(ctx, record, result.Results)
+		}
+	}
+
+	// Failing to store events shouldn't fail the poll, we just won't have them once the role is gone.
+	if err := params.Store.PutEvents(ctx, *role.Role.RoleId, result.Results); err != nil {
+		ctx.Error.Printf("storing events: %v", err)
+	} else if stored, err := params.Store.GetEvents(ctx, *role.Role.RoleId); err != nil {
+		ctx.Error.Printf("getting stored events: %v", err)
+	} else {
+		result.Results = MergeEvents(stored, result.Results)
+	}
+
+	if err := params.Store.PutAttempts(ctx, *role.Role.RoleId, result.Attempts); err != nil {
+		ctx.Error.Printf("storing attempts: %v", err)
+	} else if stored, err := params.Store.GetAttempts(ctx, *role.Role.RoleId); err != nil {
+		ctx.Error.Printf("getting stored attempts: %v", err)
+	} else {
+		result.Attempts = MergeAttempts(stored, result.Attempts)
+	}
+
 	return result, nil
 }
 
-func pollEvents(ctx *Context, params *PollEventsInput, roleName, principalId string, start time.Time) (*PollEventsOutput, error) {
+// pollStoredEvents returns the events stored for a role that no longer exists.
+func pollStoredEvents(ctx *Context, params *PollEventsInput) (*PollEventsOutput, error) {
+	token, err := ParseRoleToken(params.Token, params.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	roleId := token.RoleId
+
+	role, err := params.Store.GetRole(ctx, roleId)
+	if err != nil {
+		return nil, fmt.Errorf("getting stored role: %w", err)
+	}
+
+	events, err := params.Store.GetEvents(ctx, roleId)
+	if err != nil {
+		return nil, fmt.Errorf("getting stored events: %w", err)
+	}
+
+	attempts, err := params.Store.GetAttempts(ctx, roleId)
+	if err != nil {
+		return nil, fmt.Errorf("getting stored attempts: %w", err)
+	}
+
+	return &PollEventsOutput{
+		RoleName:    role.RoleName,
+		RoleExpires: role.Expiry(),
+		RoleDeleted: true,
+		Results:     MergeEvents(events, nil),
+		Attempts:    MergeAttempts(attempts, nil),
+		Regions:     map[string]RegionResult{},
+	}, nil
+}
+
+// pollEvents looks up the role's events in the sweeper's index and describes them, one region at a time concurrently.
+//
+// Whatever regions succeeded are returned along with the status of each.
+func pollEvents(ctx *Context, params *PollEventsInput, role *types.Role) (*PollEventsOutput, error) {
+	roleName, principalId, start := *role.RoleName, *role.RoleId, role.CreateDate.UTC()
 	ctx.Debug.Printf("looking for role %s since %s", roleName, start.String())
 
-	var allResults []AssumeRoleEvent
-	var errors []error
+	timeoutCtx, cancel := context.WithTimeout(ctx, PollTimeout)
+	defer cancel()
+	ctx = ctx.WithContext(timeoutCtx)
+
+	params.Sweeper.Refresh(ctx)
+
+	output := &PollEventsOutput{
+		RoleName:    roleName,
+		RoleExpires: RoleExpiry(*role),
+		Results:     []AssumeRoleEvent{},
+		Attempts:    []AssumeRoleAttempt{},
+		Regions:     map[string]RegionResult{},
+	}
+
+	for region, result := range params.Sweeper.RegionsSince(start) {
+		output.Regions[region] = RegionResult{Status: result.Status}
+	}
+
+	regionEvents := map[string][]Event{}
+	for _, event := range params.Sweeper.Events(principalId, start) {
+		regionEvents[event.AwsRegion] = append(regionEvents[event.AwsRegion], event)
+	}
 
+	// Failed attempts don't include the role ID, but roles with the same name can't exist at the same time.
+	regionAttempts := map[string][]Event{}
+	for _, event := range params.Sweeper.Attempts(*role.Arn, start) {
+		regionAttempts[event.AwsRegion] = append(regionAttempts[event.AwsRegion], event)
+		if _, ok := regionEvents[event.AwsRegion]; !ok {
+			regionEvents[event.AwsRegion] = nil
+		}
+	}
+
+	mu := &sync.Mutex{}
 	wg := &sync.WaitGroup{}
 
-	for region, cfg := range params.CloudTrail {
-		ctx.Debug.Printf("looking in region %s for %s assume role events", region, roleName)
+	for region, events := range regionEvents {
+		client, ok := params.CloudTrail[region]
+		if !ok {
+			ctx.Error.Printf("no cloudtrail client for region %s", region)
+			continue
+		}
+
+		ctx.Debug.Printf("describing %d %s assume role events in %s", len(events), roleName, region)
 		wg.Add(1)
 
-		go func(region string, cfg *cloudtrail.Client) {
-			ctx.Debug.Printf("looking in region %s", region)
+		go func(region string, client *cloudtrail.Client, events, attemptEvents []Event) {
+			defer wg.Done()
 
-			results, err := PollRegionEvents(ctx, cfg, params.Scanner, roleName, principalId, start)
-			if err != nil {
-				ctx.Error.Printf("poll: %v", err)
-				errors = append(errors, fmt.Errorf("poll: %w", err))
-				return
+			results, err := PollRegionEvents(ctx, client, params.Resolver, roleName, principalId, events)
+			attempts, attemptsErr := PollRegionAttempts(ctx, params.Resolver, attemptEvents)
+			if err = errors.Join(err, attemptsErr); err != nil {
+				ctx.Error.Printf("poll %s: %v", region, err)
+			} else {
+				ctx.Debug.Printf("results for %s in %s: %s", roleName, region, TryMarshal(results))
 			}
-			ctx.Debug.Printf("results for %s in %s: %s", roleName, region, TryMarshal(results))
 
-			if results != nil {
-				allResults = append(allResults, results...)
-			}
+			mu.Lock()
+			defer mu.Unlock()
 
-			wg.Done()
-		}(region, cfg)
+			output.Results = append(output.Results, results...)
+			output.Attempts = append(output.Attempts, attempts...)
+
+			result := output.Regions[region]
+			if err != nil {
+				result.Status = GetRegionStatus(err)
+			}
+			result.Events = len(results)
+			result.Attempts = len(attempts)
+			output.Regions[region] = result
+		}(region, client, events, regionAttempts[region])
 	}
 	wg.Wait()
 
-	if len(errors) > 0 {
-		return nil, fmt.Errorf("poll: failed to poll all regions")
-	}
+	sort.Slice(output.Results, func(i, j int) bool {
+		return output.Results[i].Time.Before(output.Results[j].Time)
+	})
+	sort.Slice(output.Attempts, func(i, j int) bool {
+		return output.Attempts[i].Time.Before(output.Attempts[j].Time)
+	})
 
-	return &PollEventsOutput{
-		RoleName: roleName,
-		Results:  allResults,
-	}, nil
+	return output, nil
 }
 
 type AssumeRoleEvent struct {
@@ -92,111 +267,160 @@ type AssumeRoleEvent struct {
 	SourceIp           string             `json:"source_ip"`
 	SourcePrincipalArn string             `json:"source_principal_arn"`
 	AssumeRoleParams   *RequestParameters `json:"assume_role_params"`
-	Events             []string
-}
 
-func PollRegionEvents(ctx *Context, client *cloudtrail.Client, scanner *Scanner, roleName, principalId string, start time.Time) ([]AssumeRoleEvent, error) {
-	allResults := []AssumeRoleEvent{}
+	// SourcePrincipalResolution is where SourcePrincipalArn came from, or why it's empty.
+	SourcePrincipalResolution PrincipalResolution `json:"source_principal_resolution"`
 
-	var nextToken *string
-	for {
-		resp, err := client.LookupEvents(ctx, &cloudtrail.LookupEventsInput{
-			StartTime: aws.Time(start),
-			LookupAttributes: []cloudtrailTypes.LookupAttribute{
-				{
-					AttributeKey:   cloudtrailTypes.LookupAttributeKeyEventName,
-					AttributeValue: aws.String("AssumeRole"),
-				},
-			},
-			NextToken: nextToken,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("looking up events: %w", err)
-		}
+	// SourceIdentity is the caller, SourcePrincipalArn is the same as SourceIdentity.PrincipalArn.
+	SourceIdentity SourceIdentity `json:"source_identity"`
 
-		ourAssumeRoleEvents, err := FindOurAssumeRoleEvent(ctx, resp.Events, roleName, principalId)
-		if err != nil {
-			return nil, fmt.Errorf("checking if event is ours: %w", err)
-		}
+	// EventName is one of AssumeRoleEventNames, WebIdentity and SAML are set for the matching event.
+	EventName   string             `json:"event_name"`
+	WebIdentity *WebIdentityClaims `json:"web_identity,omitempty"`
+	SAML        *SAMLClaims        `json:"saml,omitempty"`
 
-		results := []AssumeRoleEvent{}
-		for _, event := range ourAssumeRoleEvents {
-			expiration, err := time.Parse("Jan 2, 2006, 3:04:05 PM", event.ResponseElements.Credentials.Expiration)
-			if err != nil {
-				return nil, fmt.Errorf("parsing expiration time: %w", err)
-			}
-			eventNames, err := LookupSessionEvents(ctx, client, roleName, event.RequestParameters.RoleSessionName, principalId, event.ResponseElements.Credentials.AccessKeyId, event.EventTime, expiration)
-			if err != nil {
-				return nil, fmt.Errorf("analyzing events: %w", err)
-			}
+	// Events are the API calls made with the session, oldest first.
+	Events []SessionEvent `json:"events"`
+}
 
-			sourcePrincipalId := strings.Split(event.UserIdentity.PrincipalId, ":")[0]
-			sourcePrincipalArn, err := scanner.LookupPrincipalId(ctx, sourcePrincipalId)
-			if err != nil {
-				return nil, fmt.Errorf("scanning arn: %w", err)
-			}
+// SessionEvent is an API call made using an assumed role session.
+type SessionEvent struct {
+	EventId     string    `json:"event_id"`
+	EventName   string    `json:"event_name"`
+	EventSource string    `json:"event_source"`
+	Region      string    `json:"region"`
+	Time        time.Time `json:"time"`
+	ReadOnly    bool      `json:"read_only"`
 
-			results = append(results, AssumeRoleEvent{
-				EventId:            event.EventID,
-				Time:               event.EventTime,
-				Region:             event.AwsRegion,
-				SourceIp:           event.SourceIPAddress,
-				UserAgent:          event.UserAgent,
-				SourcePrincipalArn: sourcePrincipalArn,
-				AssumeRoleParams:   &event.RequestParameters,
-				Events:             eventNames,
-			})
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
 
-		}
+	// RequestParameters is kept as-is since it's different for every API call.
+	RequestParameters json.RawMessage `json:"request_parameters,omitempty"`
+}
 
-		allResults = append(allResults, results...)
-		if resp.NextToken == nil || *resp.NextToken == "" {
-			break
-		}
+// PollRegionEvents describes the role's AssumeRole, AssumeRoleWithWebIdentity and AssumeRoleWithSAML events from a
+// single region.
+//
+// On error the events described before the failure are returned along with it. Source principals are resolved in one
+// batch, any that couldn't be are left empty.
+func PollRegionEvents(ctx *Context, client *cloudtrail.Client, resolver PrincipalResolver, roleName, principalId string, events []Event) ([]AssumeRoleEvent, error) {
+	allResults := []AssumeRoleEvent{}
 
-		nextToken = resp.NextToken
+	sourcePrincipals, scanErr := resolver.LookupPrincipalIds(ctx, SourcePrincipalIds(events))
+	if scanErr != nil {
+		scanErr = fmt.Errorf("scanning arns: %w", scanErr)
+	}
 
-		ctx.Debug.Printf("looking up events with next Token %s", TryMarshal(nextToken))
+	for _, event := range events {
+		expiration, err := time.Parse("Jan 2, 2006, 3:04:05 PM", event.ResponseElements.Credentials.Expiration)
+		if err != nil {
+			return allResults, fmt.Errorf("parsing expiration time: %w", err)
+		}
+		sessionEvents, err := LookupSessionEvents(ctx, client, roleName, event.RequestParameters.RoleSessionName, principalId, event.ResponseElements.Credentials.AccessKeyId, event.EventTime, expiration)
+		if err != nil {
+			return allResults, fmt.Errorf("analyzing events: %w", err)
+		}
+
+		sourceIdentity := NewSourceIdentity(event.UserIdentity)
+		sourcePrincipal := sourceIdentity.Resolve(sourcePrincipals)
+		requestParameters := event.RequestParameters
+		allResults = append(allResults, AssumeRoleEvent{
+			EventId:                   event.EventID,
+			Time:                      event.EventTime,
+			Region:                    event.AwsRegion,
+			SourceIp:                  event.SourceIPAddress,
+			UserAgent:                 event.UserAgent,
+			SourcePrincipalArn:        sourcePrincipal.Arn,
+			SourcePrincipalResolution: sourcePrincipal.Resolution,
+			SourceIdentity:            sourceIdentity,
+			EventName:                 event.EventName,
+			WebIdentity:               NewWebIdentityClaims(event),
+			SAML:                      NewSAMLClaims(event),
+			AssumeRoleParams:          &requestParameters,
+			Events:                    sessionEvents,
+		})
 	}
 
-	return allResults, nil
+	return allResults, scanErr
 }
 
-// FindOurAssumeRoleEvent finds the AssumeRole event for the role name and principalId.
-func FindOurAssumeRoleEvent(ctx *Context, events []cloudtrailTypes.Event, name string, principalId string) ([]Event, error) {
-	var results []Event
+// SourcePrincipalIds returns the principal IDs of the events' callers that need to be resolved, see
+// SourceIdentity.ResolvablePrincipalId.
+func SourcePrincipalIds(events []Event) []string {
+	ids := make([]string, 0, len(events))
 	for _, event := range events {
-		if *event.EventName != "AssumeRole" {
-			continue
-		}
-		ctx.Debug.Printf("found matching event: %s", *event.EventId)
-		assumeRoleEvent := &Event{}
-		if err := json.Unmarshal([]byte(*event.CloudTrailEvent), assumeRoleEvent); err != nil {
-			return nil, fmt.Errorf("poll: unmarshalling event: %w", err)
+		if principalId := NewSourceIdentity(event.UserIdentity).ResolvablePrincipalId(); principalId != "" {
+			ids = append(ids, principalId)
 		}
+	}
+	return ids
+}
 
-		if targetRoleName, err := GetResourceNameFromArn(assumeRoleEvent.RequestParameters.RoleArn); err != nil {
-			return nil, fmt.Errorf("getting resource name: %w", err)
-		} else if targetRoleName != name {
-			continue
-		}
+// AssumeRoleAttempt is a call to one of AssumeRoleEventNames on the role that was denied.
+type AssumeRoleAttempt struct {
+	EventId            string             `json:"event_id"`
+	Time               time.Time          `json:"time"`
+	Region             string             `json:"region"`
+	UserAgent          string             `json:"user_agent"`
+	SourceIp           string             `json:"source_ip"`
+	SourcePrincipalArn string             `json:"source_principal_arn"`
+	ErrorCode          string             `json:"error_code"`
+	ErrorMessage       string             `json:"error_message"`
+	ExternalId         string             `json:"external_id,omitempty"`
+	AssumeRoleParams   *RequestParameters `json:"assume_role_params"`
 
-		targetPrincipalId := strings.Split(assumeRoleEvent.ResponseElements.AssumedRoleUser.AssumedRoleId, ":")[0]
-		if targetPrincipalId != principalId {
-			continue
-		}
+	SourcePrincipalResolution PrincipalResolution `json:"source_principal_resolution"`
+	SourceIdentity            SourceIdentity      `json:"source_identity"`
+
+	EventName   string             `json:"event_name"`
+	WebIdentity *WebIdentityClaims `json:"web_identity,omitempty"`
+	SAML        *SAMLClaims        `json:"saml,omitempty"`
+}
+
+// PollRegionAttempts describes failed AssumeRole events from a single region.
+//
+// Source principals are resolved in one batch, any that couldn't be are left empty and the error is returned along with
+// the attempts.
+func PollRegionAttempts(ctx *Context, resolver PrincipalResolver, events []Event) ([]AssumeRoleAttempt, error) {
+	attempts := []AssumeRoleAttempt{}
+
+	sourcePrincipals, err := resolver.LookupPrincipalIds(ctx, SourcePrincipalIds(events))
+	if err != nil {
+		err = fmt.Errorf("scanning arns: %w", err)
+	}
 
-		results = append(results, *assumeRoleEvent)
+	for _, event := range events {
+		sourceIdentity := NewSourceIdentity(event.UserIdentity)
+		sourcePrincipal := sourceIdentity.Resolve(sourcePrincipals)
+		requestParameters := event.RequestParameters
+		attempts = append(attempts, AssumeRoleAttempt{
+			EventId:                   event.EventID,
+			Time:                      event.EventTime,
+			Region:                    event.AwsRegion,
+			SourceIp:                  event.SourceIPAddress,
+			UserAgent:                 event.UserAgent,
+			SourcePrincipalArn:        sourcePrincipal.Arn,
+			SourcePrincipalResolution: sourcePrincipal.Resolution,
+			SourceIdentity:            sourceIdentity,
+			EventName:                 event.EventName,
+			WebIdentity:               NewWebIdentityClaims(event),
+			SAML:                      NewSAMLClaims(event),
+			ErrorCode:                 event.ErrorCode,
+			ErrorMessage:              event.ErrorMessage,
+			ExternalId:                event.RequestParameters.ExternalId,
+			AssumeRoleParams:          &requestParameters,
+		})
 	}
 
-	return results, nil
+	return attempts, err
 }
 
-// LookupSessionEvents looks up the events for a session, returns the event names.
-func LookupSessionEvents(ctx *Context, client *cloudtrail.Client, roleName, roleSessionName, principalId, accessKeyId string, issueTime, expiration time.Time) ([]string, error) {
+// LookupSessionEvents looks up the events for a session, oldest first.
+func LookupSessionEvents(ctx *Context, client *cloudtrail.Client, roleName, roleSessionName, principalId, accessKeyId string, issueTime, expiration time.Time) ([]SessionEvent, error) {
 	ctx.Debug.Printf("looking for events for role %s since %s", roleName, issueTime.String())
 
-	var eventNames []string
+	sessionEvents := []SessionEvent{}
 	var nextToken *string
 	for {
 		resp, err := client.LookupEvents(ctx, &cloudtrail.LookupEventsInput{
@@ -231,7 +455,28 @@ func LookupSessionEvents(ctx *Context, client *cloudtrail.Client, roleName, role
 				return nil, fmt.Errorf("principal id did not match (this shouldn't happen): %s != %s", v, principalId)
 			}
 
-			eventNames = append(eventNames, *event.EventName)
+			// Event only knows the AssumeRole request parameters, so get the raw ones separately.
+			var raw struct {
+				RequestParameters json.RawMessage `json:"requestParameters"`
+			}
+			if err := json.Unmarshal([]byte(*event.CloudTrailEvent), &raw); err != nil {
+				return nil, fmt.Errorf("unmarshalling request parameters: %w", err)
+			}
+			if string(raw.RequestParameters) == "null" {
+				raw.RequestParameters = nil
+			}
+
+			sessionEvents = append(sessionEvents, SessionEvent{
+				EventId:           cloudtrailEvent.EventID,
+				EventName:         cloudtrailEvent.EventName,
+				EventSource:       cloudtrailEvent.EventSource,
+				Region:            cloudtrailEvent.AwsRegion,
+				Time:              cloudtrailEvent.EventTime,
+				ReadOnly:          cloudtrailEvent.ReadOnly,
+				ErrorCode:         cloudtrailEvent.ErrorCode,
+				ErrorMessage:      cloudtrailEvent.ErrorMessage,
+				RequestParameters: raw.RequestParameters,
+			})
 		}
 
 		if resp.NextToken == nil || *resp.NextToken == "" {
@@ -243,6 +488,10 @@ func LookupSessionEvents(ctx *Context, client *cloudtrail.Client, roleName, role
 		ctx.Debug.Printf("looking up events with next Token %s", TryMarshal(nextToken))
 	}
 
-	return eventNames, nil
+	// LookupEvents returns the most recent events first.
+	sort.SliceStable(sessionEvents, func(i, j int) bool {
+		return sessionEvents[i].Time.Before(sessionEvents[j].Time)
+	})
 
+	return sessionEvents, nil
 }
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestGetRegionStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want RegionStatus
+	}{
+		{
+			name: "No error",
+			err:  nil,
+			want: RegionStatusOk,
+		},
+		{
+			name: "Throttled",
+			err:  fmt.Errorf("looking up events: %w", &smithy.GenericAPIError{Code: "ThrottlingException"}),
+			want: RegionStatusThrottled,
+		},
+		{
+			name: "Access denied",
+			err:  fmt.Errorf("looking up events: %w", &smithy.GenericAPIError{Code: "AccessDeniedException"}),
+			want: RegionStatusAccessDenied,
+		},
+		{
+			name: "Deadline exceeded",
+			err:  fmt.Errorf("looking up events: %w", context.DeadlineExceeded),
+			want: RegionStatusTimedOut,
+		},
+		{
+			name: "Unknown error",
+			err:  errors.New("something else"),
+			want: RegionStatusError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GetRegionStatus(tt.err); got != tt.want {
+				t.Errorf("GetRegionStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
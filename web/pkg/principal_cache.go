@@ -0,0 +1,199 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PrincipalPositiveTTL is how long a resolved ARN is cached, a principal ID always maps to the same ARN but the
+	// principal may be deleted.
+	PrincipalPositiveTTL = 7 * 24 * time.Hour
+
+	// PrincipalNegativeTTL is how long an ID that couldn't be resolved is cached before trying again.
+	PrincipalNegativeTTL = time.Hour
+)
+
+type PrincipalStatus string
+
+const (
+	PrincipalStatusResolved PrincipalStatus = "resolved"
+
+	// PrincipalStatusDeleted is used when AWS hands back the raw ID rather than an ARN, the principal no longer exists.
+	PrincipalStatusDeleted PrincipalStatus = "deleted"
+
+	// PrincipalStatusInvalid is used when the ID was rejected outright.
+	PrincipalStatusInvalid PrincipalStatus = "invalid"
+)
+
+// PrincipalEntry is a cached principal ID lookup, Arn is only set when Status is PrincipalStatusResolved.
+type PrincipalEntry struct {
+	PrincipalId string          `json:"principal_id"`
+	Arn         string          `json:"arn,omitempty"`
+	Status      PrincipalStatus `json:"status"`
+	Expires     time.Time       `json:"expires"`
+}
+
+// UnmarshalJSON also accepts the bare ARN that was stored before entries existed, these are left expired so they're
+// looked up again.
+func (e *PrincipalEntry) UnmarshalJSON(b []byte) error {
+	var arn string
+	if err := json.Unmarshal(b, &arn); err == nil {
+		*e = PrincipalEntry{Arn: arn, Status: PrincipalStatusResolved}
+		if !strings.HasPrefix(arn, "arn:") {
+			*e = PrincipalEntry{Status: PrincipalStatusDeleted}
+		}
+		return nil
+	}
+
+	type principalEntry PrincipalEntry
+	return json.Unmarshal(b, (*principalEntry)(e))
+}
+
+// Expired reports whether the entry should be looked up again.
+func (e *PrincipalEntry) Expired() bool {
+	return !time.Now().Before(e.Expires)
+}
+
+// PrincipalCache persists principal ID lookups, GetPrincipal returns ErrNotFound on a miss. Store implementations are
+// also a PrincipalCache.
+type PrincipalCache interface {
+	PutPrincipal(ctx *Context, entry *PrincipalEntry) error
+	GetPrincipal(ctx *Context, principalId string) (*PrincipalEntry, error)
+}
+
+// NewS3PrincipalCache keeps each entry in an object under prefix in bucket.
+func NewS3PrincipalCache(client *s3.Client, bucket, prefix string) *S3PrincipalCache {
+	return &S3PrincipalCache{
+		client: client,
+		Bucket: bucket,
+		Prefix: prefix,
+	}
+}
+
+type S3PrincipalCache struct {
+	client *s3.Client
+	Bucket string
+	Prefix string
+}
+
+func (c *S3PrincipalCache) PutPrincipal(ctx *Context, entry *PrincipalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshalling %s: %w", entry.PrincipalId, err)
+	}
+
+	if _, err := c.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(c.Bucket),
+		Key:         aws.String(c.key(entry.PrincipalId)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return fmt.Errorf("putting %s: %w", entry.PrincipalId, err)
+	}
+
+	return nil
+}
+
+func (c *S3PrincipalCache) GetPrincipal(ctx *Context, principalId string) (*PrincipalEntry, error) {
+	resp, err := c.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.Bucket),
+		Key:    aws.String(c.key(principalId)),
+	})
+	var noSuchKey *s3Types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, principalId)
+	} else if err != nil {
+		return nil, fmt.Errorf("getting %s: %w", principalId, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", principalId, err)
+	}
+
+	entry := &PrincipalEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("unmarshalling %s: %w", principalId, err)
+	}
+	return entry, nil
+}
+
+func (c *S3PrincipalCache) key(principalId string) string {
+	return strings.TrimSuffix(c.Prefix, "/") + "/" + principalId + ".json"
+}
+
+// NewFilePrincipalCache keeps every entry in a single JSON file at path, for running locally.
+func NewFilePrincipalCache(path string) (*FilePrincipalCache, error) {
+	cache := &FilePrincipalCache{
+		Path:    path,
+		entries: map[string]*PrincipalEntry{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, fmt.Errorf("unmarshalling %s: %w", path, err)
+	}
+	return cache, nil
+}
+
+type FilePrincipalCache struct {
+	Path string
+
+	mu      sync.Mutex
+	entries map[string]*PrincipalEntry
+}
+
+func (c *FilePrincipalCache) PutPrincipal(ctx *Context, entry *PrincipalEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[entry.PrincipalId] = entry
+
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling %s: %w", c.Path, err)
+	}
+
+	// Write to a temporary file first so a crash doesn't leave a truncated cache behind.
+	tmp := filepath.Join(filepath.Dir(c.Path), "."+filepath.Base(c.Path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("writing %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, c.Path); err != nil {
+		return fmt.Errorf("renaming %s: %w", tmp, err)
+	}
+
+	return nil
+}
+
+func (c *FilePrincipalCache) GetPrincipal(ctx *Context, principalId string) (*PrincipalEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[principalId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, principalId)
+	}
+
+	copied := *entry
+	return &copied, nil
+}
@@ -0,0 +1,349 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/syncmap"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PrincipalResolver resolves principal IDs to ARNs.
+//
+// IDs that couldn't be looked up at all are left out of the result and the error says why, IDs that were rejected as
+// invalid are included as PrincipalResolutionUnresolved.
+type PrincipalResolver interface {
+	LookupPrincipalIds(ctx *Context, principalIds []string) (map[string]ResolvedPrincipal, error)
+}
+
+type PrincipalResolution string
+
+const (
+	PrincipalResolutionCache      PrincipalResolution = "cache"
+	PrincipalResolutionLookup     PrincipalResolution = "lookup"
+	PrincipalResolutionDeleted    PrincipalResolution = "deleted"
+	PrincipalResolutionUnresolved PrincipalResolution = "unresolved"
+)
+
+// ResolvedPrincipal is the outcome of looking up a principal ID, Arn is empty unless it was resolved.
+type ResolvedPrincipal struct {
+	Arn        string
+	Resolution PrincipalResolution
+}
+
+// ErrInvalidPrincipalId is returned for principal IDs that IAM won't accept in a policy.
+var ErrInvalidPrincipalId = errors.New("invalid principal id")
+
+// LookupPrincipalId resolves a single principal ID to its ARN.
+func LookupPrincipalId(ctx *Context, resolver PrincipalResolver, principalId string) (string, error) {
+	principals, err := resolver.LookupPrincipalIds(ctx, []string{principalId})
+	if err != nil {
+		return "", err
+	}
+
+	switch principal, ok := principals[principalId]; {
+	case !ok:
+		return "", fmt.Errorf("principal %s wasn't resolved", principalId)
+	case principal.Resolution == PrincipalResolutionDeleted:
+		return "", fmt.Errorf("principal %s was deleted", principalId)
+	case principal.Resolution == PrincipalResolutionUnresolved:
+		return "", fmt.Errorf("%w: %s", ErrInvalidPrincipalId, principalId)
+	default:
+		return principal.Arn, nil
+	}
+}
+
+type NewChainResolverInput struct {
+	// Cache persists lookups across cold starts, optional.
+	Cache PrincipalCache
+
+	// PositiveTTL and NegativeTTL default to PrincipalPositiveTTL and PrincipalNegativeTTL.
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+
+	Resolvers []PrincipalResolver
+}
+
+func NewChainResolver(input *NewChainResolverInput) *ChainResolver {
+	resolver := &ChainResolver{
+		Cache:       input.Cache,
+		PositiveTTL: PrincipalPositiveTTL,
+		NegativeTTL: PrincipalNegativeTTL,
+		Resolvers:   input.Resolvers,
+		cache:       syncmap.Map{},
+	}
+	if input.PositiveTTL != 0 {
+		resolver.PositiveTTL = input.PositiveTTL
+	}
+	if input.NegativeTTL != 0 {
+		resolver.NegativeTTL = input.NegativeTTL
+	}
+
+	return resolver
+}
+
+// ChainResolver checks the in-memory cache, then Cache, then tries each of Resolvers in order with whatever IDs the
+// previous ones couldn't look up.
+type ChainResolver struct {
+	Cache       PrincipalCache
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+	Resolvers   []PrincipalResolver
+
+	// cache holds *PrincipalEntry in memory in front of Cache.
+	cache syncmap.Map
+}
+
+// LookupPrincipalIds returns every ID, the ones no resolver could look up are marked PrincipalResolutionUnresolved
+// without being cached and returned along with the errors from each resolver.
+func (c *ChainResolver) LookupPrincipalIds(ctx *Context, principalIds []string) (map[string]ResolvedPrincipal, error) {
+	principals := map[string]ResolvedPrincipal{}
+
+	var misses []string
+	for _, principalId := range principalIds {
+		if _, ok := principals[principalId]; ok || slices.Contains(misses, principalId) {
+			continue
+		}
+
+		if entry := c.cached(ctx, principalId); entry != nil {
+			principals[principalId] = entry.resolved(PrincipalResolutionCache)
+			continue
+		}
+
+		misses = append(misses, principalId)
+	}
+
+	var errs []error
+	for _, resolver := range c.Resolvers {
+		if len(misses) == 0 {
+			break
+		}
+
+		resolved, err := resolver.LookupPrincipalIds(ctx, misses)
+		if err != nil {
+			ctx.Info.Printf("resolving %d principals with %T: %v", len(misses), resolver, err)
+			errs = append(errs, err)
+		}
+
+		var remaining []string
+		for _, principalId := range misses {
+			principal, ok := resolved[principalId]
+			if !ok {
+				remaining = append(remaining, principalId)
+				continue
+			}
+
+			principals[principalId] = principal
+			c.store(ctx, principalId, principal)
+		}
+		misses = remaining
+	}
+
+	if len(misses) == 0 {
+		return principals, nil
+	}
+
+	for _, principalId := range misses {
+		principals[principalId] = ResolvedPrincipal{Resolution: PrincipalResolutionUnresolved}
+	}
+	if len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("no resolver could look up %d principals", len(misses)))
+	}
+
+	return principals, errors.Join(errs...)
+}
+
+// cached returns the unexpired entry for principalId from memory or Cache, or nil.
+func (c *ChainResolver) cached(ctx *Context, principalId string) *PrincipalEntry {
+	if v, ok := c.cache.Load(principalId); ok && !v.(*PrincipalEntry).Expired() {
+		ctx.Debug.Printf("cache hit: %s", principalId)
+		return v.(*PrincipalEntry)
+	}
+	ctx.Debug.Printf("cache miss: %s", principalId)
+
+	if c.Cache == nil {
+		return nil
+	}
+
+	entry, err := c.Cache.GetPrincipal(ctx, principalId)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			ctx.Error.Printf("getting cached principal %s: %v", principalId, err)
+		}
+		return nil
+	} else if entry.Expired() {
+		return nil
+	}
+
+	ctx.Debug.Printf("persistent cache hit: %s", principalId)
+	entry.PrincipalId = principalId
+	c.cache.Store(principalId, entry)
+	return entry
+}
+
+// store caches a lookup, deleted principals won't come back so they're kept as long as resolved ones.
+func (c *ChainResolver) store(ctx *Context, principalId string, principal ResolvedPrincipal) {
+	entry := &PrincipalEntry{
+		PrincipalId: principalId,
+		Arn:         principal.Arn,
+		Status:      PrincipalStatusResolved,
+		Expires:     time.Now().Add(c.PositiveTTL),
+	}
+	switch principal.Resolution {
+	case PrincipalResolutionDeleted:
+		entry.Status = PrincipalStatusDeleted
+	case PrincipalResolutionUnresolved:
+		entry.Status = PrincipalStatusInvalid
+		entry.Expires = time.Now().Add(c.NegativeTTL)
+	}
+
+	c.cache.Store(principalId, entry)
+
+	if c.Cache != nil {
+		if err := c.Cache.PutPrincipal(ctx, entry); err != nil {
+			ctx.Error.Printf("caching principal %s: %v", principalId, err)
+		}
+	}
+}
+
+func (e *PrincipalEntry) resolved(resolution PrincipalResolution) ResolvedPrincipal {
+	switch e.Status {
+	case PrincipalStatusResolved:
+		return ResolvedPrincipal{Arn: e.Arn, Resolution: resolution}
+	case PrincipalStatusDeleted:
+		return ResolvedPrincipal{Resolution: PrincipalResolutionDeleted}
+	default:
+		return ResolvedPrincipal{Resolution: PrincipalResolutionUnresolved}
+	}
+}
+
+const (
+	// PolicyReadAttempts is how many times a policy is read back while waiting for an update to show up.
+	PolicyReadAttempts = 5
+	PolicyReadDelay    = 2 * time.Second
+)
+
+// errStalePolicy is returned by ParseResolvedPolicy when the policy read back isn't the one that was just put.
+var errStalePolicy = errors.New("policy hasn't been updated yet")
+
+// policyTarget is a resource with a policy that principal IDs can be put in, when the policy is read back AWS has
+// replaced each ID with the ARN of the principal.
+type policyTarget interface {
+	// statement returns a statement denying access to principalId.
+	statement(sid, principalId string) PolicyStatement
+	putPolicy(ctx *Context, policy string) error
+	getPolicy(ctx *Context) (string, error)
+
+	// isInvalidPrincipal reports whether putPolicy failed because one of the principals was rejected.
+	isInvalidPrincipal(err error) bool
+}
+
+// resolveWithPolicy resolves principalIds batchSize at a time using target's policy, see resolvePolicyBatch.
+func resolveWithPolicy(ctx *Context, target policyTarget, principalIds []string, batchSize int) (map[string]ResolvedPrincipal, error) {
+	principals := map[string]ResolvedPrincipal{}
+
+	var errs []error
+	for chunk := range slices.Chunk(principalIds, batchSize) {
+		entries, err := resolvePolicyBatch(ctx, target, chunk)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, entry := range entries {
+			principals[entry.PrincipalId] = entry.resolved(PrincipalResolutionLookup)
+		}
+	}
+
+	return principals, errors.Join(errs...)
+}
+
+// resolvePolicyBatch puts one statement per principal ID in the policy, when the policy is rejected because of an
+// invalid ID the IDs are split in half and each half is tried again until the invalid ID is found.
+func resolvePolicyBatch(ctx *Context, target policyTarget, principalIds []string) ([]*PrincipalEntry, error) {
+	// Each policy gets its own Sid prefix so a stale read can't be mistaken for the new policy.
+	prefix := RandStringRunes(8)
+
+	statements := make([]PolicyStatement, 0, len(principalIds))
+	for i, principalId := range principalIds {
+		statements = append(statements, target.statement(prefix+strconv.Itoa(i), principalId))
+	}
+
+	policy, err := json.Marshal(PolicyDocument{
+		Version:   "2012-10-17",
+		Statement: statements,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshalling policy: %w", err)
+	}
+
+	if err := target.putPolicy(ctx, string(policy)); target.isInvalidPrincipal(err) {
+		if len(principalIds) == 1 {
+			ctx.Debug.Printf("principal %s is invalid: %v", principalIds[0], err)
+			return []*PrincipalEntry{{PrincipalId: principalIds[0], Status: PrincipalStatusInvalid}}, nil
+		}
+
+		ctx.Debug.Printf("policy with %d principals was rejected, bisecting: %v", len(principalIds), err)
+
+		half := len(principalIds) / 2
+		left, leftErr := resolvePolicyBatch(ctx, target, principalIds[:half])
+		right, rightErr := resolvePolicyBatch(ctx, target, principalIds[half:])
+		return append(left, right...), errors.Join(leftErr, rightErr)
+	} else if err != nil {
+		return nil, fmt.Errorf("updating policy: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		updated, err := target.getPolicy(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("getting policy: %w", err)
+		}
+		ctx.Debug.Printf("updated policy: %s", updated)
+
+		entries, err := ParseResolvedPolicy(updated, prefix, principalIds)
+		if !errors.Is(err, errStalePolicy) || attempt == PolicyReadAttempts {
+			return entries, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(PolicyReadDelay):
+		}
+	}
+}
+
+// ParseResolvedPolicy returns an entry for each principal ID using the principal in the statement with the Sid
+// "<prefix><index>", when it wasn't replaced with an ARN the principal has been deleted.
+func ParseResolvedPolicy(policy, prefix string, principalIds []string) ([]*PrincipalEntry, error) {
+	updatedPolicy := &PolicyDocument{}
+	if err := json.Unmarshal([]byte(policy), updatedPolicy); err != nil {
+		return nil, fmt.Errorf("unmarshalling policy: %w", err)
+	}
+
+	var entries []*PrincipalEntry
+	for _, statement := range updatedPolicy.Statement {
+		index, ok := strings.CutPrefix(statement.Sid, prefix)
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected statement %q", errStalePolicy, statement.Sid)
+		}
+
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(principalIds) {
+			return nil, fmt.Errorf("unexpected statement %q in policy", statement.Sid)
+		} else if statement.Principal == nil || statement.Principal.AWS == "" {
+			return nil, fmt.Errorf("statement %q is missing a principal", statement.Sid)
+		}
+
+		entry := &PrincipalEntry{PrincipalId: principalIds[i], Arn: statement.Principal.AWS, Status: PrincipalStatusResolved}
+		if !strings.HasPrefix(entry.Arn, "arn:") {
+			entry.Arn = ""
+			entry.Status = PrincipalStatusDeleted
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/smithy-go"
+	"net/url"
+	"sync"
+)
+
+// DefaultResolverRoleName is the role IamRoleResolver uses when none is given.
+const DefaultResolverRoleName = "assume-role-id-resolver"
+
+// ResolverTagKey is set to "true" on the role IamRoleResolver creates, it won't use a role without it.
+const ResolverTagKey = "assume-role-id-resolver"
+
+// resolverRoleDescription is only there for people looking at the role, ResolverTagKey is what marks it as ours.
+const resolverRoleDescription = "principal id resolver for assume-role-id"
+
+// ErrNotResolverRole is returned when the resolver's role exists but wasn't created by IamRoleResolver.
+var ErrNotResolverRole = errors.New("role isn't a resolver role")
+
+// MaxPrincipalIdsPerTrustPolicy keeps trust policies under the default 2048 character limit.
+const MaxPrincipalIdsPerTrustPolicy = 15
+
+type NewIamRoleResolverInput struct {
+	Iam      *iam.Client
+	RoleName string
+
+	// BoundaryArn is the permissions boundary of the role if it's created, it's required.
+	BoundaryArn string
+}
+
+func NewIamRoleResolver(input *NewIamRoleResolverInput) *IamRoleResolver {
+	resolver := &IamRoleResolver{
+		iam:         input.Iam,
+		RoleName:    DefaultResolverRoleName,
+		BoundaryArn: input.BoundaryArn,
+	}
+	if input.RoleName != "" {
+		resolver.RoleName = input.RoleName
+	}
+
+	return resolver
+}
+
+// IamRoleResolver is a PrincipalResolver using the trust policy of a role in the sandbox account, the role is created
+// if it doesn't exist. This avoids the access point quota and S3 permissions at the cost of smaller batches.
+type IamRoleResolver struct {
+	iam         *iam.Client
+	RoleName    string
+	BoundaryArn string
+
+	// mu serializes lookups since they share the role's trust policy.
+	mu sync.Mutex
+}
+
+func (r *IamRoleResolver) LookupPrincipalIds(ctx *Context, principalIds []string) (map[string]ResolvedPrincipal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.ensureRole(ctx); err != nil {
+		return nil, err
+	}
+
+	return resolveWithPolicy(ctx, r, principalIds, MaxPrincipalIdsPerTrustPolicy)
+}
+
+// ensureRole creates the role if it doesn't exist, an existing role is only used if it's tagged with ResolverTagKey
+// since its trust policy is overwritten.
+func (r *IamRoleResolver) ensureRole(ctx *Context) error {
+	resp, err := r.iam.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(r.RoleName)})
+	var notFoundErr *types.NoSuchEntityException
+	if err == nil && !IsResolverRole(*resp.Role) {
+		return fmt.Errorf("%w: %s isn't tagged %s=true", ErrNotResolverRole, r.RoleName, ResolverTagKey)
+	} else if err == nil {
+		return nil
+	} else if !errors.As(err, &notFoundErr) {
+		return fmt.Errorf("getting role %s: %w", r.RoleName, err)
+	}
+
+	ctx.Debug.Printf("creating resolver role %s", r.RoleName)
+
+	if _, err := r.iam.CreateRole(ctx, &iam.CreateRoleInput{
+		RoleName:                 aws.String(r.RoleName),
+		Description:              aws.String(resolverRoleDescription),
+		AssumeRolePolicyDocument: aws.String(string(Must(json.Marshal(denyAllTrustPolicy)))),
+		PermissionsBoundary:      aws.String(r.BoundaryArn),
+		Tags: []types.Tag{
+			{
+				Key:   aws.String("assume-role-id"),
+				Value: aws.String("true"),
+			},
+			{
+				Key:   aws.String(ResolverTagKey),
+				Value: aws.String("true"),
+			},
+		},
+	}); err != nil {
+		return fmt.Errorf("creating role %s: %w", r.RoleName, err)
+	}
+
+	return nil
+}
+
+// IsResolverRole checks for the tag IamRoleResolver creates its role with.
+func IsResolverRole(role types.Role) bool {
+	for _, tag := range role.Tags {
+		if aws.ToString(tag.Key) == ResolverTagKey && aws.ToString(tag.Value) == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+var denyAllTrustPolicy = PolicyDocument{
+	Version: "2012-10-17",
+	Statement: []PolicyStatement{
+		{
+			Sid:       "DenyAll",
+			Effect:    "Deny",
+			Principal: &PolicyPrincipal{AWS: "*"},
+			Action:    "sts:AssumeRole",
+		},
+	},
+}
+
+func (r *IamRoleResolver) statement(sid, principalId string) PolicyStatement {
+	return PolicyStatement{
+		Sid:       sid,
+		Effect:    "Deny",
+		Principal: &PolicyPrincipal{AWS: principalId},
+		Action:    "sts:AssumeRole",
+	}
+}
+
+func (r *IamRoleResolver) putPolicy(ctx *Context, policy string) error {
+	_, err := r.iam.UpdateAssumeRolePolicy(ctx, &iam.UpdateAssumeRolePolicyInput{
+		RoleName:       aws.String(r.RoleName),
+		PolicyDocument: aws.String(policy),
+	})
+	return err
+}
+
+func (r *IamRoleResolver) getPolicy(ctx *Context) (string, error) {
+	resp, err := r.iam.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(r.RoleName)})
+	if err != nil {
+		return "", err
+	}
+
+	// IAM returns policy documents URL encoded.
+	return url.QueryUnescape(*resp.Role.AssumeRolePolicyDocument)
+}
+
+func (r *IamRoleResolver) isInvalidPrincipal(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "MalformedPolicyDocument"
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/smithy-go"
+	"sync"
+)
+
+// MaxPrincipalIdsPerQueuePolicy keeps queue policies under the 8192 byte limit.
+const MaxPrincipalIdsPerQueuePolicy = 30
+
+type NewSqsResolverInput struct {
+	Sqs      *sqs.Client
+	QueueUrl string
+}
+
+func NewSqsResolver(input *NewSqsResolverInput) *SqsResolver {
+	return &SqsResolver{
+		sqs:      input.Sqs,
+		QueueUrl: input.QueueUrl,
+	}
+}
+
+// SqsResolver is a PrincipalResolver using the policy of an existing SQS queue, the queue is only used for this.
+//
+// Queue attributes can take a while to propagate, so lookups may be slower than the other resolvers.
+type SqsResolver struct {
+	sqs      *sqs.Client
+	QueueUrl string
+
+	// mu serializes lookups since they share the queue policy.
+	mu       sync.Mutex
+	queueArn string
+}
+
+func (r *SqsResolver) LookupPrincipalIds(ctx *Context, principalIds []string) (map[string]ResolvedPrincipal, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.queueArn == "" {
+		resp, err := r.sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       &r.QueueUrl,
+			AttributeNames: []sqsTypes.QueueAttributeName{sqsTypes.QueueAttributeNameQueueArn},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting queue arn: %w", err)
+		}
+		r.queueArn = resp.Attributes[string(sqsTypes.QueueAttributeNameQueueArn)]
+	}
+
+	return resolveWithPolicy(ctx, r, principalIds, MaxPrincipalIdsPerQueuePolicy)
+}
+
+func (r *SqsResolver) statement(sid, principalId string) PolicyStatement {
+	return PolicyStatement{
+		Sid:       sid,
+		Effect:    "Deny",
+		Principal: &PolicyPrincipal{AWS: principalId},
+		Action:    "sqs:SendMessage",
+		Resource:  r.queueArn,
+	}
+}
+
+func (r *SqsResolver) putPolicy(ctx *Context, policy string) error {
+	_, err := r.sqs.SetQueueAttributes(ctx, &sqs.SetQueueAttributesInput{
+		QueueUrl: &r.QueueUrl,
+		Attributes: map[string]string{
+			string(sqsTypes.QueueAttributeNamePolicy): policy,
+		},
+	})
+	return err
+}
+
+func (r *SqsResolver) getPolicy(ctx *Context) (string, error) {
+	resp, err := r.sqs.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       &r.QueueUrl,
+		AttributeNames: []sqsTypes.QueueAttributeName{sqsTypes.QueueAttributeNamePolicy},
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Attributes[string(sqsTypes.QueueAttributeNamePolicy)], nil
+}
+
+func (r *SqsResolver) isInvalidPrincipal(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidAttributeValue"
+}
@@ -0,0 +1,300 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestParseResolvedPolicy(t *testing.T) {
+	ids := []string{"AIDAEXAMPLE1", "AROAEXAMPLE2"}
+
+	tests := []struct {
+		name    string
+		policy  string
+		want    []PrincipalEntry
+		wantErr bool
+	}{
+		{
+			name: "Resolved",
+			policy: `{"Version":"2012-10-17","Statement":[
+				{"Sid":"abcdefghp1","Effect":"Deny","Principal":{"AWS":"arn:aws:iam::123456789012:role/two"},"Action":"*","Resource":"arn"},
+				{"Sid":"abcdefghp0","Effect":"Deny","Principal":{"AWS":"arn:aws:iam::123456789012:user/one"},"Action":"*","Resource":"arn"}
+			]}`,
+			want: []PrincipalEntry{
+				{PrincipalId: "AROAEXAMPLE2", Arn: "arn:aws:iam::123456789012:role/two", Status: PrincipalStatusResolved},
+				{PrincipalId: "AIDAEXAMPLE1", Arn: "arn:aws:iam::123456789012:user/one", Status: PrincipalStatusResolved},
+			},
+		},
+		{
+			name:   "Deleted",
+			policy: `{"Version":"2012-10-17","Statement":[{"Sid":"abcdefghp0","Effect":"Deny","Principal":{"AWS":"AIDAEXAMPLE1"},"Action":"*","Resource":"arn"}]}`,
+			want: []PrincipalEntry{
+				{PrincipalId: "AIDAEXAMPLE1", Status: PrincipalStatusDeleted},
+			},
+		},
+		{
+			name:    "Stale",
+			policy:  `{"Version":"2012-10-17","Statement":[{"Sid":"zyxwvutsp0","Effect":"Deny","Principal":{"AWS":"arn"}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown statement",
+			policy:  `{"Version":"2012-10-17","Statement":[{"Sid":"abcdefghp2","Effect":"Deny","Principal":{"AWS":"arn"}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Missing principal",
+			policy:  `{"Version":"2012-10-17","Statement":[{"Sid":"abcdefghp0","Effect":"Deny"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseResolvedPolicy(tt.policy, "abcdefghp", ids)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseResolvedPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseResolvedPolicy() got = %v, want %v", got, tt.want)
+			}
+			for i := range tt.want {
+				if *got[i] != tt.want[i] {
+					t.Errorf("ParseResolvedPolicy() got = %v, want %v", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// fakeResolver resolves the IDs in principals and fails the rest with err.
+type fakeResolver struct {
+	principals map[string]ResolvedPrincipal
+	err        error
+	calls      [][]string
+}
+
+func (r *fakeResolver) LookupPrincipalIds(ctx *Context, principalIds []string) (map[string]ResolvedPrincipal, error) {
+	r.calls = append(r.calls, principalIds)
+
+	resolved := map[string]ResolvedPrincipal{}
+	for _, principalId := range principalIds {
+		if principal, ok := r.principals[principalId]; ok {
+			resolved[principalId] = principal
+		}
+	}
+	return resolved, r.err
+}
+
+func TestChainResolver(t *testing.T) {
+	ctx := NewContext(context.Background())
+	path := filepath.Join(t.TempDir(), "principals.json")
+
+	cache, err := NewFilePrincipalCache(path)
+	if err != nil {
+		t.Fatalf("NewFilePrincipalCache() error = %v", err)
+	}
+	for _, entry := range []*PrincipalEntry{
+		{PrincipalId: "AIDAEXAMPLE1", Arn: "arn:aws:iam::123456789012:user/one", Status: PrincipalStatusResolved},
+		{PrincipalId: "AIDAEXAMPLE2", Status: PrincipalStatusDeleted},
+		{PrincipalId: "AIDAEXAMPLE3", Status: PrincipalStatusInvalid},
+	} {
+		entry.Expires = time.Now().Add(time.Hour)
+		if err := cache.PutPrincipal(ctx, entry); err != nil {
+			t.Fatalf("PutPrincipal() error = %v", err)
+		}
+	}
+
+	// Reopen it to make sure the entries survive a restart.
+	cache, err = NewFilePrincipalCache(path)
+	if err != nil {
+		t.Fatalf("NewFilePrincipalCache() error = %v", err)
+	}
+
+	failing := &fakeResolver{
+		principals: map[string]ResolvedPrincipal{
+			"AROAEXAMPLE4": {Arn: "arn:aws:iam::123456789012:role/four", Resolution: PrincipalResolutionLookup},
+		},
+		err: errors.New("quota exceeded"),
+	}
+	fallback := &fakeResolver{
+		principals: map[string]ResolvedPrincipal{
+			"AROAEXAMPLE5": {Resolution: PrincipalResolutionDeleted},
+		},
+	}
+
+	resolver := NewChainResolver(&NewChainResolverInput{
+		Cache:     cache,
+		Resolvers: []PrincipalResolver{failing, fallback},
+	})
+
+	got, err := resolver.LookupPrincipalIds(ctx, []string{
+		"AIDAEXAMPLE1", "AIDAEXAMPLE2", "AIDAEXAMPLE3", "AROAEXAMPLE4", "AROAEXAMPLE5", "AROAEXAMPLE6", "AIDAEXAMPLE1",
+	})
+	if err == nil {
+		t.Errorf("LookupPrincipalIds() error = nil, want the error for AROAEXAMPLE6")
+	}
+
+	want := map[string]ResolvedPrincipal{
+		"AIDAEXAMPLE1": {Arn: "arn:aws:iam::123456789012:user/one", Resolution: PrincipalResolutionCache},
+		"AIDAEXAMPLE2": {Resolution: PrincipalResolutionDeleted},
+		"AIDAEXAMPLE3": {Resolution: PrincipalResolutionUnresolved},
+		"AROAEXAMPLE4": {Arn: "arn:aws:iam::123456789012:role/four", Resolution: PrincipalResolutionLookup},
+		"AROAEXAMPLE5": {Resolution: PrincipalResolutionDeleted},
+		"AROAEXAMPLE6": {Resolution: PrincipalResolutionUnresolved},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("LookupPrincipalIds() got = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("LookupPrincipalIds() %s got = %v, want %v", k, got[k], v)
+		}
+	}
+
+	if want := [][]string{{"AROAEXAMPLE4", "AROAEXAMPLE5", "AROAEXAMPLE6"}}; !slices.EqualFunc(failing.calls, want, slices.Equal) {
+		t.Errorf("first resolver calls got = %v, want %v", failing.calls, want)
+	}
+	if want := [][]string{{"AROAEXAMPLE5", "AROAEXAMPLE6"}}; !slices.EqualFunc(fallback.calls, want, slices.Equal) {
+		t.Errorf("second resolver calls got = %v, want %v", fallback.calls, want)
+	}
+
+	// Lookups are cached, the one that no resolver could look up isn't.
+	if _, err := resolver.LookupPrincipalIds(ctx, []string{"AROAEXAMPLE4", "AROAEXAMPLE5", "AROAEXAMPLE6"}); err == nil {
+		t.Errorf("LookupPrincipalIds() error = nil, want the error for AROAEXAMPLE6")
+	}
+	if want := []string{"AROAEXAMPLE6"}; !slices.Equal(failing.calls[1], want) {
+		t.Errorf("first resolver calls got = %v, want %v", failing.calls[1], want)
+	}
+	if entry, err := cache.GetPrincipal(ctx, "AROAEXAMPLE5"); err != nil || entry.Status != PrincipalStatusDeleted {
+		t.Errorf("GetPrincipal() got = %v, %v, want a deleted entry", entry, err)
+	}
+}
+
+// fakePolicyTarget rejects any policy containing an ID starting with "BAD" and resolves the rest to a user ARN.
+type fakePolicyTarget struct {
+	policy string
+	puts   int
+}
+
+func (f *fakePolicyTarget) statement(sid, principalId string) PolicyStatement {
+	return PolicyStatement{Sid: sid, Effect: "Deny", Principal: &PolicyPrincipal{AWS: principalId}, Action: "*"}
+}
+
+func (f *fakePolicyTarget) putPolicy(ctx *Context, policy string) error {
+	f.puts++
+
+	doc := &PolicyDocument{}
+	if err := json.Unmarshal([]byte(policy), doc); err != nil {
+		return err
+	}
+	for i, statement := range doc.Statement {
+		if statement.Principal.AWS[:3] == "BAD" {
+			return &smithy.GenericAPIError{Code: "Invalid"}
+		}
+		doc.Statement[i].Principal.AWS = "arn:aws:iam::123456789012:user/" + statement.Principal.AWS
+	}
+	f.policy = string(Must(json.Marshal(doc)))
+	return nil
+}
+
+func (f *fakePolicyTarget) getPolicy(ctx *Context) (string, error) {
+	return f.policy, nil
+}
+
+func (f *fakePolicyTarget) isInvalidPrincipal(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "Invalid"
+}
+
+func TestResolveWithPolicy(t *testing.T) {
+	ctx := NewContext(context.Background())
+	target := &fakePolicyTarget{}
+
+	got, err := resolveWithPolicy(ctx, target, []string{"AIDA1", "AIDA2", "BAD3", "AIDA4", "AIDA5"}, 4)
+	if err != nil {
+		t.Fatalf("resolveWithPolicy() error = %v", err)
+	}
+
+	want := map[string]ResolvedPrincipal{
+		"AIDA1": {Arn: "arn:aws:iam::123456789012:user/AIDA1", Resolution: PrincipalResolutionLookup},
+		"AIDA2": {Arn: "arn:aws:iam::123456789012:user/AIDA2", Resolution: PrincipalResolutionLookup},
+		"BAD3":  {Resolution: PrincipalResolutionUnresolved},
+		"AIDA4": {Arn: "arn:aws:iam::123456789012:user/AIDA4", Resolution: PrincipalResolutionLookup},
+		"AIDA5": {Arn: "arn:aws:iam::123456789012:user/AIDA5", Resolution: PrincipalResolutionLookup},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("resolveWithPolicy() got = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("resolveWithPolicy() %s got = %v, want %v", k, got[k], v)
+		}
+	}
+
+	// [1 2 BAD3 4] is rejected, then [1 2], [BAD3 4], [BAD3], [4], and finally [5] in its own batch.
+	if target.puts != 6 {
+		t.Errorf("putPolicy() calls got = %d, want 6", target.puts)
+	}
+}
+
+func TestIamRoleResolverEnsureRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     *fakeIamRole
+		wantErr  error
+		wantTags map[string]string
+	}{
+		{
+			name:     "Missing",
+			wantTags: map[string]string{"assume-role-id": "true", ResolverTagKey: "true"},
+		},
+		{
+			name:     "Tagged",
+			role:     &fakeIamRole{tags: map[string]string{"assume-role-id": "true", ResolverTagKey: "true"}},
+			wantTags: map[string]string{"assume-role-id": "true", ResolverTagKey: "true"},
+		},
+		{
+			name:     "Untagged with the description",
+			role:     &fakeIamRole{description: resolverRoleDescription, tags: map[string]string{"assume-role-id": "true"}},
+			wantErr:  ErrNotResolverRole,
+			wantTags: map[string]string{"assume-role-id": "true"},
+		},
+		{
+			name:     "Generated role",
+			role:     &fakeIamRole{description: "role for assume-role-id", tags: map[string]string{"assume-role-id": "true", OwnerTagKey: "hash"}},
+			wantErr:  ErrNotResolverRole,
+			wantTags: map[string]string{"assume-role-id": "true", OwnerTagKey: "hash"},
+		},
+		{
+			name:     "Someone else's role",
+			role:     &fakeIamRole{description: resolverRoleDescription, tags: map[string]string{}},
+			wantErr:  ErrNotResolverRole,
+			wantTags: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeIam{roles: map[string]*fakeIamRole{}}
+			if tt.role != nil {
+				fake.roles[DefaultResolverRoleName] = tt.role
+			}
+
+			resolver := NewIamRoleResolver(&NewIamRoleResolverInput{Iam: newFakeIamClient(t, fake)})
+			if err := resolver.ensureRole(NewContext(context.Background())); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ensureRole() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got := fake.roles[DefaultResolverRoleName].tags; !maps.Equal(got, tt.wantTags) {
+				t.Errorf("role tags = %v, want %v", got, tt.wantTags)
+			}
+		})
+	}
+}
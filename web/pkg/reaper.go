@@ -0,0 +1,283 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ReaperInterval is how often RunReaper deletes expired roles, in lambda an EventBridge schedule does this instead.
+const ReaperInterval = 15 * time.Minute
+
+// ProviderGracePeriod is how long identity providers are kept after they're created, so ones set up for a role that's
+// still being created aren't reaped before the role refers to them.
+const ProviderGracePeriod = time.Hour
+
+type ReapRolesInput struct {
+	Iam *iam.Client
+
+	// DryRun only reports the roles that would be deleted.
+	DryRun bool
+}
+
+// ReapReport summarizes a ReapRoles run.
+type ReapReport struct {
+	DryRun bool `json:"dry_run"`
+
+	// Listed is the number of roles in the account, Kept is the number of ours that haven't expired yet.
+	Listed int `json:"listed"`
+	Kept   int `json:"kept"`
+
+	// Deleted are the names of the expired roles that were deleted, or would have been in a dry run.
+	Deleted []string `json:"deleted"`
+
+	// DeletedProviders are the ARNs of our identity providers no remaining role referred to.
+	DeletedProviders []string `json:"deleted_providers"`
+
+	// Failed maps the names of roles and ARNs of providers that couldn't be checked or deleted to the error.
+	Failed map[string]string `json:"failed"`
+}
+
+func (r *ReapReport) String() string {
+	verb := "deleted"
+	if r.DryRun {
+		verb = "would delete"
+	}
+	return fmt.Sprintf("listed %d roles, kept %d, %s %d and %d providers, %d failed", r.Listed, r.Kept, verb, len(r.Deleted),
+		len(r.DeletedProviders), len(r.Failed))
+}
+
+// RunReaper calls ReapRoles every interval until ctx is done.
+func RunReaper(ctx *Context, params *ReapRolesInput, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := ReapRoles(ctx, params)
+		if err != nil {
+			ctx.Error.Printf("reaping roles: %v", err)
+		}
+		ctx.Debug.Printf("reaped roles: %s", report)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReapRoles deletes each of our roles that has expired, see RoleExpiry. The IamRoleResolver's role is recognized by its
+// tag and kept. Afterwards our identity providers that none of the remaining roles trust are deleted, see
+// reapProviders.
+//
+// A role that can't be checked or deleted doesn't stop the others, the report is always returned and the error joins
+// everything that failed.
+func ReapRoles(ctx *Context, params *ReapRolesInput) (*ReapReport, error) {
+	now := time.Now().UTC()
+	report := &ReapReport{
+		DryRun:           params.DryRun,
+		Deleted:          []string{},
+		DeletedProviders: []string{},
+		Failed:           map[string]string{},
+	}
+
+	var errs []error
+	fail := func(name string, err error) {
+		report.Failed[name] = err.Error()
+		errs = append(errs, fmt.Errorf("role %s: %w", name, err))
+	}
+
+	// The trust policies of every role that's kept, ours or not, decide which providers are still used.
+	var trustPolicies []string
+
+	roles := iam.NewListRolesPaginator(params.Iam, &iam.ListRolesInput{})
+	for roles.HasMorePages() {
+		resp, err := roles.NextPage(ctx)
+		if err != nil {
+			return report, errors.Join(append(errs, fmt.Errorf("listing roles: %w", err))...)
+		}
+
+		for _, role := range resp.Roles {
+			report.Listed++
+			name := *role.RoleName
+			keep := func() {
+				policy, _ := url.QueryUnescape(aws.ToString(role.AssumeRolePolicyDocument))
+				trustPolicies = append(trustPolicies, policy)
+			}
+
+			// ListRoles doesn't return tags.
+			tags, err := listRoleTags(ctx, params.Iam, name)
+			if isNoSuchEntity(err) {
+				continue
+			} else if err != nil {
+				keep()
+				fail(name, fmt.Errorf("listing tags: %w", err))
+				continue
+			}
+			role.Tags = tags
+
+			if !IsOurRole(role) || IsResolverRole(role) {
+				keep()
+				continue
+			} else if !roleExpired(role, now) {
+				keep()
+				report.Kept++
+				continue
+			}
+
+			if params.DryRun {
+				ctx.Info.Printf("would delete role %s, it expired at %s", name, RoleExpiry(role))
+			} else {
+				ctx.Info.Printf("deleting role %s, it expired at %s", name, RoleExpiry(role))
+				if err := DeleteRole(ctx, params.Iam, name); err != nil {
+					keep()
+					fail(name, err)
+					continue
+				}
+			}
+			report.Deleted = append(report.Deleted, name)
+		}
+	}
+
+	errs = append(errs, reapProviders(ctx, params, report, trustPolicies, now)...)
+	return report, errors.Join(errs...)
+}
+
+// identityProvider is a kind of identity provider the trust templates create.
+type identityProvider struct {
+	kind string
+
+	// list returns the ARNs of every provider of this kind, get returns one's tags and creation time since they aren't
+	// listed.
+	list   func(ctx *Context, client *iam.Client) ([]string, error)
+	get    func(ctx *Context, client *iam.Client, providerArn string) ([]types.Tag, time.Time, error)
+	delete func(ctx *Context, client *iam.Client, providerArn string) error
+}
+
+var identityProviders = []identityProvider{
+	{
+		kind: "oidc",
+		list: func(ctx *Context, client *iam.Client) ([]string, error) {
+			resp, err := client.ListOpenIDConnectProviders(ctx, &iam.ListOpenIDConnectProvidersInput{})
+			if err != nil {
+				return nil, err
+			}
+			var arns []string
+			for _, provider := range resp.OpenIDConnectProviderList {
+				arns = append(arns, aws.ToString(provider.Arn))
+			}
+			return arns, nil
+		},
+		get: func(ctx *Context, client *iam.Client, providerArn string) ([]types.Tag, time.Time, error) {
+			resp, err := client.GetOpenIDConnectProvider(ctx, &iam.GetOpenIDConnectProviderInput{
+				OpenIDConnectProviderArn: aws.String(providerArn),
+			})
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			return resp.Tags, aws.ToTime(resp.CreateDate), nil
+		},
+		delete: func(ctx *Context, client *iam.Client, providerArn string) error {
+			_, err := client.DeleteOpenIDConnectProvider(ctx, &iam.DeleteOpenIDConnectProviderInput{
+				OpenIDConnectProviderArn: aws.String(providerArn),
+			})
+			return err
+		},
+	},
+	{
+		kind: "saml",
+		list: func(ctx *Context, client *iam.Client) ([]string, error) {
+			resp, err := client.ListSAMLProviders(ctx, &iam.ListSAMLProvidersInput{})
+			if err != nil {
+				return nil, err
+			}
+			var arns []string
+			for _, provider := range resp.SAMLProviderList {
+				arns = append(arns, aws.ToString(provider.Arn))
+			}
+			return arns, nil
+		},
+		get: func(ctx *Context, client *iam.Client, providerArn string) ([]types.Tag, time.Time, error) {
+			resp, err := client.GetSAMLProvider(ctx, &iam.GetSAMLProviderInput{
+				SAMLProviderArn: aws.String(providerArn),
+			})
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			return resp.Tags, aws.ToTime(resp.CreateDate), nil
+		},
+		delete: func(ctx *Context, client *iam.Client, providerArn string) error {
+			_, err := client.DeleteSAMLProvider(ctx, &iam.DeleteSAMLProviderInput{
+				SAMLProviderArn: aws.String(providerArn),
+			})
+			return err
+		},
+	},
+}
+
+// reapProviders deletes the identity providers tagged as ours that are older than ProviderGracePeriod and that none of
+// trustPolicies refer to. Providers created by anyone else are never touched.
+func reapProviders(ctx *Context, params *ReapRolesInput, report *ReapReport, trustPolicies []string, now time.Time) []error {
+	var errs []error
+	fail := func(providerArn string, err error) {
+		report.Failed[providerArn] = err.Error()
+		errs = append(errs, fmt.Errorf("provider %s: %w", providerArn, err))
+	}
+
+	for _, kind := range identityProviders {
+		arns, err := kind.list(ctx, params.Iam)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing %s providers: %w", kind.kind, err))
+			continue
+		}
+
+		for _, providerArn := range arns {
+			if providerReferenced(providerArn, trustPolicies) {
+				continue
+			}
+
+			tags, created, err := kind.get(ctx, params.Iam, providerArn)
+			if isNoSuchEntity(err) {
+				continue
+			} else if err != nil {
+				fail(providerArn, fmt.Errorf("getting provider: %w", err))
+				continue
+			} else if !isOurTag(tags) || now.Sub(created) < ProviderGracePeriod {
+				continue
+			}
+
+			if params.DryRun {
+				ctx.Info.Printf("would delete %s provider %s, no role trusts it", kind.kind, providerArn)
+			} else {
+				ctx.Info.Printf("deleting %s provider %s, no role trusts it", kind.kind, providerArn)
+				if err := kind.delete(ctx, params.Iam, providerArn); err != nil && !isNoSuchEntity(err) {
+					fail(providerArn, fmt.Errorf("deleting provider: %w", err))
+					continue
+				}
+			}
+			report.DeletedProviders = append(report.DeletedProviders, providerArn)
+		}
+	}
+
+	return errs
+}
+
+// providerReferenced reports whether any of the trust policies has providerArn as a principal.
+func providerReferenced(providerArn string, trustPolicies []string) bool {
+	for _, policy := range trustPolicies {
+		if strings.Contains(policy, `"`+providerArn+`"`) {
+			return true
+		}
+	}
+	return false
+}
+
+func roleExpired(role types.Role, now time.Time) bool {
+	return !now.Before(RoleExpiry(role))
+}
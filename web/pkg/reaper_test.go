@@ -0,0 +1,402 @@
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSandboxAccountId is the sandbox account the fakes are in.
+const testSandboxAccountId = "137068222704"
+
+// fakeIam answers the IAM calls ReapRoles and IamRoleResolver make, listing roles two to a page.
+type fakeIam struct {
+	mu    sync.Mutex
+	roles map[string]*fakeIamRole
+
+	// providers are OIDC and SAML providers keyed by ARN.
+	providers map[string]*fakeIamProvider
+
+	// failDelete are roles whose DeleteRole call fails.
+	failDelete []string
+}
+
+type fakeIamRole struct {
+	created     time.Time
+	description string
+	tags        map[string]string
+	policies    []string
+	trust       string
+}
+
+type fakeIamProvider struct {
+	created time.Time
+	tags    map[string]string
+}
+
+type fakeIamMember struct {
+	RoleName    string           `xml:",omitempty"`
+	RoleId      string           `xml:",omitempty"`
+	Arn         string           `xml:",omitempty"`
+	Path        string           `xml:",omitempty"`
+	CreateDate  string           `xml:",omitempty"`
+	Description string           `xml:",omitempty"`
+	Tags        *[]fakeIamMember `xml:"Tags>member"`
+	Key         string           `xml:",omitempty"`
+	Value       string           `xml:",omitempty"`
+
+	AssumeRolePolicyDocument string `xml:",omitempty"`
+}
+
+type fakeIamResult struct {
+	Role        *fakeIamMember   `xml:"Role"`
+	Roles       *[]fakeIamMember `xml:"Roles>member"`
+	Tags        *[]fakeIamMember `xml:"Tags>member"`
+	PolicyNames *[]string        `xml:"PolicyNames>member"`
+	IsTruncated bool             `xml:"IsTruncated"`
+	Marker      string           `xml:"Marker,omitempty"`
+
+	OpenIDConnectProviderList *[]fakeIamMember `xml:"OpenIDConnectProviderList>member"`
+	SAMLProviderList          *[]fakeIamMember `xml:"SAMLProviderList>member"`
+	SAMLProviderArn           string           `xml:",omitempty"`
+	CreateDate                string           `xml:",omitempty"`
+}
+
+func (f *fakeIam) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	action, name := r.Form.Get("Action"), r.Form.Get("RoleName")
+	if strings.Contains(action, "OpenIDConnectProvider") || strings.Contains(action, "SAMLProvider") {
+		f.serveProvider(w, r, action)
+		return
+	}
+
+	role, ok := f.roles[name]
+	if action == "CreateRole" && ok {
+		f.error(w, http.StatusConflict, "EntityAlreadyExists")
+		return
+	} else if !ok && action != "ListRoles" && action != "CreateRole" {
+		f.error(w, http.StatusNotFound, "NoSuchEntity")
+		return
+	}
+
+	result := &fakeIamResult{}
+	switch action {
+	case "ListRoles":
+		names := Keys(f.roles)
+		sort.Strings(names)
+
+		// The marker is the next role's name, so deleting roles while listing doesn't skip any.
+		start, _ := slices.BinarySearch(names, r.Form.Get("Marker"))
+		end := min(start+2, len(names))
+		if end < len(names) {
+			result.IsTruncated, result.Marker = true, names[end]
+		}
+
+		result.Roles = &[]fakeIamMember{}
+		for _, name := range names[start:end] {
+			*result.Roles = append(*result.Roles, fakeIamMember{
+				RoleName:                 name,
+				RoleId:                   "AROA" + name,
+				Arn:                      "arn:aws:iam::" + testSandboxAccountId + ":role/" + name,
+				Path:                     "/",
+				CreateDate:               f.roles[name].created.Format(time.RFC3339),
+				AssumeRolePolicyDocument: url.QueryEscape(f.roles[name].trust),
+			})
+		}
+	case "CreateRole":
+		role = &fakeIamRole{
+			created:     time.Now().UTC(),
+			description: r.Form.Get("Description"),
+			tags:        map[string]string{},
+			trust:       r.Form.Get("AssumeRolePolicyDocument"),
+		}
+		f.roles[name] = role
+		f.tag(r, role)
+		result.Role = f.member(name, role)
+	case "GetRole":
+		result.Role = f.member(name, role)
+	case "TagRole":
+		f.tag(r, role)
+	case "ListRoleTags":
+		result.Tags = &[]fakeIamMember{}
+		for key, value := range role.tags {
+			*result.Tags = append(*result.Tags, fakeIamMember{Key: key, Value: value})
+		}
+	case "PutRolePolicy":
+		role.policies = append(role.policies, r.Form.Get("PolicyName"))
+	case "AttachRolePolicy":
+	case "ListRolePolicies":
+		result.PolicyNames = &role.policies
+	case "DeleteRolePolicy":
+		role.policies = slices.DeleteFunc(role.policies, func(p string) bool { return p == r.Form.Get("PolicyName") })
+	case "DeleteRole":
+		if slices.Contains(f.failDelete, name) {
+			f.error(w, http.StatusInternalServerError, "ServiceFailure")
+			return
+		} else if len(role.policies) > 0 {
+			f.error(w, http.StatusConflict, "DeleteConflict")
+			return
+		}
+		delete(f.roles, name)
+	case "ListAttachedRolePolicies", "ListInstanceProfilesForRole":
+	default:
+		f.error(w, http.StatusBadRequest, "InvalidAction")
+		return
+	}
+
+	f.respond(w, action, result)
+}
+
+// serveProvider answers the OIDC and SAML provider calls, the provider is the one named by OpenIDConnectProviderArn,
+// SAMLProviderArn or, when creating a SAML provider, Name.
+func (f *fakeIam) serveProvider(w http.ResponseWriter, r *http.Request, action string) {
+	providerArn := cmp.Or(r.Form.Get("OpenIDConnectProviderArn"), r.Form.Get("SAMLProviderArn"))
+	if action == "CreateSAMLProvider" {
+		providerArn = SAMLProviderArn(testSandboxAccountId, r.Form.Get("Name"))
+	}
+	provider, ok := f.providers[providerArn]
+	if action == "CreateSAMLProvider" && ok {
+		f.error(w, http.StatusConflict, "EntityAlreadyExists")
+		return
+	} else if !ok && !strings.HasPrefix(action, "List") && action != "CreateSAMLProvider" {
+		f.error(w, http.StatusNotFound, "NoSuchEntity")
+		return
+	}
+
+	result := &fakeIamResult{}
+	switch action {
+	case "ListOpenIDConnectProviders", "ListSAMLProviders":
+		list := &[]fakeIamMember{}
+		for _, providerArn := range Keys(f.providers) {
+			if strings.Contains(providerArn, ":oidc-provider/") == (action == "ListOpenIDConnectProviders") {
+				*list = append(*list, fakeIamMember{Arn: providerArn})
+			}
+		}
+		if action == "ListSAMLProviders" {
+			result.SAMLProviderList = list
+		} else {
+			result.OpenIDConnectProviderList = list
+		}
+	case "CreateSAMLProvider":
+		provider = &fakeIamProvider{created: time.Now().UTC(), tags: map[string]string{}}
+		for i := 1; r.Form.Has(fmt.Sprintf("Tags.member.%d.Key", i)); i++ {
+			provider.tags[r.Form.Get(fmt.Sprintf("Tags.member.%d.Key", i))] = r.Form.Get(fmt.Sprintf("Tags.member.%d.Value", i))
+		}
+		f.providers[providerArn] = provider
+		result.SAMLProviderArn = providerArn
+	case "GetOpenIDConnectProvider", "GetSAMLProvider":
+		result.CreateDate = provider.created.Format(time.RFC3339)
+		result.Tags = &[]fakeIamMember{}
+		for key, value := range provider.tags {
+			*result.Tags = append(*result.Tags, fakeIamMember{Key: key, Value: value})
+		}
+	case "DeleteOpenIDConnectProvider", "DeleteSAMLProvider":
+		delete(f.providers, providerArn)
+	default:
+		f.error(w, http.StatusBadRequest, "InvalidAction")
+		return
+	}
+
+	f.respond(w, action, result)
+}
+
+func (f *fakeIam) respond(w http.ResponseWriter, action string, result *fakeIamResult) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<%sResponse xmlns="https://iam.amazonaws.com/doc/2010-05-08/">`, action)
+	if err := xml.NewEncoder(w).EncodeElement(result, xml.StartElement{Name: xml.Name{Local: action + "Result"}}); err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(w, `<ResponseMetadata><RequestId>test</RequestId></ResponseMetadata></%sResponse>`, action)
+}
+
+func (f *fakeIam) member(name string, role *fakeIamRole) *fakeIamMember {
+	tags := []fakeIamMember{}
+	for key, value := range role.tags {
+		tags = append(tags, fakeIamMember{Key: key, Value: value})
+	}
+	return &fakeIamMember{
+		RoleName:    name,
+		RoleId:      "AROA" + name,
+		Arn:         "arn:aws:iam::" + testSandboxAccountId + ":role/" + name,
+		Path:        "/",
+		CreateDate:  role.created.Format(time.RFC3339),
+		Description: role.description,
+		Tags:        &tags,
+	}
+}
+
+func (f *fakeIam) tag(r *http.Request, role *fakeIamRole) {
+	for i := 1; r.Form.Has(fmt.Sprintf("Tags.member.%d.Key", i)); i++ {
+		role.tags[r.Form.Get(fmt.Sprintf("Tags.member.%d.Key", i))] = r.Form.Get(fmt.Sprintf("Tags.member.%d.Value", i))
+	}
+}
+
+func (f *fakeIam) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>test</RequestId></ErrorResponse>`, code, code)
+}
+
+func newFakeIamClient(t *testing.T, fake *fakeIam) *iam.Client {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return iam.New(iam.Options{
+		BaseEndpoint: aws.String(server.URL),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", ""),
+		Retryer:      aws.NopRetryer{},
+	})
+}
+
+func TestReapRoles(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	ours := func(expires time.Time) map[string]string {
+		tags := map[string]string{"assume-role-id": "true", OwnerTagKey: "hash"}
+		if !expires.IsZero() {
+			tags[ExpiresTagKey] = expires.Format(time.RFC3339)
+		}
+		return tags
+	}
+	trusting := func(providerArn string) string {
+		return string(Must(json.Marshal(&PolicyDocument2{
+			Version: "2012-10-17",
+			Statement: []PolicyStatement2{{
+				Effect:    "Allow",
+				Principal: &PolicyPrincipal{Federated: providerArn},
+				Action:    []string{"sts:AssumeRoleWithWebIdentity"},
+			}},
+		})))
+	}
+	provider := func(tagged bool, age time.Duration) *fakeIamProvider {
+		p := &fakeIamProvider{created: now.Add(-age), tags: map[string]string{}}
+		if tagged {
+			p.tags["assume-role-id"] = "true"
+		}
+		return p
+	}
+	newFake := func() *fakeIam {
+		return &fakeIam{
+			roles: map[string]*fakeIamRole{
+				"expired": {
+					created:  now.Add(-2 * time.Hour),
+					tags:     ours(now.Add(-time.Hour)),
+					policies: []string{"ListAttachedRolePolicies", "DenyUnnecessaryAccess"},
+					trust:    trusting(OIDCProviderArn(testSandboxAccountId, "expired.example.com")),
+				},
+				"extended":              {created: now.Add(-48 * time.Hour), tags: ours(now.Add(time.Hour)), trust: trusting(OIDCProviderArn(testSandboxAccountId, "used.example.com"))},
+				"legacy":                {created: now.Add(-KeepRolesFor - time.Hour), tags: ours(time.Time{})},
+				"other":                 {created: now.Add(-48 * time.Hour), tags: map[string]string{}, trust: trusting(SAMLProviderArn(testSandboxAccountId, "assume-role-id-used"))},
+				"resolver":              {created: now.Add(-48 * time.Hour), tags: map[string]string{"assume-role-id": "true", ResolverTagKey: "true"}},
+				DefaultResolverRoleName: {created: now.Add(-48 * time.Hour), tags: ours(now.Add(-time.Hour))},
+				"stuck":                 {created: now.Add(-48 * time.Hour), tags: ours(now.Add(-time.Hour)), trust: trusting(OIDCProviderArn(testSandboxAccountId, "stuck.example.com"))},
+			},
+			providers: map[string]*fakeIamProvider{
+				OIDCProviderArn(testSandboxAccountId, "expired.example.com"):   provider(true, 48*time.Hour),
+				OIDCProviderArn(testSandboxAccountId, "new.example.com"):       provider(true, time.Minute),
+				OIDCProviderArn(testSandboxAccountId, "other.example.com"):     provider(false, 48*time.Hour),
+				OIDCProviderArn(testSandboxAccountId, "stuck.example.com"):     provider(true, 48*time.Hour),
+				OIDCProviderArn(testSandboxAccountId, "unused.example.com"):    provider(true, 48*time.Hour),
+				OIDCProviderArn(testSandboxAccountId, "used.example.com"):      provider(true, 48*time.Hour),
+				SAMLProviderArn(testSandboxAccountId, "assume-role-id-unused"): provider(true, 48*time.Hour),
+				SAMLProviderArn(testSandboxAccountId, "assume-role-id-used"):   provider(true, 48*time.Hour),
+			},
+			failDelete: []string{"stuck"},
+		}
+	}
+
+	tests := []struct {
+		name                 string
+		dryRun               bool
+		wantDeleted          []string
+		wantDeletedProviders []string
+		wantDeletedSAML      []string
+		wantFailed           []string
+		wantRoles            []string
+	}{
+		{
+			name:                 "Reap",
+			wantDeleted:          []string{DefaultResolverRoleName, "expired", "legacy"},
+			wantDeletedProviders: []string{"expired.example.com", "unused.example.com"},
+			wantDeletedSAML:      []string{"assume-role-id-unused"},
+			wantFailed:           []string{"stuck"},
+			wantRoles:            []string{"extended", "other", "resolver", "stuck"},
+		},
+		{
+			name:                 "Dry run",
+			dryRun:               true,
+			wantDeleted:          []string{DefaultResolverRoleName, "expired", "legacy", "stuck"},
+			wantDeletedProviders: []string{"expired.example.com", "stuck.example.com", "unused.example.com"},
+			wantDeletedSAML:      []string{"assume-role-id-unused"},
+			wantRoles:            []string{DefaultResolverRoleName, "expired", "extended", "legacy", "other", "resolver", "stuck"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFake()
+			report, err := ReapRoles(NewContext(context.Background()), &ReapRolesInput{
+				Iam:    newFakeIamClient(t, fake),
+				DryRun: tt.dryRun,
+			})
+			if (err != nil) != (len(tt.wantFailed) > 0) {
+				t.Errorf("ReapRoles() error = %v, want failures %v", err, tt.wantFailed)
+			}
+
+			if report.Listed != 7 || report.Kept != 1 {
+				t.Errorf("ReapRoles() listed %d and kept %d, want 7 and 1", report.Listed, report.Kept)
+			}
+			if !slices.Equal(report.Deleted, tt.wantDeleted) {
+				t.Errorf("ReapRoles() deleted = %v, want %v", report.Deleted, tt.wantDeleted)
+			}
+			var wantProviders []string
+			for _, issuer := range tt.wantDeletedProviders {
+				wantProviders = append(wantProviders, OIDCProviderArn(testSandboxAccountId, issuer))
+			}
+			for _, name := range tt.wantDeletedSAML {
+				wantProviders = append(wantProviders, SAMLProviderArn(testSandboxAccountId, name))
+			}
+			sort.Strings(wantProviders)
+			sort.Strings(report.DeletedProviders)
+			if !slices.Equal(report.DeletedProviders, wantProviders) {
+				t.Errorf("ReapRoles() deleted providers = %v, want %v", report.DeletedProviders, wantProviders)
+			}
+			if remaining := len(fake.providers); !tt.dryRun && remaining != 8-len(wantProviders) {
+				t.Errorf("providers left = %d, want %d", remaining, 8-len(wantProviders))
+			}
+			if failed := Keys(report.Failed); !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("ReapRoles() failed = %v, want %v", failed, tt.wantFailed)
+			}
+
+			roles := Keys(fake.roles)
+			sort.Strings(roles)
+			if !slices.Equal(roles, tt.wantRoles) {
+				t.Errorf("roles left = %v, want %v", roles, tt.wantRoles)
+			}
+			// Roles that fail to delete keep their expiry so they're reaped again.
+			if stuck := fake.roles["stuck"]; stuck.tags[ExpiresTagKey] == "" {
+				t.Errorf("stuck role tags = %v, want %s kept", stuck.tags, ExpiresTagKey)
+			}
+		})
+	}
+}
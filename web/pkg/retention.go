@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpiresTagKey holds when the role should be deleted, in RFC 3339.
+const ExpiresTagKey = "assume-role-id-expires"
+
+// DefaultMaxRoleRetention bounds the retention creators can ask for when the operator hasn't set a maximum.
+const DefaultMaxRoleRetention = 7 * 24 * time.Hour
+
+// ErrInvalidRetention is returned when the requested retention isn't a duration or is longer than allowed.
+var ErrInvalidRetention = errors.New("invalid retention")
+
+// ParseRetention parses a requested retention, either a Go duration like "36h" or a number of days like "7d".
+//
+// An empty value is defaultRetention (KeepRolesFor when zero), or maxRetention if that's shorter. Anything longer than
+// maxRetention returns ErrInvalidRetention.
+func ParseRetention(value string, defaultRetention, maxRetention time.Duration) (time.Duration, error) {
+	if value == "" {
+		if defaultRetention == 0 {
+			defaultRetention = KeepRolesFor
+		}
+		return min(defaultRetention, maxRetention), nil
+	}
+
+	var retention time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q isn't a number of days", ErrInvalidRetention, value)
+		}
+		retention = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if retention, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrInvalidRetention, err)
+		}
+	}
+
+	if retention <= 0 {
+		return 0, fmt.Errorf("%w: %s isn't positive", ErrInvalidRetention, value)
+	} else if retention > maxRetention {
+		return 0, fmt.Errorf("%w: %s is longer than the maximum of %s", ErrInvalidRetention, value, maxRetention)
+	}
+
+	return retention, nil
+}
+
+// RoleExpiry returns when the role should be deleted, from its ExpiresTagKey tag or KeepRolesFor after it was created.
+func RoleExpiry(role types.Role) time.Time {
+	for _, tag := range role.Tags {
+		if *tag.Key != ExpiresTagKey {
+			continue
+		}
+		if expires, err := time.Parse(time.RFC3339, *tag.Value); err == nil {
+			return expires.UTC()
+		}
+	}
+	return role.CreateDate.UTC().Add(KeepRolesFor)
+}
+
+// MaxRoleExpiry returns the latest the role can be kept until, maxRetention after it was created. Past it the
+// sweeper's lookback wouldn't cover the role's events and its tokens could outlive the keys they were encrypted with.
+func MaxRoleExpiry(role types.Role, maxRetention time.Duration) time.Time {
+	return role.CreateDate.UTC().Add(maxRetention)
+}
+
+// Expiry returns when the stored role should be deleted, records from before retention was stored use KeepRolesFor.
+func (r *RoleRecord) Expiry() time.Time {
+	if r.Expires.IsZero() {
+		return r.CreateDate.Add(KeepRolesFor)
+	}
+	return r.Expires
+}
+
+func expiresTags(expires time.Time) []types.Tag {
+	return []types.Tag{
+		{
+			// The sandbox role only allows tagging requests that include this.
+			Key:   aws.String("assume-role-id"),
+			Value: aws.String("true"),
+		},
+		{
+			Key:   aws.String(ExpiresTagKey),
+			Value: aws.String(expires.UTC().Format(time.RFC3339)),
+		},
+	}
+}
+
+type ExtendRoleInput struct {
+	Token   string      `json:"token"`
+	Iam     *iam.Client `json:"-"`
+	Store   Store       `json:"-"`
+	Keyring *Keyring    `json:"-"`
+
+	// Retention is how long from now the role should be kept, see ParseRetention. Roles aren't kept past
+	// MaxRoleExpiry, MaxRetention is DefaultMaxRoleRetention when zero.
+	Retention        string        `json:"retention"`
+	DefaultRetention time.Duration `json:"-"`
+	MaxRetention     time.Duration `json:"-"`
+}
+
+type ExtendRoleOutput struct {
+	RoleArn string    `json:"role_arn"`
+	Expires time.Time `json:"expires"`
+
+	// Token is a new owner token that outlives the role, the old one keeps working until it expires.
+	Token string `json:"token"`
+}
+
+// ExtendRole keeps the role an owner token was issued for until Retention from now, or MaxRoleExpiry if that's sooner.
+// A role is never shortened.
+func ExtendRole(ctx *Context, params *ExtendRoleInput) (*ExtendRoleOutput, error) {
+	token, err := CheckRoleToken(ctx, params.Store, params.Token, params.Keyring)
+	if err != nil {
+		return nil, err
+	} else if token.Scope != RoleTokenScopeOwner {
+		return nil, fmt.Errorf("%w: extending a role needs an owner token", ErrRoleTokenScope)
+	}
+
+	maxRetention := params.MaxRetention
+	if maxRetention == 0 {
+		maxRetention = DefaultMaxRoleRetention
+	}
+	retention, err := ParseRetention(params.Retention, params.DefaultRetention, maxRetention)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := GetRoleFromToken(ctx, params.Iam, params.Store, params.Token, params.Keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := RoleExpiry(*role.Role)
+	requested := time.Now().UTC().Add(retention).Truncate(time.Second)
+	if limit := MaxRoleExpiry(*role.Role, maxRetention); requested.After(limit) {
+		ctx.Debug.Printf("capping extension of role %s at %s", *role.Role.RoleName, limit)
+		requested = limit
+	}
+	if requested.After(expires) {
+		ctx.Debug.Printf("extending role %s from %s to %s", *role.Role.RoleName, expires, requested)
+
+		if _, err := params.Iam.TagRole(ctx, &iam.TagRoleInput{
+			RoleName: role.Role.RoleName,
+			Tags:     expiresTags(requested),
+		}); err != nil {
+			return nil, fmt.Errorf("tagging role: %w", err)
+		}
+		expires = requested
+	}
+
+	if err := params.Store.UpdateRole(ctx, *role.Role.RoleId, func(record *RoleRecord) error {
+		record.Expires = expires
+		return nil
+	}); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("storing role: %w", err)
+	}
+
+	owner, err := CreateRoleToken(&CreateRoleTokenInput{
+		RoleName: *role.Role.RoleName,
+		RoleArn:  *role.Role.Arn,
+		RoleId:   *role.Role.RoleId,
+		Lifetime: time.Until(expires) + RoleTokenLifetime,
+		Keyring:  params.Keyring,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generating Token: %w", err)
+	}
+
+	return &ExtendRoleOutput{
+		RoleArn: *role.Role.Arn,
+		Expires: expires,
+		Token:   owner,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		def     time.Duration
+		max     time.Duration
+		want    time.Duration
+		wantErr error
+	}{
+		{name: "Default", max: DefaultMaxRoleRetention, want: KeepRolesFor},
+		{name: "Default over max", max: time.Hour, want: time.Hour},
+		{name: "Configured default", def: 3 * time.Hour, max: DefaultMaxRoleRetention, want: 3 * time.Hour},
+		{name: "Days", value: "3d", max: DefaultMaxRoleRetention, want: 3 * 24 * time.Hour},
+		{name: "Duration", value: "36h", max: DefaultMaxRoleRetention, want: 36 * time.Hour},
+		{name: "Max", value: "7d", max: DefaultMaxRoleRetention, want: DefaultMaxRoleRetention},
+		{name: "Over max", value: "8d", max: DefaultMaxRoleRetention, wantErr: ErrInvalidRetention},
+		{name: "Negative", value: "-1h", max: DefaultMaxRoleRetention, wantErr: ErrInvalidRetention},
+		{name: "Zero days", value: "0d", max: DefaultMaxRoleRetention, wantErr: ErrInvalidRetention},
+		{name: "Garbage", value: "forever", max: DefaultMaxRoleRetention, wantErr: ErrInvalidRetention},
+		{name: "Garbage days", value: "xd", max: DefaultMaxRoleRetention, wantErr: ErrInvalidRetention},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRetention(tt.value, tt.def, tt.max)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseRetention() error = %v, want %v", err, tt.wantErr)
+			} else if got != tt.want {
+				t.Errorf("ParseRetention() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleExpiry(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name string
+		tags []types.Tag
+		want time.Time
+	}{
+		{
+			name: "Tagged",
+			tags: expiresTags(created.Add(72 * time.Hour)),
+			want: created.Add(72 * time.Hour),
+		},
+		{
+			name: "Untagged",
+			want: created.Add(KeepRolesFor),
+		},
+		{
+			name: "Invalid tag",
+			tags: []types.Tag{{Key: aws.String(ExpiresTagKey), Value: aws.String("tomorrow")}},
+			want: created.Add(KeepRolesFor),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := types.Role{CreateDate: aws.Time(created), Tags: tt.tags}
+			if got := RoleExpiry(role); !got.Equal(tt.want) {
+				t.Errorf("RoleExpiry() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxRoleExpiry(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	role := types.Role{CreateDate: aws.Time(created), Tags: expiresTags(created.Add(24 * time.Hour))}
+
+	if got, want := MaxRoleExpiry(role, DefaultMaxRoleRetention), created.Add(7*24*time.Hour); !got.Equal(want) {
+		t.Errorf("MaxRoleExpiry() = %s, want %s", got, want)
+	}
+}
@@ -1,9 +1,15 @@
 package pkg
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -11,167 +17,247 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 )
 
-// const KeepRolesFor = time.Hour * 24
+// KeepRolesFor is how long roles are kept by default, and how long roles from before retention was tagged were kept.
 const KeepRolesFor = time.Hour * 24
-const SandboxBoundaryArn = "arn:aws:iam::137068222704:policy/SandboxBoundaryPolicy"
 
-type CreateRoleRequest struct {
-	RoleName          string `json:"role_name"`
-	RequireExternalId bool
+// SandboxBoundaryPolicyName is the permissions boundary roles get by default, see SandboxBoundaryArn.
+const SandboxBoundaryPolicyName = "SandboxBoundaryPolicy"
+
+// SandboxBoundaryArn returns the ARN of SandboxBoundaryPolicyName in the sandbox account accountId.
+func SandboxBoundaryArn(accountId string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:policy/%s", accountId, SandboxBoundaryPolicyName)
+}
+
+// OwnerTagKey holds the hex encoded SHA-256 of the owner secret handed out when the role was created.
+const OwnerTagKey = "assume-role-id-owner"
+
+// OwnerSecretHeader carries the owner secret when re-creating a role, it's kept out of the URL so it doesn't end up in
+// access logs or browser history.
+const OwnerSecretHeader = "X-Assume-Role-Id-Owner"
+
+// MinOwnerSecretLength is the shortest owner secret accepted from callers, generated ones are 43 characters.
+const MinOwnerSecretLength = 32
+
+// ErrRoleOwnedByOther is returned when a requested role name already belongs to someone else.
+var ErrRoleOwnedByOther = errors.New("role name is owned by someone else")
+
+// ErrReservedRoleName is returned for role names used by the service itself, like the IamRoleResolver's role.
+var ErrReservedRoleName = errors.New("role name is reserved")
+
+// ErrInvalidOwnerSecret is returned for owner secrets shorter than MinOwnerSecretLength.
+var ErrInvalidOwnerSecret = errors.New("invalid owner secret")
+
+type CreateRoleInput struct {
+	Iam               *iam.Client `json:"-"`
+	Store             Store       `json:"-"`
+	Keyring           *Keyring    `json:"-"`
+	RoleName          string      `json:"role_name"`
+	RequireExternalId bool        `json:"require_external_id"`
+
+	// Trust selects the trust policy template, when nil RequireExternalId picks between public and external-id.
+	Trust *TrustPolicyInput `json:"trust,omitempty"`
+
+	// PermissionProfile is the name of one of PermissionProfiles, DefaultPermissionProfile is used if empty.
+	PermissionProfile string `json:"permission_profile,omitempty"`
+
+	// Webhook is notified of new AssumeRole events and session activity when set.
+	Webhook *Webhook `json:"webhook,omitempty"`
+
+	// OwnerSecret is the owner_secret returned when the role was first created, if it was. When set it must be at
+	// least MinOwnerSecretLength long, otherwise one is generated.
+	OwnerSecret string `json:"-"`
+
+	// Retention is how long the role is kept, see ParseRetention. DefaultRetention is used when it's empty, and it
+	// can't be longer than MaxRetention, which is DefaultMaxRoleRetention when zero.
+	Retention        string        `json:"retention,omitempty"`
+	DefaultRetention time.Duration `json:"-"`
+	MaxRetention     time.Duration `json:"-"`
+
+	// BoundaryArn is the role's permissions boundary, SandboxBoundaryArn of TrustOptions.AccountId when empty.
+	BoundaryArn string `json:"-"`
+
+	// ReservedRoleNames can't be created, DefaultResolverRoleName is always reserved.
+	ReservedRoleNames []string `json:"-"`
+
+	// TrustOptions limits what Trust can refer to and names the sandbox account, it's required.
+	TrustOptions *TrustOptions `json:"-"`
 }
 
 type CreateRoleResponse struct {
 	RoleArn string `json:"role_arn"`
 	Token   string `json:"token"`
+
+	// OwnerSecret must be passed back when re-creating a role with the same name.
+	OwnerSecret string `json:"owner_secret"`
+
+	Trust             *TrustPolicyInput `json:"trust"`
+	PermissionProfile string            `json:"permission_profile"`
+
+	// Expires is when the role will be deleted, it can be pushed back with ExtendRole.
+	Expires time.Time `json:"expires"`
 }
 
-func CreateRole(ctx *Context, client *iam.Client, roleName string, requireExternalId bool, secret []byte) (*CreateRoleResponse, error) {
-	if roleName == "" {
-		roleName = RandStringRunes(16)
+// CreateRole creates the role, deleting and recreating it first if it already exists.
+//
+// An existing role is only replaced when OwnerSecret matches the one returned when it was originally created,
+// otherwise ErrRoleOwnedByOther is returned.
+func CreateRole(ctx *Context, params *CreateRoleInput) (*CreateRoleResponse, error) {
+	req := *params
+	if req.RoleName == "" {
+		req.RoleName = RandStringRunes(16)
+	} else if req.RoleName == DefaultResolverRoleName || slices.Contains(req.ReservedRoleNames, req.RoleName) {
+		return nil, fmt.Errorf("%w: %s", ErrReservedRoleName, req.RoleName)
 	}
-	if role, err := client.GetRole(ctx, &iam.GetRoleInput{
-		RoleName: aws.String(roleName),
-	}); err != nil {
-		var notFoundErr *types.NoSuchEntityException
-		if ok := errors.As(err, &notFoundErr); ok {
-			ctx.Debug.Printf("IAM role '%s' does not exist.\n", roleName)
-		} else {
-			return nil, fmt.Errorf("getting role: %w", err)
+	if req.Trust == nil {
+		req.Trust = &TrustPolicyInput{Template: DefaultTrustTemplate}
+		if req.RequireExternalId {
+			req.Trust.Template = "external-id"
 		}
-	} else if !IsOurRole(*role.Role) {
-		return nil, fmt.Errorf("forbidden role name: %s", roleName)
-	} else {
+	}
+
+	// Check this before touching an existing role.
+	trustPolicy, err := BuildTrustPolicy(req.Trust, req.TrustOptions)
+	if err != nil {
+		return nil, err
+	}
+	if req.PermissionProfile == "" {
+		req.PermissionProfile = DefaultPermissionProfile
+	}
+	profile, err := GetPermissionProfile(req.PermissionProfile)
+	if err != nil {
+		return nil, err
+	}
+	if req.Webhook != nil {
+		if err := req.Webhook.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if req.OwnerSecret != "" && len(req.OwnerSecret) < MinOwnerSecretLength {
+		return nil, fmt.Errorf("%w: must be at least %d characters", ErrInvalidOwnerSecret, MinOwnerSecretLength)
+	}
+	if req.MaxRetention == 0 {
+		req.MaxRetention = DefaultMaxRoleRetention
+	}
+	if req.BoundaryArn == "" {
+		req.BoundaryArn = SandboxBoundaryArn(req.TrustOptions.AccountId)
+	}
+	retention, err := ParseRetention(req.Retention, req.DefaultRetention, req.MaxRetention)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := req.Iam.GetRole(ctx, &iam.GetRoleInput{
+		RoleName: aws.String(req.RoleName),
+	})
+	if isNoSuchEntity(err) {
+		ctx.Debug.Printf("IAM role '%s' does not exist.\n", req.RoleName)
+		role = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting role: %w", err)
+	} else if !IsOurRole(*role.Role) || IsResolverRole(*role.Role) {
+		return nil, fmt.Errorf("forbidden role name: %s", req.RoleName)
+	} else if !IsRoleOwner(*role.Role, req.OwnerSecret) {
+		return nil, fmt.Errorf("%w: %s", ErrRoleOwnedByOther, req.RoleName)
+	}
+
+	// Identity providers are only set up for callers that may create the role, the reaper deletes them once no role
+	// refers to them.
+	if err := SetupTrustPolicy(ctx, req.Iam, req.Trust, req.TrustOptions); err != nil {
+		return nil, err
+	}
+
+	if role != nil {
 		// If the role exists, just delete it.
 		// TODO: Display an error in the UI if the role is deleted and recreated when polling.
-		if err := DeleteRole(ctx, client, roleName); err != nil {
+		if err := DeleteRole(ctx, req.Iam, req.RoleName); err != nil {
 			return nil, fmt.Errorf("deleting role: %w", err)
 		}
 	}
 
-	return createRole(ctx, client, secret, &CreateRoleRequest{
-		RoleName:          roleName,
-		RequireExternalId: requireExternalId,
-	})
+	return createRole(ctx, &req, trustPolicy, profile, retention)
 }
 
-func createRole(ctx *Context, client *iam.Client, secret []byte, req *CreateRoleRequest) (*CreateRoleResponse, error) {
-	go func() {
-		err := CleanUpOldRoles(ctx, client)
+func createRole(ctx *Context, req *CreateRoleInput, trustPolicy *PolicyDocument2, profile *PermissionProfile, retention time.Duration) (*CreateRoleResponse, error) {
+	client := req.Iam
+
+	ownerSecret := req.OwnerSecret
+	if ownerSecret == "" {
+		b, err := GenerateSecret(32)
 		if err != nil {
-			ctx.Error.Println("cleaning up old roles:", err)
+			return nil, fmt.Errorf("generating owner secret: %w", err)
 		}
-	}()
-
-	var policy string
-	if req.RequireExternalId {
-		policy = `{
-			"Version": "2012-10-17",
-			"Statement": [	
-				{	
-					"Effect": "Allow",
-					"Principal": {
-						"AWS": "*"
-					},
-					"Action": "sts:AssumeRole"	
-				}
-			]
-		}`
-	} else {
-		policy = `{
-			"Version": "2012-10-17",
-			"Statement": [	
-				{	
-					"Effect": "Allow",
-					"Principal": {
-						"AWS": "*"
-					},
-					"Action": "sts:AssumeRole",
-					"Condition": {
-						"Null": {
-							"sts:ExternalId": "false"
-						},
-						"StringNotEquals": {
-							"sts:ExternalId": "PurposefullyIncorrectExternalID"
-						}
-					}
-				}
-			]
-		}`
+		ownerSecret = base64.RawURLEncoding.EncodeToString(b)
 	}
+
+	expires := time.Now().UTC().Add(retention).Truncate(time.Second)
 	role, err := client.CreateRole(ctx, &iam.CreateRoleInput{
 		RoleName:                 aws.String(req.RoleName),
 		Description:              aws.String("role for assume-role-id"),
-		AssumeRolePolicyDocument: aws.String(policy),
-		PermissionsBoundary:      aws.String(SandboxBoundaryArn),
+		AssumeRolePolicyDocument: aws.String(string(Must(json.Marshal(trustPolicy)))),
+		PermissionsBoundary:      aws.String(req.BoundaryArn),
 		Tags: []types.Tag{
 			{
 				Key:   aws.String("assume-role-id"),
 				Value: aws.String("true"),
 			},
+			{
+				Key:   aws.String(OwnerTagKey),
+				Value: aws.String(HashOwnerSecret(ownerSecret)),
+			},
+			{
+				Key:   aws.String(ExpiresTagKey),
+				Value: aws.String(expires.Format(time.RFC3339)),
+			},
 		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("creating role: %w", err)
 	}
 
-	// Some stuff checks the current role for attached policies.
-	if _, err := client.PutRolePolicy(ctx, &iam.PutRolePolicyInput{
-		RoleName:   role.Role.RoleName,
-		PolicyName: aws.String("ListAttachedRolePolicies"),
-		PolicyDocument: aws.String(string(Must(json.Marshal(PolicyDocument{
-			Version: "2012-10-17",
-			Statement: []PolicyStatement{
-				{
-					Sid:      "AllowSelfListAttachedRolePolicies",
-					Effect:   "Allow",
-					Action:   "iam:ListAttachedRolePolicies",
-					Resource: *role.Role.Arn,
-				},
-				{
-					Sid:      "AllowDescribeRegions",
-					Effect:   "Allow",
-					Action:   "ec2:DescribeRegions",
-					Resource: "*",
-				},
-			},
-		})))),
-	}); err != nil {
-		return nil, fmt.Errorf("attaching policy: %w", err)
+	for _, policy := range profile.InlinePolicies(*role.Role.Arn) {
+		if _, err := client.PutRolePolicy(ctx, &iam.PutRolePolicyInput{
+			RoleName:       role.Role.RoleName,
+			PolicyName:     aws.String(policy.Name),
+			PolicyDocument: aws.String(string(Must(json.Marshal(policy.Document)))),
+		}); err != nil {
+			return nil, fmt.Errorf("putting policy %s: %w", policy.Name, err)
+		}
 	}
 
-	if _, err := client.AttachRolePolicy(ctx, &iam.AttachRolePolicyInput{
-		RoleName:  role.Role.RoleName,
-		PolicyArn: aws.String("arn:aws:iam::aws:policy/SecurityAudit"),
-	}); err != nil {
-		return nil, fmt.Errorf("attaching policy: %w", err)
-	}
-
-	// A single deny policy covering all un-necessary permissions.
-	if _, err := client.PutRolePolicy(ctx, &iam.PutRolePolicyInput{
-		RoleName:   role.Role.RoleName,
-		PolicyName: aws.String("DenyUnnecessaryAccess"),
-		PolicyDocument: aws.String(string(Must(json.Marshal(PolicyDocument2{
-			Version: "2012-10-17",
-			Statement: []PolicyStatement2{
-				{
-					Sid:         "AllowSelfListAttachedRolePolicies",
-					Effect:      "Deny",
-					Action:      []string{"iam:ListAttachedRolePolicies"},
-					NotResource: []string{*role.Role.Arn},
-				},
-				{
-					Sid:       "AllowDescribeRegions",
-					Effect:    "Deny",
-					NotAction: []string{"iam:ListAttachedRolePolicies", "ec2:DescribeRegions"},
-					Resource:  []string{"*"},
-				},
-			},
-		})))),
+	for _, policyArn := range profile.ManagedPolicyArns {
+		if _, err := client.AttachRolePolicy(ctx, &iam.AttachRolePolicyInput{
+			RoleName:  role.Role.RoleName,
+			PolicyArn: aws.String(policyArn),
+		}); err != nil {
+			return nil, fmt.Errorf("attaching policy %s: %w", policyArn, err)
+		}
+	}
+
+	var webhook *Webhook
+	if req.Webhook != nil {
+		if webhook, err = req.Webhook.Seal(*role.Role.RoleId, req.Keyring); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := req.Store.PutRole(ctx, &RoleRecord{
+		RoleId:     *role.Role.RoleId,
+		RoleName:   *role.Role.RoleName,
+		RoleArn:    *role.Role.Arn,
+		CreateDate: role.Role.CreateDate.UTC(),
+		Expires:    expires,
+		Webhook:    webhook,
 	}); err != nil {
-		return nil, fmt.Errorf("attaching policy: %w", err)
+		return nil, fmt.Errorf("storing role: %w", err)
 	}
 
-	token, err := CreateRoleToken(*role.Role.RoleName, *role.Role.RoleId, secret)
+	token, err := CreateRoleToken(&CreateRoleTokenInput{
+		RoleName: *role.Role.RoleName,
+		RoleArn:  *role.Role.Arn,
+		RoleId:   *role.Role.RoleId,
+		Lifetime: retention + RoleTokenLifetime,
+		Keyring:  req.Keyring,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("generating Token: %w", err)
 	}
@@ -179,54 +265,119 @@ func createRole(ctx *Context, client *iam.Client, secret []byte, req *CreateRole
 	ctx.Debug.Printf("issuing token %s for role %s", token, *role.Role.Arn)
 
 	return &CreateRoleResponse{
-		RoleArn: *role.Role.Arn,
-		Token:   token,
+		RoleArn:           *role.Role.Arn,
+		Token:             token,
+		OwnerSecret:       ownerSecret,
+		Trust:             req.Trust,
+		PermissionProfile: profile.Name,
+		Expires:           expires,
 	}, nil
 }
 
-func CleanUpOldRoles(ctx *Context, client *iam.Client) error {
-	resp, err := client.ListRoles(ctx, &iam.ListRolesInput{})
+type DeleteRoleWithTokenInput struct {
+	*PollEventsInput
+}
+
+type DeleteRoleWithTokenOutput struct {
+	RoleArn string `json:"role_arn"`
+
+	// Token is a viewer token for reading the events captured before the role was deleted, the owner token it was
+	// deleted with no longer works.
+	Token string `json:"token"`
+}
+
+// DeleteRoleWithToken deletes the role an owner token was issued for and revokes its tokens.
+//
+// The role is polled one last time first so its events are stored, and the returned viewer token can be used to read
+// them afterward. Deleting a role that's already gone still revokes its tokens.
+func DeleteRoleWithToken(ctx *Context, params *DeleteRoleWithTokenInput) (*DeleteRoleWithTokenOutput, error) {
+	token, err := CheckRoleToken(ctx, params.Store, params.Token, params.Keyring)
 	if err != nil {
-		return fmt.Errorf("listing roles: %w", err)
-	}
-
-	cutoff := time.Now().UTC().Add(-KeepRolesFor)
-	for _, role := range resp.Roles {
-		if IsOurRole(role) && role.CreateDate.UTC().Before(cutoff) {
-			ctx.Debug.Printf("deleting role %s", *role.RoleName)
-
-			resp, err := client.ListAttachedRolePolicies(ctx, &iam.ListAttachedRolePoliciesInput{
-				RoleName: role.RoleName,
-			})
-			if err != nil {
-				return fmt.Errorf("listing attached policies %s: %w", *role.RoleName, err)
-			}
-
-			for _, policy := range resp.AttachedPolicies {
-				if _, err := client.DetachRolePolicy(ctx, &iam.DetachRolePolicyInput{
-					RoleName:  role.RoleName,
-					PolicyArn: policy.PolicyArn,
-				}); err != nil {
-					return fmt.Errorf("detaching policy %s: %w", *policy.PolicyArn, err)
-				}
-			}
-
-			if _, err := client.DeleteRole(ctx, &iam.DeleteRoleInput{
-				RoleName: role.RoleName,
-			}); err != nil {
-				return fmt.Errorf("deleting role %s: %w", *role.RoleName, err)
-			}
-		}
+		return nil, err
+	} else if token.Scope != RoleTokenScopeOwner {
+		return nil, fmt.Errorf("%w: deleting a role needs an owner token", ErrRoleTokenScope)
+	}
+
+	if _, err := PollEvents(ctx, params.PollEventsInput); err != nil {
+		ctx.Error.Printf("polling events before deleting %s: %v", token.RoleName, err)
+	}
+
+	role, err := GetRoleFromToken(ctx, params.Iam, params.Store, params.Token, params.Keyring)
+	if errors.Is(err, ErrRoleNotFound) {
+		ctx.Debug.Printf("role %s is already gone: %v", token.RoleName, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("getting role from Token: %w", err)
+	} else if err := DeleteRole(ctx, params.Iam, *role.Role.RoleName); err != nil {
+		return nil, fmt.Errorf("deleting role: %w", err)
 	}
 
-	return nil
+	// Tokens are issued with second precision, so viewer tokens issued in the same second are still accepted.
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	record := &RoleRecord{RoleId: token.RoleId, RoleName: token.RoleName, RoleArn: token.RoleArn}
+	err = params.Store.UpdateRole(ctx, token.RoleId, func(role *RoleRecord) error {
+		role.TokensRevokedAt = revokedAt
+		record = role
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		// Roles from before the store, nothing else updates these so there's nothing to lose.
+		record.TokensRevokedAt = revokedAt
+		err = params.Store.PutRole(ctx, record)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storing role: %w", err)
+	}
+
+	viewer, err := CreateRoleToken(&CreateRoleTokenInput{
+		RoleName: token.RoleName,
+		RoleArn:  cmp.Or(token.RoleArn, record.RoleArn),
+		RoleId:   token.RoleId,
+		Scope:    RoleTokenScopeViewer,
+		Keyring:  params.Keyring,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generating Token: %w", err)
+	}
+
+	return &DeleteRoleWithTokenOutput{
+		RoleArn: cmp.Or(token.RoleArn, record.RoleArn),
+		Token:   viewer,
+	}, nil
 }
 
 func IsOurRole(role types.Role) bool {
-	for _, tag := range role.Tags {
+	return isOurTag(role.Tags)
+}
+
+// isOurTag reports whether tags has the assume-role-id tag everything we create in the sandbox account gets.
+func isOurTag(tags []types.Tag) bool {
+	for _, tag := range tags {
 		if *tag.Key == "assume-role-id" && *tag.Value == "true" {
 			return true
 		}
 	}
 	return false
 }
+
+// IsRoleOwner checks ownerSecret against the owner tag on the role.
+//
+// Roles without an owner tag can't be claimed by anyone.
+func IsRoleOwner(role types.Role, ownerSecret string) bool {
+	if ownerSecret == "" {
+		return false
+	}
+	for _, tag := range role.Tags {
+		if *tag.Key == OwnerTagKey {
+			expected := []byte(*tag.Value)
+			actual := []byte(HashOwnerSecret(ownerSecret))
+			return subtle.ConstantTimeCompare(expected, actual) == 1
+		}
+	}
+	return false
+}
+
+// HashOwnerSecret returns the value stored in the owner tag for ownerSecret.
+func HashOwnerSecret(ownerSecret string) string {
+	sum := sha256.Sum256([]byte(ownerSecret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+func TestIsRoleOwner(t *testing.T) {
+	secret := strings.Repeat("s", MinOwnerSecretLength)
+	tagged := func(tags ...string) types.Role {
+		role := types.Role{}
+		for i := 0; i < len(tags); i += 2 {
+			role.Tags = append(role.Tags, types.Tag{Key: aws.String(tags[i]), Value: aws.String(tags[i+1])})
+		}
+		return role
+	}
+
+	tests := []struct {
+		name   string
+		role   types.Role
+		secret string
+		want   bool
+	}{
+		{name: "Matching secret", role: tagged("assume-role-id", "true", OwnerTagKey, HashOwnerSecret(secret)), secret: secret, want: true},
+		{name: "Other secret", role: tagged(OwnerTagKey, HashOwnerSecret(secret)), secret: strings.Repeat("o", MinOwnerSecretLength)},
+		{name: "Empty secret", role: tagged(OwnerTagKey, HashOwnerSecret("")), secret: ""},
+		{name: "Unhashed secret", role: tagged(OwnerTagKey, secret), secret: secret},
+		{name: "No owner tag", role: tagged("assume-role-id", "true"), secret: secret},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRoleOwner(tt.role, tt.secret); got != tt.want {
+				t.Errorf("IsRoleOwner() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateRoleOwner(t *testing.T) {
+	secret := strings.Repeat("s", MinOwnerSecretLength)
+	existing := func(tags map[string]string) *fakeIamRole {
+		return &fakeIamRole{tags: tags}
+	}
+
+	tests := []struct {
+		name       string
+		existing   *fakeIamRole
+		secret     string
+		wantErr    error
+		wantSecret string
+	}{
+		{name: "New role", secret: secret, wantSecret: secret},
+		{name: "Generated secret"},
+		{name: "Short secret", secret: secret[1:], wantErr: ErrInvalidOwnerSecret},
+		{
+			name:       "Owner recreates",
+			existing:   existing(map[string]string{"assume-role-id": "true", OwnerTagKey: HashOwnerSecret(secret)}),
+			secret:     secret,
+			wantSecret: secret,
+		},
+		{
+			name:     "Owned by someone else",
+			existing: existing(map[string]string{"assume-role-id": "true", OwnerTagKey: HashOwnerSecret(secret)}),
+			secret:   strings.Repeat("o", MinOwnerSecretLength),
+			wantErr:  ErrRoleOwnedByOther,
+		},
+		{
+			name:     "No secret for an existing role",
+			existing: existing(map[string]string{"assume-role-id": "true", OwnerTagKey: HashOwnerSecret(secret)}),
+			wantErr:  ErrRoleOwnedByOther,
+		},
+		{
+			name:     "Existing role without an owner",
+			existing: existing(map[string]string{"assume-role-id": "true"}),
+			secret:   secret,
+			wantErr:  ErrRoleOwnedByOther,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := NewContext(context.Background())
+
+			store, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+			if err != nil {
+				t.Fatalf("NewBoltStore() error = %v", err)
+			}
+			defer store.Close()
+
+			fake := &fakeIam{roles: map[string]*fakeIamRole{}}
+			if tt.existing != nil {
+				fake.roles["example"] = tt.existing
+			}
+
+			got, err := CreateRole(ctx, &CreateRoleInput{
+				Iam:          newFakeIamClient(t, fake),
+				Store:        store,
+				Keyring:      NewStaticKeyring([]byte("thisis32byteslongpassphrase!!!##")),
+				RoleName:     "example",
+				OwnerSecret:  tt.secret,
+				TrustOptions: testTrustOptions,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateRole() error = %v, want %v", err, tt.wantErr)
+			} else if err != nil {
+				if role := fake.roles["example"]; tt.existing != nil && role != tt.existing {
+					t.Errorf("CreateRole() replaced the role after failing")
+				}
+				return
+			}
+
+			if tt.wantSecret != "" && got.OwnerSecret != tt.wantSecret {
+				t.Errorf("CreateRole() owner secret = %q, want %q", got.OwnerSecret, tt.wantSecret)
+			} else if len(got.OwnerSecret) < MinOwnerSecretLength {
+				t.Errorf("CreateRole() owner secret = %q, want at least %d characters", got.OwnerSecret, MinOwnerSecretLength)
+			}
+			if hash := fake.roles["example"].tags[OwnerTagKey]; hash != HashOwnerSecret(got.OwnerSecret) {
+				t.Errorf("owner tag = %s, want the hash of %s", hash, got.OwnerSecret)
+			}
+		})
+	}
+}
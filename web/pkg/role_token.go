@@ -1,41 +1,233 @@
 package pkg
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"strings"
+	"time"
 )
 
-// CreateRoleToken generates a token for a role and principal ID
+// ErrRoleNotFound is returned when the role a token was issued for has been deleted.
+var ErrRoleNotFound = errors.New("role no longer exists")
+
+var (
+	// ErrInvalidRoleToken is returned for tokens that don't decrypt or aren't in a format we know.
+	ErrInvalidRoleToken = errors.New("invalid token")
+
+	// ErrRoleTokenExpired is returned for tokens past their expiry.
+	ErrRoleTokenExpired = errors.New("token has expired")
+
+	// ErrRoleTokenRevoked is returned for tokens revoked when their role was deleted by its owner.
+	ErrRoleTokenRevoked = errors.New("token has been revoked")
+
+	// ErrRoleTokenScope is returned when a token's scope doesn't allow what it was used for.
+	ErrRoleTokenScope = errors.New("token doesn't allow this")
+)
+
+// RoleTokenLifetime is how long tokens are valid for by default, long enough to read a role's stored events after the
+// role itself has been cleaned up.
+const RoleTokenLifetime = 30 * 24 * time.Hour
+
+// MaxRoleTokenLifetime is the longest a token can be valid for when roles are kept up to maxRetention after they're
+// created, owner tokens last RoleTokenLifetime past the role's expiry.
+func MaxRoleTokenLifetime(maxRetention time.Duration) time.Duration {
+	return maxRetention + RoleTokenLifetime
+}
+
+// RoleTokenVersion is the version of the tokens CreateRoleToken issues.
+//
+// Version 0 tokens are the bare ciphertext of "<role name>:<role id>", they don't expire so they're only viewer scoped,
+// and stop decrypting once the first keyring rotation retires the legacy secret.
+// Version 1 tokens look like "1.<role id>.<ciphertext>", where the ciphertext from Encrypt is a JSON encoded RoleToken
+// and the "1.<role id>" prefix is authenticated as AES-GCM additional data.
+const RoleTokenVersion = 1
+
+type RoleTokenScope string
+
+const (
+	// RoleTokenScopeOwner tokens are returned when a role is created.
+	RoleTokenScopeOwner RoleTokenScope = "owner"
+
+	// RoleTokenScopeViewer tokens can only read the role's events.
+	RoleTokenScopeViewer RoleTokenScope = "viewer"
+)
+
+// RoleToken is what a token was issued for.
+type RoleToken struct {
+	Version  int            `json:"-"`
+	RoleName string         `json:"name"`
+	RoleArn  string         `json:"arn,omitempty"`
+	RoleId   string         `json:"id"`
+	Scope    RoleTokenScope `json:"scope"`
+
+	// IssuedAt and ExpiresAt are zero for version 0 tokens.
+	IssuedAt  time.Time `json:"iat"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+type CreateRoleTokenInput struct {
+	RoleName string
+	RoleArn  string
+	RoleId   string
+
+	// Scope is RoleTokenScopeOwner and Lifetime is RoleTokenLifetime by default.
+	Scope    RoleTokenScope
+	Lifetime time.Duration
+
+	Keyring *Keyring
+}
+
+// CreateRoleToken generates a token for a role
 //
 // The token can be exchanged for *iam.GetRoleOutput if the same role still exists in the future.
-// principalId is used to ensure that the same role is retrieved, not some future role with the same name.
-func CreateRoleToken(roleName, principalId string, secret []byte) (string, error) {
-	return Encrypt(fmt.Sprintf("%s:%s", roleName, principalId), secret)
+// The role ID is used to ensure that the same role is retrieved, not some future role with the same name.
+func CreateRoleToken(input *CreateRoleTokenInput) (string, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	token := &RoleToken{
+		Version:   RoleTokenVersion,
+		RoleName:  input.RoleName,
+		RoleArn:   input.RoleArn,
+		RoleId:    input.RoleId,
+		Scope:     RoleTokenScopeOwner,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(RoleTokenLifetime),
+	}
+	if input.Scope != "" {
+		token.Scope = input.Scope
+	}
+	if input.Lifetime != 0 {
+		token.ExpiresAt = now.Add(input.Lifetime)
+	}
+
+	// The role ID ends the prefix, so it can't contain the separator.
+	if token.RoleId == "" || strings.Contains(token.RoleId, ".") {
+		return "", fmt.Errorf("invalid role id: %q", token.RoleId)
+	}
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("marshalling token: %w", err)
+	}
+
+	prefix := fmt.Sprintf("%d.%s", RoleTokenVersion, token.RoleId)
+	ciphertext, err := EncryptWithAdditionalData(string(payload), []byte(prefix), input.Keyring)
+	if err != nil {
+		return "", fmt.Errorf("encrypting token: %w", err)
+	}
+
+	return prefix + "." + ciphertext, nil
+}
+
+// ParseRoleToken decrypts a Token returning what it was issued for, expired tokens return ErrRoleTokenExpired.
+func ParseRoleToken(token string, keyring *Keyring) (*RoleToken, error) {
+	// Version 0 tokens are raw URL base64, which never contains a '.'.
+	version, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return parseRoleTokenV0(token, keyring)
+	}
+
+	switch version {
+	case "1":
+		return parseRoleTokenV1(rest, keyring)
+	default:
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidRoleToken, version)
+	}
 }
 
-// GetRoleFromToken decrypts a Token and retrieves the role from IAM
-func GetRoleFromToken(ctx *Context, client *iam.Client, token string, secret []byte) (*iam.GetRoleOutput, error) {
-	plaintext, err := Decrypt(token, secret)
+func parseRoleTokenV0(token string, keyring *Keyring) (*RoleToken, error) {
+	plaintext, err := Decrypt(token, keyring)
 	if err != nil {
-		return nil, fmt.Errorf("decrypting Token: %w", err)
+		return nil, fmt.Errorf("%w: decrypting Token: %w", ErrInvalidRoleToken, err)
 	}
 	parts := strings.Split(plaintext, ":")
 	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid Token format")
+		return nil, fmt.Errorf("%w: invalid Token format", ErrInvalidRoleToken)
+	}
+
+	return &RoleToken{
+		Version:  0,
+		RoleName: parts[0],
+		RoleId:   parts[1],
+		Scope:    RoleTokenScopeViewer,
+	}, nil
+}
+
+func parseRoleTokenV1(rest string, keyring *Keyring) (*RoleToken, error) {
+	roleId, ciphertext, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid Token format", ErrInvalidRoleToken)
+	}
+
+	plaintext, err := DecryptWithAdditionalData(ciphertext, []byte("1."+roleId), keyring)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypting Token: %w", ErrInvalidRoleToken, err)
+	}
+
+	token := &RoleToken{}
+	if err := json.Unmarshal([]byte(plaintext), token); err != nil {
+		return nil, fmt.Errorf("%w: unmarshalling Token: %w", ErrInvalidRoleToken, err)
 	}
-	name, expectedPrincipalId := parts[0], parts[1]
+	token.Version = 1
+
+	if token.RoleId != roleId {
+		return nil, fmt.Errorf("%w: role id did not match (payload != prefix): %s != %s", ErrInvalidRoleToken, token.RoleId, roleId)
+	} else if token.Scope != RoleTokenScopeOwner && token.Scope != RoleTokenScopeViewer {
+		return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidRoleToken, token.Scope)
+	} else if !time.Now().Before(token.ExpiresAt) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrRoleTokenExpired, token.ExpiresAt)
+	}
+
+	return token, nil
+}
+
+// CheckRoleToken decrypts a Token like ParseRoleToken, and also returns ErrRoleTokenRevoked if the stored role says it
+// was revoked.
+func CheckRoleToken(ctx *Context, store Store, token string, keyring *Keyring) (*RoleToken, error) {
+	parsed, err := ParseRoleToken(token, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	// Roles from before the store can't have been revoked.
+	record, err := store.GetRole(ctx, parsed.RoleId)
+	if errors.Is(err, ErrNotFound) {
+		return parsed, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting stored role: %w", err)
+	} else if record.Revokes(parsed) {
+		return nil, fmt.Errorf("%w: tokens for %s were revoked at %s", ErrRoleTokenRevoked, parsed.RoleName, record.TokensRevokedAt)
+	}
+
+	return parsed, nil
+}
+
+// GetRoleFromToken checks a Token with CheckRoleToken and retrieves the role from IAM
+func GetRoleFromToken(ctx *Context, client *iam.Client, store Store, token string, keyring *Keyring) (*iam.GetRoleOutput, error) {
+	parsed, err := CheckRoleToken(ctx, store, token, keyring)
+	if err != nil {
+		return nil, err
+	}
+	name := parsed.RoleName
 
 	role, err := client.GetRole(ctx, &iam.GetRoleInput{
 		RoleName: aws.String(name),
 	})
-	if err != nil {
-		return nil, fmt.Errorf("getting role: %v", err)
+	var notFoundErr *types.NoSuchEntityException
+	if errors.As(err, &notFoundErr) {
+		return nil, fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+	} else if err != nil {
+		return nil, fmt.Errorf("getting role: %w", err)
 	} else if !IsOurRole(*role.Role) {
 		return nil, fmt.Errorf("forbidden role name: %s", name)
-	} else if id := *role.Role.RoleId; id != expectedPrincipalId {
-		return nil, fmt.Errorf("principal id did not match (actual != expected): %s != %s", id, expectedPrincipalId)
+	} else if id := *role.Role.RoleId; id != parsed.RoleId {
+		// The role was deleted and a new one created with the same name.
+		return nil, fmt.Errorf("%w: principal id did not match (actual != expected): %s != %s", ErrRoleNotFound, id, parsed.RoleId)
+	} else if arn := *role.Role.Arn; parsed.RoleArn != "" && arn != parsed.RoleArn {
+		return nil, fmt.Errorf("role arn did not match (actual != expected): %s != %s", arn, parsed.RoleArn)
 	}
 
 	return role, nil
@@ -0,0 +1,207 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoleToken(t *testing.T) {
+	keyring := NewStaticKeyring([]byte("thisis32byteslongpassphrase!!!##"))
+
+	create := func(input *CreateRoleTokenInput) string {
+		input.Keyring = keyring
+		token, err := CreateRoleToken(input)
+		if err != nil {
+			t.Fatalf("CreateRoleToken() error = %v", err)
+		}
+		return token
+	}
+
+	owner := create(&CreateRoleTokenInput{
+		RoleName: "assume-role-id-example",
+		RoleArn:  "arn:aws:iam::137068222704:role/assume-role-id-example",
+		RoleId:   "AROAEXAMPLE",
+	})
+	v0, err := Encrypt("assume-role-id-example:AROAEXAMPLE", keyring)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	// Version 0 tokens were encrypted before ciphertexts had key IDs.
+	v0 = strings.TrimPrefix(v0, LegacyKeyId+".")
+	_, ciphertext, _ := strings.Cut(strings.TrimPrefix(owner, "1."), ".")
+
+	tests := []struct {
+		name    string
+		token   string
+		want    *RoleToken
+		wantErr error
+	}{
+		{
+			name:  "Owner",
+			token: owner,
+			want: &RoleToken{
+				Version:  1,
+				RoleName: "assume-role-id-example",
+				RoleArn:  "arn:aws:iam::137068222704:role/assume-role-id-example",
+				RoleId:   "AROAEXAMPLE",
+				Scope:    RoleTokenScopeOwner,
+			},
+		},
+		{
+			name: "Viewer",
+			token: create(&CreateRoleTokenInput{
+				RoleName: "assume-role-id-example",
+				RoleId:   "AROAEXAMPLE",
+				Scope:    RoleTokenScopeViewer,
+			}),
+			want: &RoleToken{
+				Version:  1,
+				RoleName: "assume-role-id-example",
+				RoleId:   "AROAEXAMPLE",
+				Scope:    RoleTokenScopeViewer,
+			},
+		},
+		{
+			name:  "Version 0",
+			token: v0,
+			want: &RoleToken{
+				Version:  0,
+				RoleName: "assume-role-id-example",
+				RoleId:   "AROAEXAMPLE",
+				Scope:    RoleTokenScopeViewer,
+			},
+		},
+		{
+			name: "Expired",
+			token: create(&CreateRoleTokenInput{
+				RoleName: "assume-role-id-example",
+				RoleId:   "AROAEXAMPLE",
+				Lifetime: -time.Minute,
+			}),
+			wantErr: ErrRoleTokenExpired,
+		},
+		{
+			name:    "Swapped role id",
+			token:   "1.AROAOTHER." + ciphertext,
+			wantErr: ErrInvalidRoleToken,
+		},
+		{
+			name:    "Unknown version",
+			token:   "2.AROAEXAMPLE." + ciphertext,
+			wantErr: ErrInvalidRoleToken,
+		},
+		{
+			name:    "Garbage",
+			token:   "not-a-token",
+			wantErr: ErrInvalidRoleToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRoleToken(tt.token, keyring)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseRoleToken() error = %v, want %v", err, tt.wantErr)
+			} else if err != nil {
+				return
+			}
+
+			if got.Version != tt.want.Version || got.RoleName != tt.want.RoleName || got.RoleArn != tt.want.RoleArn ||
+				got.RoleId != tt.want.RoleId || got.Scope != tt.want.Scope {
+				t.Errorf("ParseRoleToken() = %+v, want %+v", got, tt.want)
+			}
+			if got.Version == 1 && !got.ExpiresAt.After(got.IssuedAt) {
+				t.Errorf("ParseRoleToken() expires at %s, want after %s", got.ExpiresAt, got.IssuedAt)
+			}
+		})
+	}
+}
+
+func TestCheckRoleToken(t *testing.T) {
+	ctx := NewContext(context.Background())
+	keyring := NewStaticKeyring([]byte("thisis32byteslongpassphrase!!!##"))
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() error = %v", err)
+	}
+	defer store.Close()
+
+	if err := store.PutRole(ctx, &RoleRecord{RoleId: "AROAREVOKED", TokensRevokedAt: time.Now().UTC()}); err != nil {
+		t.Fatalf("PutRole() error = %v", err)
+	}
+	if err := store.PutRole(ctx, &RoleRecord{RoleId: "AROAEXAMPLE"}); err != nil {
+		t.Fatalf("PutRole() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		roleId  string
+		wantErr error
+	}{
+		{name: "Revoked", roleId: "AROAREVOKED", wantErr: ErrRoleTokenRevoked},
+		{name: "Not revoked", roleId: "AROAEXAMPLE"},
+		{name: "Not stored", roleId: "AROAUNKNOWN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := CreateRoleToken(&CreateRoleTokenInput{
+				RoleName: "assume-role-id-example",
+				RoleId:   tt.roleId,
+				Keyring:  keyring,
+			})
+			if err != nil {
+				t.Fatalf("CreateRoleToken() error = %v", err)
+			}
+
+			if _, err := CheckRoleToken(ctx, store, token, keyring); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckRoleToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRoleRecordRevokes(t *testing.T) {
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	tests := []struct {
+		name      string
+		revokedAt time.Time
+		token     *RoleToken
+		want      bool
+	}{
+		{
+			name:  "Not revoked",
+			token: &RoleToken{Scope: RoleTokenScopeOwner},
+			want:  false,
+		},
+		{
+			name:      "Owner",
+			revokedAt: revokedAt,
+			token:     &RoleToken{Scope: RoleTokenScopeOwner, IssuedAt: revokedAt.Add(time.Hour)},
+			want:      true,
+		},
+		{
+			name:      "Viewer issued before",
+			revokedAt: revokedAt,
+			token:     &RoleToken{Scope: RoleTokenScopeViewer, IssuedAt: revokedAt.Add(-time.Second)},
+			want:      true,
+		},
+		{
+			name:      "Viewer issued with the revocation",
+			revokedAt: revokedAt,
+			token:     &RoleToken{Scope: RoleTokenScopeViewer, IssuedAt: revokedAt},
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &RoleRecord{TokensRevokedAt: tt.revokedAt}
+			if got := record.Revokes(tt.token); got != tt.want {
+				t.Errorf("Revokes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"strings"
+)
+
+// DefaultSAMLAudience is the audience AWS sign-in expects in assertions.
+const DefaultSAMLAudience = "https://signin.aws.amazon.com/saml"
+
+// DefaultMaxSAMLProviders leaves room under IAM's quota of 100 SAML providers per account.
+const DefaultMaxSAMLProviders = 50
+
+// MaxSAMLMetadataSize is the largest metadata accepted in a request body.
+const MaxSAMLMetadataSize = 1 << 20
+
+// samlProviderPrefix starts the name of every SAML provider the saml template creates, see SAMLProviderName.
+const samlProviderPrefix = "assume-role-id-"
+
+// ErrProviderLimit is returned when a trust template would create more identity providers than allowed.
+var ErrProviderLimit = errors.New("too many identity providers")
+
+// SAMLMetadata is the part of an IdP's metadata we check before handing it to IAM.
+type SAMLMetadata struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityId string   `xml:"entityID,attr"`
+	IdP      *struct {
+		KeyDescriptors []struct {
+			Use string `xml:"use,attr"`
+		} `xml:"KeyDescriptor"`
+	} `xml:"IDPSSODescriptor"`
+}
+
+// DecodeSAMLMetadata decodes the base64 metadata passed to the saml trust template, either alphabet is accepted with or
+// without padding.
+func DecodeSAMLMetadata(value string) ([]byte, error) {
+	value = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(value, "="))
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+// ParseSAMLMetadata checks the metadata describes an IdP with a signing key.
+func ParseSAMLMetadata(metadata []byte) (*SAMLMetadata, error) {
+	parsed := &SAMLMetadata{}
+	if err := xml.Unmarshal(metadata, parsed); err != nil {
+		return nil, fmt.Errorf("parsing metadata: %w", err)
+	}
+
+	if parsed.EntityId == "" {
+		return nil, errors.New("metadata is missing an entityID")
+	} else if parsed.IdP == nil || len(parsed.IdP.KeyDescriptors) == 0 {
+		return nil, errors.New("metadata is missing an IDPSSODescriptor with a KeyDescriptor")
+	}
+
+	return parsed, nil
+}
+
+// SAMLProviderName names the sandbox account's provider after the metadata, so the same IdP is only created once.
+func SAMLProviderName(metadata []byte) string {
+	sum := sha256.Sum256(metadata)
+	return samlProviderPrefix + hex.EncodeToString(sum[:8])
+}
+
+// SAMLProviderArn returns the ARN of the provider named name in the sandbox account accountId.
+func SAMLProviderArn(accountId, name string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:saml-provider/%s", accountId, name)
+}
+
+// EnsureSAMLProvider creates the SAML provider for metadata if it doesn't exist, unless there are already limit providers
+// created by the saml template, in which case ErrProviderLimit is returned.
+func EnsureSAMLProvider(ctx *Context, client *iam.Client, metadata []byte, limit int) error {
+	name := SAMLProviderName(metadata)
+
+	resp, err := client.ListSAMLProviders(ctx, &iam.ListSAMLProvidersInput{})
+	if err != nil {
+		return fmt.Errorf("listing saml providers: %w", err)
+	}
+	count := 0
+	for _, provider := range resp.SAMLProviderList {
+		_, existing, _ := strings.Cut(aws.ToString(provider.Arn), ":saml-provider/")
+		if existing == name {
+			ctx.Debug.Printf("saml provider %s already exists", name)
+			return nil
+		} else if strings.HasPrefix(existing, samlProviderPrefix) {
+			count++
+		}
+	}
+	if count >= limit {
+		return fmt.Errorf("%w: %d saml providers already exist", ErrProviderLimit, count)
+	}
+
+	ctx.Debug.Printf("creating saml provider %s", name)
+	_, err = client.CreateSAMLProvider(ctx, &iam.CreateSAMLProviderInput{
+		Name:                 aws.String(name),
+		SAMLMetadataDocument: aws.String(string(metadata)),
+		Tags: []types.Tag{
+			{
+				Key:   aws.String("assume-role-id"),
+				Value: aws.String("true"),
+			},
+		},
+	})
+	var existsErr *types.EntityAlreadyExistsException
+	if errors.As(err, &existsErr) {
+		ctx.Debug.Printf("saml provider %s already exists", name)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("creating saml provider %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// SAMLClaims are the parts of the assertion an AssumeRoleWithSAML call was made with that CloudTrail records.
+type SAMLClaims struct {
+	Issuer   string `json:"issuer"`
+	NameId   string `json:"name_id"`
+	Audience string `json:"audience"`
+
+	// NameIdFormat is CloudTrail's subjectType, transient or persistent for those formats and the full URI otherwise.
+	NameIdFormat  string `json:"name_id_format,omitempty"`
+	NameQualifier string `json:"name_qualifier,omitempty"`
+	ProviderArn   string `json:"provider_arn,omitempty"`
+	AssertionId   string `json:"assertion_id,omitempty"`
+}
+
+// NewSAMLClaims returns the SAML claims of an AssumeRoleWithSAML event, or nil for other events.
+//
+// Failed calls don't have response elements, so only what's in the caller's identity and request is returned.
+func NewSAMLClaims(event Event) *SAMLClaims {
+	if event.EventName != EventAssumeRoleWithSAML {
+		return nil
+	}
+
+	response := event.ResponseElements
+	claims := &SAMLClaims{
+		Issuer:        response.Issuer,
+		NameId:        response.Subject,
+		Audience:      response.Audience,
+		NameIdFormat:  response.SubjectType,
+		NameQualifier: response.NameQualifier,
+		ProviderArn:   event.RequestParameters.PrincipalArn,
+		AssertionId:   event.RequestParameters.SAMLAssertionID,
+	}
+	if claims.NameId == "" {
+		claims.NameId = event.UserIdentity.UserName
+	}
+	if claims.NameQualifier == "" {
+		claims.NameQualifier = event.UserIdentity.IdentityProvider
+	}
+
+	return claims
+}
@@ -0,0 +1,318 @@
+package pkg
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"github.com/ryanjarv/assume-role-id/web/pkg/samltest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSAMLClaims(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  *SAMLClaims
+	}{
+		{
+			name: "Success",
+			event: `{
+				"eventName": "AssumeRoleWithSAML",
+				"userIdentity": {
+					"type": "SAMLUser",
+					"principalId": "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s=:alice",
+					"userName": "alice",
+					"identityProvider": "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s="
+				},
+				"requestParameters": {
+					"sAMLAssertionID": "_abc",
+					"principalArn": "arn:aws:iam::137068222704:saml-provider/example"
+				},
+				"responseElements": {
+					"subject": "alice",
+					"subjectType": "persistent",
+					"issuer": "https://idp.example.com",
+					"audience": "https://signin.aws.amazon.com/saml",
+					"nameQualifier": "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s="
+				}
+			}`,
+			want: &SAMLClaims{
+				Issuer:        "https://idp.example.com",
+				NameId:        "alice",
+				Audience:      "https://signin.aws.amazon.com/saml",
+				NameIdFormat:  "persistent",
+				NameQualifier: "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s=",
+				ProviderArn:   "arn:aws:iam::137068222704:saml-provider/example",
+				AssertionId:   "_abc",
+			},
+		},
+		{
+			name: "Failed",
+			event: `{
+				"eventName": "AssumeRoleWithSAML",
+				"errorCode": "AccessDenied",
+				"userIdentity": {
+					"type": "SAMLUser",
+					"principalId": "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s=:mallory",
+					"userName": "mallory",
+					"identityProvider": "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s="
+				},
+				"requestParameters": {
+					"principalArn": "arn:aws:iam::137068222704:saml-provider/example"
+				}
+			}`,
+			want: &SAMLClaims{
+				NameId:        "mallory",
+				NameQualifier: "Sr4lbzH/lWMD0bZ1Y+QZXJ0KU9s=",
+				ProviderArn:   "arn:aws:iam::137068222704:saml-provider/example",
+			},
+		},
+		{
+			name:  "AssumeRole",
+			event: `{"eventName": "AssumeRole"}`,
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var event Event
+			if err := json.Unmarshal([]byte(tt.event), &event); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			got := NewSAMLClaims(event)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("NewSAMLClaims() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSAMLPipeline signs an assertion with a fake IdP, assumes a role built from the saml template with it through a
+// fake STS, and checks the sweeper and poller pick the call up from a fake CloudTrail.
+func TestSAMLPipeline(t *testing.T) {
+	ctx := NewContext(context.Background())
+
+	idp, err := samltest.NewIdP("https://idp.example.com")
+	if err != nil {
+		t.Fatalf("NewIdP() error = %v", err)
+	}
+	metadata := idp.Metadata()
+
+	policy, err := BuildTrustPolicy(&TrustPolicyInput{
+		Template: "saml",
+		Params: map[string]string{
+			"metadata": base64.URLEncoding.EncodeToString(metadata),
+			"audience": DefaultSAMLAudience,
+		},
+	}, testTrustOptions)
+	if err != nil {
+		t.Fatalf("BuildTrustPolicy() error = %v", err)
+	}
+	providerArn := policy.Statement[0].Principal.Federated
+	if want := SAMLProviderArn(testSandboxAccountId, SAMLProviderName(metadata)); providerArn != want {
+		t.Fatalf("BuildTrustPolicy() principal = %s, want %s", providerArn, want)
+	}
+
+	sts := samltest.NewSTS(testSandboxAccountId, "us-east-1")
+	if arn, err := sts.CreateSAMLProvider(SAMLProviderName(metadata), metadata); err != nil {
+		t.Fatalf("CreateSAMLProvider() error = %v", err)
+	} else if arn != providerArn {
+		t.Fatalf("CreateSAMLProvider() = %s, want %s", arn, providerArn)
+	}
+
+	roleArn := "arn:aws:iam::" + testSandboxAccountId + ":role/assume-role-id-saml"
+	roleId := "AROAEXAMPLESAMLROLE"
+	assume := func(input *samltest.AssertionInput) ([]byte, error) {
+		response, err := idp.Response(input)
+		if err != nil {
+			t.Fatalf("Response() error = %v", err)
+		}
+		return sts.AssumeRoleWithSAML(&samltest.AssumeRoleWithSAMLInput{
+			RoleArn:       roleArn,
+			PrincipalArn:  providerArn,
+			SAMLAssertion: response,
+			RoleId:        roleId,
+		})
+	}
+
+	raw, err := assume(&samltest.AssertionInput{
+		RoleArn:     roleArn,
+		ProviderArn: providerArn,
+		NameId:      "alice",
+		SessionName: "alice@example.com",
+	})
+	if err != nil {
+		t.Fatalf("AssumeRoleWithSAML() error = %v", err)
+	}
+
+	if _, err := assume(&samltest.AssertionInput{
+		RoleArn:     roleArn,
+		ProviderArn: providerArn,
+		NameId:      "alice",
+		SessionName: "alice@example.com",
+		Lifetime:    -time.Minute,
+	}); !errors.Is(err, samltest.ErrInvalidAssertion) {
+		t.Errorf("AssumeRoleWithSAML() with an expired assertion error = %v, want %v", err, samltest.ErrInvalidAssertion)
+	}
+
+	response, err := idp.Response(&samltest.AssertionInput{RoleArn: roleArn, ProviderArn: providerArn, NameId: "alice"})
+	if err != nil {
+		t.Fatalf("Response() error = %v", err)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(response)
+	tampered := base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(decoded), ">alice<", ">root<", 1)))
+	if _, err := sts.AssumeRoleWithSAML(&samltest.AssumeRoleWithSAMLInput{
+		RoleArn:       roleArn,
+		PrincipalArn:  providerArn,
+		SAMLAssertion: tampered,
+		RoleId:        roleId,
+	}); !errors.Is(err, samltest.ErrInvalidAssertion) {
+		t.Errorf("AssumeRoleWithSAML() with a tampered assertion error = %v, want %v", err, samltest.ErrInvalidAssertion)
+	}
+
+	var assumed Event
+	if err := json.Unmarshal(raw, &assumed); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	// A call made with the session, so there's something for LookupSessionEvents to find.
+	session, err := json.Marshal(map[string]any{
+		"eventID":     "session-event",
+		"eventName":   "GetCallerIdentity",
+		"eventSource": "sts.amazonaws.com",
+		"eventTime":   assumed.EventTime.Format(time.RFC3339),
+		"awsRegion":   "us-east-1",
+		"readOnly":    true,
+		"userIdentity": map[string]any{
+			"type":        "AssumedRole",
+			"principalId": roleId + ":alice@example.com",
+			"accessKeyId": assumed.ResponseElements.Credentials.AccessKeyId,
+			"sessionContext": map[string]any{
+				"sessionIssuer": map[string]any{"type": "Role", "principalId": roleId},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	trail := samltest.NewCloudTrail()
+	defer trail.Close()
+	for _, event := range [][]byte{raw, session} {
+		if err := trail.AddEvent(event); err != nil {
+			t.Fatalf("AddEvent() error = %v", err)
+		}
+	}
+	client := trail.Client("us-east-1")
+
+	sweeper := NewSweeper(&NewSweeperInput{CloudTrail: map[string]*cloudtrail.Client{"us-east-1": client}})
+	sweeper.Refresh(ctx)
+	since := time.Now().Add(-time.Hour)
+	if status := sweeper.RegionsSince(since)["us-east-1"].Status; status != RegionStatusOk {
+		t.Fatalf("Refresh() region status = %s, want %s", status, RegionStatusOk)
+	}
+
+	events := sweeper.Events(roleId, since)
+	if len(events) != 1 || events[0].EventName != EventAssumeRoleWithSAML {
+		t.Fatalf("Events() = %+v, want the AssumeRoleWithSAML event", events)
+	}
+
+	resolver := &fakeResolver{}
+	results, err := PollRegionEvents(ctx, client, resolver, "assume-role-id-saml", roleId, events)
+	if err != nil {
+		t.Fatalf("PollRegionEvents() error = %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("PollRegionEvents() got %d results, want 1", len(results))
+	}
+	result := results[0]
+
+	if result.SourceIdentity.Type != SourceIdentitySAMLUser {
+		t.Errorf("SourceIdentity.Type = %s, want %s", result.SourceIdentity.Type, SourceIdentitySAMLUser)
+	}
+	if len(resolver.calls) != 1 || len(resolver.calls[0]) != 0 {
+		t.Errorf("LookupPrincipalIds() calls = %v, want a single empty call", resolver.calls)
+	}
+	if result.SAML == nil {
+		t.Fatalf("SAML = nil, want claims")
+	}
+	want := SAMLClaims{
+		Issuer:        "https://idp.example.com",
+		NameId:        "alice",
+		Audience:      samltest.AWSSignIn,
+		NameIdFormat:  "persistent",
+		NameQualifier: assumed.ResponseElements.NameQualifier,
+		ProviderArn:   providerArn,
+		AssertionId:   assumed.RequestParameters.SAMLAssertionID,
+	}
+	if *result.SAML != want {
+		t.Errorf("SAML = %+v, want %+v", *result.SAML, want)
+	}
+	if len(result.Events) != 1 || result.Events[0].EventId != "session-event" {
+		t.Errorf("Events = %+v, want the session's GetCallerIdentity call", result.Events)
+	}
+}
+
+func TestEnsureSAMLProvider(t *testing.T) {
+	metadata := []byte("<EntityDescriptor/>")
+	providerArn := SAMLProviderArn(testSandboxAccountId, SAMLProviderName(metadata))
+	ours := map[string]string{"assume-role-id": "true"}
+
+	tests := []struct {
+		name      string
+		providers []string
+		limit     int
+		wantErr   error
+		wantCount int
+	}{
+		{
+			name:      "Created",
+			providers: []string{SAMLProviderArn(testSandboxAccountId, "assume-role-id-other")},
+			limit:     2,
+			wantCount: 2,
+		},
+		{
+			name:      "Already exists at the limit",
+			providers: []string{SAMLProviderArn(testSandboxAccountId, "assume-role-id-other"), providerArn},
+			limit:     2,
+			wantCount: 2,
+		},
+		{
+			name:      "At the limit",
+			providers: []string{SAMLProviderArn(testSandboxAccountId, "assume-role-id-other"), SAMLProviderArn(testSandboxAccountId, "assume-role-id-another")},
+			limit:     2,
+			wantErr:   ErrProviderLimit,
+			wantCount: 2,
+		},
+		{
+			name:      "Providers that aren't ours don't count",
+			providers: []string{SAMLProviderArn(testSandboxAccountId, "okta"), SAMLProviderArn(testSandboxAccountId, "assume-role-id-other")},
+			limit:     2,
+			wantCount: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeIam{roles: map[string]*fakeIamRole{}, providers: map[string]*fakeIamProvider{}}
+			for _, providerArn := range tt.providers {
+				fake.providers[providerArn] = &fakeIamProvider{created: time.Now(), tags: ours}
+			}
+
+			err := EnsureSAMLProvider(NewContext(context.Background()), newFakeIamClient(t, fake), metadata, tt.limit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EnsureSAMLProvider() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(fake.providers) != tt.wantCount {
+				t.Errorf("providers = %v, want %d", Keys(fake.providers), tt.wantCount)
+			}
+			if provider := fake.providers[providerArn]; err == nil && provider.tags["assume-role-id"] != "true" {
+				t.Errorf("provider tags = %v, want assume-role-id", provider.tags)
+			}
+		})
+	}
+}
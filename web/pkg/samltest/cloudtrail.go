@@ -0,0 +1,151 @@
+package samltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloudTrail is a fake CloudTrail serving LookupEvents for the events added to it.
+//
+// Only the EventName, Username and AccessKeyId lookup attributes are supported, and everything is returned in one page.
+type CloudTrail struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	events []trailEvent
+}
+
+type trailEvent struct {
+	id          string
+	name        string
+	time        time.Time
+	username    string
+	accessKeyId string
+	raw         string
+}
+
+// NewCloudTrail starts a fake CloudTrail, it should be closed when done.
+func NewCloudTrail() *CloudTrail {
+	c := &CloudTrail{}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	return c
+}
+
+// Client returns a CloudTrail client for region using the fake.
+func (c *CloudTrail) Client(region string) *cloudtrail.Client {
+	return cloudtrail.New(cloudtrail.Options{
+		BaseEndpoint:     aws.String(c.URL),
+		Region:           region,
+		Credentials:      aws.AnonymousCredentials{},
+		RetryMaxAttempts: 1,
+	})
+}
+
+// AddEvent records a CloudTrail event, in the same JSON format CloudTrail uses.
+func (c *CloudTrail) AddEvent(raw []byte) error {
+	var event struct {
+		EventId      string    `json:"eventID"`
+		EventName    string    `json:"eventName"`
+		EventTime    time.Time `json:"eventTime"`
+		UserIdentity struct {
+			UserName    string `json:"userName"`
+			PrincipalId string `json:"principalId"`
+			AccessKeyId string `json:"accessKeyId"`
+		} `json:"userIdentity"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return fmt.Errorf("unmarshalling event: %w", err)
+	}
+
+	// Role sessions are looked up by their session name.
+	username := event.UserIdentity.UserName
+	if username == "" {
+		_, username, _ = strings.Cut(event.UserIdentity.PrincipalId, ":")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, trailEvent{
+		id:          event.EventId,
+		name:        event.EventName,
+		time:        event.EventTime,
+		username:    username,
+		accessKeyId: event.UserIdentity.AccessKeyId,
+		raw:         string(raw),
+	})
+
+	return nil
+}
+
+func (c *CloudTrail) serve(w http.ResponseWriter, r *http.Request) {
+	if target := r.Header.Get("X-Amz-Target"); !strings.HasSuffix(target, ".LookupEvents") {
+		http.Error(w, fmt.Sprintf(`{"__type":"UnknownOperationException","message":"%s"}`, target), http.StatusBadRequest)
+		return
+	}
+
+	var input struct {
+		LookupAttributes []struct {
+			AttributeKey   string
+			AttributeValue string
+		}
+		StartTime *float64
+		EndTime   *float64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, fmt.Sprintf(`{"__type":"InvalidLookupAttributesException","message":"%s"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	var matched []trailEvent
+	for _, event := range c.events {
+		if input.StartTime != nil && float64(event.time.Unix()) < *input.StartTime {
+			continue
+		} else if input.EndTime != nil && float64(event.time.Unix()) > *input.EndTime {
+			continue
+		}
+
+		match := true
+		for _, attr := range input.LookupAttributes {
+			switch attr.AttributeKey {
+			case "EventName":
+				match = match && event.name == attr.AttributeValue
+			case "Username":
+				match = match && event.username == attr.AttributeValue
+			case "AccessKeyId":
+				match = match && event.accessKeyId == attr.AttributeValue
+			}
+		}
+		if match {
+			matched = append(matched, event)
+		}
+	}
+	c.mu.Unlock()
+
+	// CloudTrail returns the most recent events first.
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].time.After(matched[j].time)
+	})
+
+	events := []map[string]any{}
+	for _, event := range matched {
+		events = append(events, map[string]any{
+			"EventId":         event.id,
+			"EventName":       event.name,
+			"EventTime":       event.time.Unix(),
+			"Username":        event.username,
+			"CloudTrailEvent": event.raw,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(map[string]any{"Events": events})
+}
@@ -0,0 +1,196 @@
+// Package samltest is a fake SAML identity provider along with fake STS and CloudTrail backends, so AssumeRoleWithSAML
+// can be exercised end to end without a real IdP or AWS account.
+//
+// IdP signs assertions, STS checks them against the metadata of the providers created with it and returns the
+// CloudTrail event AWS would record, and CloudTrail serves those events over LookupEvents.
+package samltest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"math/big"
+	"time"
+)
+
+const (
+	ProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	AssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	MetadataNamespace  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	// AWS sign-in's endpoint, the default audience and recipient.
+	AWSSignIn = "https://signin.aws.amazon.com/saml"
+
+	RoleAttribute            = "https://aws.amazon.com/SAML/Attributes/Role"
+	RoleSessionNameAttribute = "https://aws.amazon.com/SAML/Attributes/RoleSessionName"
+)
+
+// IdP is a SAML identity provider with a self-signed signing certificate.
+type IdP struct {
+	EntityId string
+	Key      *rsa.PrivateKey
+	Cert     *x509.Certificate
+}
+
+// NewIdP creates an IdP with a new key and a certificate valid for a day.
+func NewIdP(entityId string) (*IdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: entityId},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	return &IdP{EntityId: entityId, Key: key, Cert: cert}, nil
+}
+
+// Metadata returns the IdP's metadata XML, as it would be uploaded to IAM.
+func (idp *IdP) Metadata() []byte {
+	doc := etree.NewDocument()
+
+	entity := doc.CreateElement("md:EntityDescriptor")
+	entity.CreateAttr("xmlns:md", MetadataNamespace)
+	entity.CreateAttr("entityID", idp.EntityId)
+
+	descriptor := entity.CreateElement("md:IDPSSODescriptor")
+	descriptor.CreateAttr("protocolSupportEnumeration", ProtocolNamespace)
+
+	key := descriptor.CreateElement("md:KeyDescriptor")
+	key.CreateAttr("use", "signing")
+	keyInfo := key.CreateElement("ds:KeyInfo")
+	keyInfo.CreateAttr("xmlns:ds", dsig.Namespace)
+	keyInfo.CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").SetText(base64.StdEncoding.EncodeToString(idp.Cert.Raw))
+
+	sso := descriptor.CreateElement("md:SingleSignOnService")
+	sso.CreateAttr("Binding", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect")
+	sso.CreateAttr("Location", idp.EntityId+"/sso")
+
+	b, _ := doc.WriteToBytes()
+	return b
+}
+
+// AssertionInput describes the user an assertion is for and the role they want.
+type AssertionInput struct {
+	RoleArn     string
+	ProviderArn string
+	NameId      string
+	SessionName string
+
+	// NameIdFormat defaults to persistent and Audience to AWSSignIn.
+	NameIdFormat string
+	Audience     string
+
+	// Lifetime is how long the assertion is valid for, five minutes by default.
+	Lifetime time.Duration
+}
+
+// Response returns a base64 encoded SAMLResponse with a signed assertion, as it would be posted to AWS sign-in or
+// passed to AssumeRoleWithSAML.
+func (idp *IdP) Response(input *AssertionInput) (string, error) {
+	now := time.Now().UTC()
+	lifetime := input.Lifetime
+	if lifetime == 0 {
+		lifetime = 5 * time.Minute
+	}
+	audience := input.Audience
+	if audience == "" {
+		audience = AWSSignIn
+	}
+	format := input.NameIdFormat
+	if format == "" {
+		format = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	}
+
+	doc := etree.NewDocument()
+	response := doc.CreateElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", ProtocolNamespace)
+	response.CreateAttr("xmlns:saml", AssertionNamespace)
+	response.CreateAttr("ID", newId())
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("IssueInstant", now.Format(time.RFC3339))
+	response.CreateAttr("Destination", AWSSignIn)
+	response.CreateElement("saml:Issuer").SetText(idp.EntityId)
+	response.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", "urn:oasis:names:tc:SAML:2.0:status:Success")
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", AssertionNamespace)
+	assertion.CreateAttr("ID", newId())
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateAttr("IssueInstant", now.Format(time.RFC3339))
+	assertion.CreateElement("saml:Issuer").SetText(idp.EntityId)
+
+	subject := assertion.CreateElement("saml:Subject")
+	nameId := subject.CreateElement("saml:NameID")
+	nameId.CreateAttr("Format", format)
+	nameId.SetText(input.NameId)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", "urn:oasis:names:tc:SAML:2.0:cm:bearer")
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	data.CreateAttr("NotOnOrAfter", now.Add(lifetime).Format(time.RFC3339))
+	data.CreateAttr("Recipient", AWSSignIn)
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", now.Add(-time.Minute).Format(time.RFC3339))
+	conditions.CreateAttr("NotOnOrAfter", now.Add(lifetime).Format(time.RFC3339))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(audience)
+
+	authn := assertion.CreateElement("saml:AuthnStatement")
+	authn.CreateAttr("AuthnInstant", now.Format(time.RFC3339))
+	authn.CreateElement("saml:AuthnContext").CreateElement("saml:AuthnContextClassRef").SetText("urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport")
+
+	attributes := assertion.CreateElement("saml:AttributeStatement")
+	for _, attr := range [][2]string{
+		{RoleAttribute, input.RoleArn + "," + input.ProviderArn},
+		{RoleSessionNameAttribute, input.SessionName},
+	} {
+		attribute := attributes.CreateElement("saml:Attribute")
+		attribute.CreateAttr("Name", attr[0])
+		attribute.CreateElement("saml:AttributeValue").SetText(attr[1])
+	}
+
+	signer, err := dsig.NewSigningContext(idp.Key, [][]byte{idp.Cert.Raw})
+	if err != nil {
+		return "", fmt.Errorf("creating signing context: %w", err)
+	}
+	signer.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+
+	signature, err := signer.ConstructSignature(assertion, true)
+	if err != nil {
+		return "", fmt.Errorf("signing assertion: %w", err)
+	}
+
+	// The schema puts the signature right after the issuer.
+	assertion.InsertChildAt(1, signature)
+	response.AddChild(assertion)
+
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		return "", fmt.Errorf("writing response: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("_%x", b)
+}
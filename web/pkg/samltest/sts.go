@@ -0,0 +1,202 @@
+package samltest
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidAssertion is returned by STS.AssumeRoleWithSAML when AWS would reject the assertion.
+var ErrInvalidAssertion = errors.New("invalid saml assertion")
+
+// STS plays the AWS side of AssumeRoleWithSAML.
+type STS struct {
+	AccountId string
+	Region    string
+
+	mu        sync.Mutex
+	providers map[string]*x509.Certificate
+}
+
+func NewSTS(accountId, region string) *STS {
+	return &STS{
+		AccountId: accountId,
+		Region:    region,
+		providers: map[string]*x509.Certificate{},
+	}
+}
+
+// CreateSAMLProvider registers the metadata's signing certificate under name and returns the provider's ARN.
+func (s *STS) CreateSAMLProvider(name string, metadata []byte) (string, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(metadata); err != nil {
+		return "", fmt.Errorf("parsing metadata: %w", err)
+	}
+
+	el := doc.FindElement("//IDPSSODescriptor/KeyDescriptor/KeyInfo/X509Data/X509Certificate")
+	if el == nil {
+		return "", errors.New("metadata is missing a signing certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(el.Text()))
+	if err != nil {
+		return "", fmt.Errorf("decoding certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	arn := fmt.Sprintf("arn:aws:iam::%s:saml-provider/%s", s.AccountId, name)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.providers[arn] = cert
+
+	return arn, nil
+}
+
+type AssumeRoleWithSAMLInput struct {
+	RoleArn       string
+	PrincipalArn  string
+	SAMLAssertion string
+
+	// RoleId is the unique ID of the role, AWS would look this up.
+	RoleId string
+}
+
+// AssumeRoleWithSAML checks the assertion the way AWS does and returns the CloudTrail event for the call, or an error
+// wrapping ErrInvalidAssertion.
+func (s *STS) AssumeRoleWithSAML(input *AssumeRoleWithSAMLInput) ([]byte, error) {
+	s.mu.Lock()
+	cert, ok := s.providers[input.PrincipalArn]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown provider %s", ErrInvalidAssertion, input.PrincipalArn)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(input.SAMLAssertion)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding response: %w", ErrInvalidAssertion, err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, fmt.Errorf("%w: parsing response: %w", ErrInvalidAssertion, err)
+	}
+
+	assertion := doc.FindElement("/Response/Assertion")
+	if assertion == nil {
+		return nil, fmt.Errorf("%w: response is missing an assertion", ErrInvalidAssertion)
+	}
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert}})
+	assertion, err = validator.Validate(assertion)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAssertion, err)
+	}
+
+	elements := map[string]*etree.Element{}
+	for _, path := range []string{"./Issuer", "./Subject/NameID", "./Conditions", "./Conditions/AudienceRestriction/Audience"} {
+		if elements[path] = assertion.FindElement(path); elements[path] == nil {
+			return nil, fmt.Errorf("%w: assertion is missing %s", ErrInvalidAssertion, path)
+		}
+	}
+	issuer := elements["./Issuer"].Text()
+	nameId := elements["./Subject/NameID"]
+	audience := elements["./Conditions/AudienceRestriction/Audience"].Text()
+
+	now := time.Now().UTC()
+	if notOnOrAfter, err := time.Parse(time.RFC3339, elements["./Conditions"].SelectAttrValue("NotOnOrAfter", "")); err != nil || !now.Before(notOnOrAfter) {
+		return nil, fmt.Errorf("%w: assertion has expired", ErrInvalidAssertion)
+	}
+
+	attributes := map[string][]string{}
+	for _, attribute := range assertion.FindElements("./AttributeStatement/Attribute") {
+		for _, value := range attribute.FindElements("./AttributeValue") {
+			name := attribute.SelectAttrValue("Name", "")
+			attributes[name] = append(attributes[name], value.Text())
+		}
+	}
+	if !slices.Contains(attributes[RoleAttribute], input.RoleArn+","+input.PrincipalArn) {
+		return nil, fmt.Errorf("%w: assertion doesn't allow %s", ErrInvalidAssertion, input.RoleArn)
+	}
+	sessionName := ""
+	if v := attributes[RoleSessionNameAttribute]; len(v) != 0 {
+		sessionName = v[0]
+	}
+
+	subjectType := strings.TrimPrefix(nameId.SelectAttrValue("Format", ""), "urn:oasis:names:tc:SAML:2.0:nameid-format:")
+
+	// See the saml:namequalifier key in https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_iam-condition-keys.html
+	providerName := input.PrincipalArn[strings.LastIndex(input.PrincipalArn, "/")+1:]
+	sum := sha1.Sum([]byte(issuer + s.AccountId + "/" + providerName))
+	nameQualifier := base64.StdEncoding.EncodeToString(sum[:])
+
+	accessKeyId := "ASIA" + randomString(16)
+	event := map[string]any{
+		"eventVersion": "1.08",
+		"userIdentity": map[string]any{
+			"type":             "SAMLUser",
+			"principalId":      nameQualifier + ":" + nameId.Text(),
+			"userName":         nameId.Text(),
+			"identityProvider": nameQualifier,
+		},
+		"eventTime":       now.Format(time.RFC3339),
+		"eventSource":     "sts.amazonaws.com",
+		"eventName":       "AssumeRoleWithSAML",
+		"awsRegion":       s.Region,
+		"sourceIPAddress": "192.0.2.1",
+		"userAgent":       "samltest",
+		"requestParameters": map[string]any{
+			"sAMLAssertionID": assertion.SelectAttrValue("ID", ""),
+			"roleSessionName": sessionName,
+			"principalArn":    input.PrincipalArn,
+			"roleArn":         input.RoleArn,
+			"durationSeconds": 3600,
+		},
+		"responseElements": map[string]any{
+			"credentials": map[string]any{
+				"accessKeyId":  accessKeyId,
+				"sessionToken": randomString(32),
+				"expiration":   now.Add(time.Hour).Format("Jan 2, 2006, 3:04:05 PM"),
+			},
+			"assumedRoleUser": map[string]any{
+				"assumedRoleId": input.RoleId + ":" + sessionName,
+				"arn":           strings.Replace(strings.Replace(input.RoleArn, ":iam:", ":sts:", 1), ":role/", ":assumed-role/", 1) + "/" + sessionName,
+			},
+			"subject":       nameId.Text(),
+			"subjectType":   subjectType,
+			"issuer":        issuer,
+			"audience":      audience,
+			"nameQualifier": nameQualifier,
+		},
+		"requestID":          randomString(16),
+		"eventID":            randomString(16),
+		"readOnly":           true,
+		"eventType":          "AwsApiCall",
+		"managementEvent":    true,
+		"recipientAccountId": s.AccountId,
+		"eventCategory":      "Management",
+	}
+
+	return json.Marshal(event)
+}
+
+func randomString(n int) string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	for i := range b {
+		b[i] = letters[int(b[i])%len(letters)]
+	}
+	return string(b)
+}
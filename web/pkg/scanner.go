@@ -2,22 +2,25 @@ package pkg
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3control"
 	s3controlTypes "github.com/aws/aws-sdk-go-v2/service/s3control/types"
 	"github.com/aws/smithy-go"
-	"golang.org/x/sync/syncmap"
 )
 
 type NewScannerInput struct {
 	Config      aws.Config
 	Concurrency int
 	Bucket      string
-	Name        string
 	AccountId   string
+
+	// Name prefixes the access points, "assume-role-id" when empty.
+	Name string
+
+	// Region is where access points are created, Config's region or us-east-1 when empty.
+	Region string
 }
 
 func NewScanner(input *NewScannerInput) (*Scanner, error) {
@@ -27,35 +30,39 @@ func NewScanner(input *NewScannerInput) (*Scanner, error) {
 		Region:          "us-east-1",
 		AccessPointName: "assume-role-id",
 		BucketName:      input.Bucket,
-		cache:           syncmap.Map{},
 	}
 	if input.Config.Region != "" {
 		scanner.Region = input.Config.Region
 	}
+	if input.Region != "" {
+		scanner.Region = input.Region
+	}
+	if input.Name != "" {
+		scanner.AccessPointName = input.Name
+	}
 
 	return scanner, nil
 }
 
+// Scanner is a PrincipalResolver using S3 access point policies.
 type Scanner struct {
 	s3control       *s3control.Client
 	AccountId       string
 	Region          string
 	BucketName      string
 	AccessPointName string
-	cache           syncmap.Map
 }
 
-func (s *Scanner) LookupPrincipalId(ctx *Context, principalId string) (string, error) {
-	if cached, ok := s.cache.Load(principalId); ok {
-		ctx.Debug.Printf("cache hit: %s", principalId)
-		return cached.(string), nil
-	}
-	ctx.Debug.Printf("cache miss: %s", principalId)
+// MaxPrincipalIdsPerPolicy is how many principal IDs are packed into one access point policy, this keeps the policy
+// well under the 20KB limit.
+const MaxPrincipalIdsPerPolicy = 50
 
+// LookupPrincipalIds creates an access point and resolves the IDs using its policy, MaxPrincipalIdsPerPolicy at a time.
+func (s *Scanner) LookupPrincipalIds(ctx *Context, principalIds []string) (map[string]ResolvedPrincipal, error) {
 	name := s.AccessPointName + "-" + RandStringRunes(8)
 	accesspointArn, err := SetupAccessPoint(ctx, s.s3control, name, s.AccountId, s.BucketName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	defer func() {
@@ -64,49 +71,59 @@ func (s *Scanner) LookupPrincipalId(ctx *Context, principalId string) (string, e
 		}
 	}()
 
-	policy, err := json.Marshal(PolicyDocument{
-		Version: "2012-10-17",
-		Statement: []PolicyStatement{
-			{
-				Sid:      "testrole",
-				Effect:   "Deny",
-				Action:   "*",
-				Resource: accesspointArn,
-				Principal: &PolicyPrincipal{
-					AWS: principalId,
-				},
-			},
+	return resolveWithPolicy(ctx, &accessPointTarget{
+		scanner: s,
+		name:    name,
+		arn:     accesspointArn,
+	}, principalIds, MaxPrincipalIdsPerPolicy)
+}
+
+type accessPointTarget struct {
+	scanner *Scanner
+	name    string
+	arn     string
+}
+
+func (t *accessPointTarget) statement(sid, principalId string) PolicyStatement {
+	return PolicyStatement{
+		Sid:      sid,
+		Effect:   "Deny",
+		Action:   "*",
+		Resource: t.arn,
+		Principal: &PolicyPrincipal{
+			AWS: principalId,
 		},
-	})
-	if err != nil {
-		return "", fmt.Errorf("marshalling policy: %w", err)
 	}
+}
 
-	if _, err = s.s3control.PutAccessPointPolicy(ctx, &s3control.PutAccessPointPolicyInput{
-		AccountId: &s.AccountId,
-		Name:      &name,
-		Policy:    aws.String(string(policy)),
-	}); err != nil {
-		return "", fmt.Errorf("updating policy: %w", err)
-	}
+func (t *accessPointTarget) putPolicy(ctx *Context, policy string) error {
+	_, err := t.scanner.s3control.PutAccessPointPolicy(ctx, &s3control.PutAccessPointPolicyInput{
+		AccountId: &t.scanner.AccountId,
+		Name:      &t.name,
+		Policy:    aws.String(policy),
+	})
+	return err
+}
 
-	resp, err := s.s3control.GetAccessPointPolicy(ctx, &s3control.GetAccessPointPolicyInput{
-		AccountId: &s.AccountId,
-		Name:      &name,
+func (t *accessPointTarget) getPolicy(ctx *Context) (string, error) {
+	resp, err := t.scanner.s3control.GetAccessPointPolicy(ctx, &s3control.GetAccessPointPolicyInput{
+		AccountId: &t.scanner.AccountId,
+		Name:      &t.name,
 	})
 	if err != nil {
-		return "", fmt.Errorf("updating policy: %w", err)
-	}
-	ctx.Debug.Printf("updated policy: %s", *resp.Policy)
-
-	updatedPolicy := &PolicyDocument{}
-	if err := json.Unmarshal([]byte(*resp.Policy), updatedPolicy); err != nil {
-		return "", fmt.Errorf("unmarshalling policy: %w", err)
+		return "", err
 	}
+	return *resp.Policy, nil
+}
 
-	s.cache.Store(principalId, updatedPolicy.Statement[0].Principal.AWS)
+func (t *accessPointTarget) isInvalidPrincipal(err error) bool {
+	return IsMalformedPolicy(err)
+}
 
-	return updatedPolicy.Statement[0].Principal.AWS, nil
+// IsMalformedPolicy reports whether err is S3 rejecting a policy, for example because of an invalid principal.
+func IsMalformedPolicy(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "MalformedPolicy"
 }
 
 func SetupAccessPoint(ctx context.Context, api *s3control.Client, name, account, bucket string) (string, error) {
@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsMalformedPolicy(t *testing.T) {
+	if !IsMalformedPolicy(fmt.Errorf("putting policy: %w", &smithy.GenericAPIError{Code: "MalformedPolicy"})) {
+		t.Errorf("IsMalformedPolicy() = false, want true")
+	}
+	if IsMalformedPolicy(&smithy.GenericAPIError{Code: "AccessDenied"}) || IsMalformedPolicy(nil) {
+		t.Errorf("IsMalformedPolicy() = true, want false")
+	}
+}
+
+func TestPrincipalEntryUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want PrincipalStatus
+	}{
+		{name: "Stored ARN", json: `"arn:aws:iam::123456789012:user/one"`, want: PrincipalStatusResolved},
+		{name: "Stored raw ID", json: `"AIDAEXAMPLE1"`, want: PrincipalStatusDeleted},
+		{name: "Entry", json: `{"principal_id":"AIDAEXAMPLE1","status":"invalid"}`, want: PrincipalStatusInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &PrincipalEntry{}
+			if err := json.Unmarshal([]byte(tt.json), entry); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if entry.Status != tt.want {
+				t.Errorf("Status got = %v, want %v", entry.Status, tt.want)
+			}
+			if !entry.Expired() {
+				t.Errorf("Expired() got = false, want true")
+			}
+		})
+	}
+}
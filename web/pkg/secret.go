@@ -3,53 +3,140 @@ package pkg
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"slices"
+	"strings"
+	"time"
 )
 
-func GetOrGenerateSecret(ctx *Context, client *ssm.Client, secretName string) ([]byte, error) {
-	ctx.Debug.Printf("fetching secret %s", secretName)
-	resp, err := client.GetParameter(ctx, &ssm.GetParameterInput{
-		Name:           aws.String(secretName),
+// KeyringPath returns the SSM path the keyring for secretName is stored under, each key is a parameter named after its
+// ID holding the JSON encoded Key.
+func KeyringPath(secretName string) string {
+	return "/" + strings.Trim(secretName, "/") + "/keys"
+}
+
+// GetOrGenerateKeyring loads the keyring stored under secretName, creating its first key if it's empty.
+//
+// The secret stored at secretName itself before the keyring existed is included as the LegacyKeyId key, until it's
+// retired by RotateKeyring.
+func GetOrGenerateKeyring(ctx *Context, client *ssm.Client, secretName string) (*Keyring, error) {
+	keyring, err := GetKeyring(ctx, client, secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keyring.Keys()) == 0 {
+		ctx.Info.Printf("creating the first key for %s", secretName)
+		// Another instance may have beaten us to it. There aren't any keys to retire, so the token lifetime is unused.
+		var existsErr *types.ParameterAlreadyExists
+		if _, err := RotateKeyring(ctx, client, secretName, 0); err != nil && !errors.As(err, &existsErr) {
+			return nil, fmt.Errorf("creating first key: %w", err)
+		}
+		return GetKeyring(ctx, client, secretName)
+	}
+
+	return keyring, nil
+}
+
+// GetKeyring loads the keyring stored under secretName, see GetOrGenerateKeyring.
+func GetKeyring(ctx *Context, client *ssm.Client, secretName string) (*Keyring, error) {
+	path := KeyringPath(secretName)
+	ctx.Debug.Printf("fetching keyring %s", path)
+
+	var keys []*Key
+	paginator := ssm.NewGetParametersByPathPaginator(client, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
 		WithDecryption: aws.Bool(true),
 	})
-	if err != nil {
-		var notFoundErr *types.ParameterNotFound
-		if ok := errors.As(err, &notFoundErr); ok {
-			ctx.Info.Printf("creating new secret %s", secretName)
-			return CreateSecret(ctx, client, secretName)
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("getting keys: %w", err)
+		}
+
+		for _, param := range resp.Parameters {
+			key := &Key{Id: strings.TrimPrefix(*param.Name, path+"/")}
+			if err := json.Unmarshal([]byte(*param.Value), key); err != nil {
+				return nil, fmt.Errorf("unmarshalling key %s: %w", *param.Name, err)
+			}
+			keys = append(keys, key)
 		}
-		return nil, fmt.Errorf("failed to get parameter: %w", err)
 	}
 
-	secret, err := base64.StdEncoding.DecodeString(*resp.Parameter.Value)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode Secret: %w", err)
+	// Once the legacy secret has been rotated its retirement date is kept with the other keys.
+	if !slices.ContainsFunc(keys, func(key *Key) bool { return key.Id == LegacyKeyId }) {
+		resp, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(secretName),
+			WithDecryption: aws.Bool(true),
+		})
+		var notFoundErr *types.ParameterNotFound
+		if errors.As(err, &notFoundErr) {
+			ctx.Debug.Printf("no legacy secret at %s", secretName)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get parameter: %w", err)
+		} else if secret, err := base64.StdEncoding.DecodeString(*resp.Parameter.Value); err != nil {
+			return nil, fmt.Errorf("failed to decode Secret: %w", err)
+		} else {
+			keys = append(keys, &Key{Id: LegacyKeyId, Secret: secret})
+		}
 	}
 
-	return secret, nil
+	return NewKeyring(keys...)
 }
 
-func CreateSecret(ctx *Context, client *ssm.Client, arn string) ([]byte, error) {
-	secret, err := GenerateSecret(32)
+// RotateKeyring adds a key to the keyring stored under secretName and deletes retired keys, see Keyring.Rotate.
+func RotateKeyring(ctx *Context, client *ssm.Client, secretName string, tokenLifetime time.Duration) (*Keyring, error) {
+	keyring, err := GetKeyring(ctx, client, secretName)
 	if err != nil {
-		return nil, fmt.Errorf("generating random string: %w", err)
+		return nil, err
 	}
 
-	_, err = client.PutParameter(ctx, &ssm.PutParameterInput{
-		Name:      aws.String(arn),
-		Value:     aws.String(base64.StdEncoding.EncodeToString(secret)),
-		Type:      types.ParameterTypeSecureString,
-		Overwrite: aws.Bool(false),
-	})
+	added, updated, removed, err := keyring.Rotate(time.Now().UTC(), tokenLifetime)
 	if err != nil {
-		return nil, fmt.Errorf("failed to put parameter: %w", err)
+		return nil, err
 	}
 
-	return secret, nil
+	path := KeyringPath(secretName)
+	for _, key := range append([]*Key{added}, updated...) {
+		ctx.Info.Printf("storing key %s, active at %s, retiring at %s", key.Id, key.ActiveAt, key.RetireAt)
+
+		value, err := json.Marshal(key)
+		if err != nil {
+			return nil, fmt.Errorf("marshalling key %s: %w", key.Id, err)
+		}
+		if _, err := client.PutParameter(ctx, &ssm.PutParameterInput{
+			Name:  aws.String(path + "/" + key.Id),
+			Value: aws.String(string(value)),
+			Type:  types.ParameterTypeSecureString,
+			// Only keys being retired are overwritten.
+			Overwrite: aws.Bool(key != added),
+		}); err != nil {
+			return nil, fmt.Errorf("failed to put parameter: %w", err)
+		}
+	}
+
+	for _, key := range removed {
+		ctx.Info.Printf("deleting retired key %s", key.Id)
+
+		names := []string{path + "/" + key.Id}
+		if key.Id == LegacyKeyId {
+			names = append(names, secretName)
+		}
+		for _, name := range names {
+			_, err := client.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(name)})
+			var notFoundErr *types.ParameterNotFound
+			if err != nil && !errors.As(err, &notFoundErr) {
+				return nil, fmt.Errorf("failed to delete parameter %s: %w", name, err)
+			}
+		}
+	}
+
+	return keyring, nil
 }
 
 // GenerateSecret generates a secure random string of length i
@@ -0,0 +1,154 @@
+package pkg
+
+import "strings"
+
+// SourceIdentityType is the CloudTrail userIdentity type of the caller.
+type SourceIdentityType string
+
+const (
+	SourceIdentityIAMUser         SourceIdentityType = "IAMUser"
+	SourceIdentityAssumedRole     SourceIdentityType = "AssumedRole"
+	SourceIdentityRoot            SourceIdentityType = "Root"
+	SourceIdentityFederatedUser   SourceIdentityType = "FederatedUser"
+	SourceIdentityWebIdentityUser SourceIdentityType = "WebIdentityUser"
+	SourceIdentitySAMLUser        SourceIdentityType = "SAMLUser"
+	SourceIdentityAWSService      SourceIdentityType = "AWSService"
+
+	// SourceIdentityAWSAccount is used for callers in another account, CloudTrail only gives us their principal ID.
+	SourceIdentityAWSAccount SourceIdentityType = "AWSAccount"
+)
+
+// PrincipalResolution values for callers that aren't looked up with a PrincipalResolver.
+const (
+	// PrincipalResolutionEvent is used when the ARN came from the event itself.
+	PrincipalResolutionEvent PrincipalResolution = "event"
+
+	// PrincipalResolutionNone is used for callers without an IAM principal, like services and web identity users.
+	PrincipalResolutionNone PrincipalResolution = "none"
+)
+
+// SourceIdentity is the caller of an AssumeRole event.
+type SourceIdentity struct {
+	Type      SourceIdentityType `json:"type"`
+	AccountId string             `json:"account_id,omitempty"`
+
+	// PrincipalId is the unique ID of the IAM principal without the session name, or the raw principal ID for web
+	// identity and SAML users. For FederatedUser callers it's the IAM user that called GetFederationToken.
+	PrincipalId  string `json:"principal_id,omitempty"`
+	PrincipalArn string `json:"principal_arn,omitempty"`
+
+	// FederatedUserArn is the caller's own sts federated-user ARN for FederatedUser callers.
+	FederatedUserArn string `json:"federated_user_arn,omitempty"`
+
+	// PrincipalIdType is the kind of principal going by the prefix of PrincipalId, see DecodeUniqueId.
+	PrincipalIdType UniqueIdType `json:"principal_id_type,omitempty"`
+
+	// AccessKeyId is the caller's access key, AccountId is decoded from it when CloudTrail doesn't include one.
+	AccessKeyId string `json:"access_key_id,omitempty"`
+
+	// SessionName is the role session name for AssumedRole callers and the federated user name for FederatedUser ones.
+	SessionName string `json:"session_name,omitempty"`
+
+	// InvokedBy is the service that made the call on the caller's behalf.
+	InvokedBy string `json:"invoked_by,omitempty"`
+
+	// IdentityProvider and UserName are set for WebIdentityUser and SAMLUser callers.
+	IdentityProvider string `json:"identity_provider,omitempty"`
+	UserName         string `json:"user_name,omitempty"`
+}
+
+// NewSourceIdentity classifies the caller of an event.
+func NewSourceIdentity(identity UserIdentity) SourceIdentity {
+	source := SourceIdentity{
+		Type:        SourceIdentityType(identity.Type),
+		AccountId:   identity.AccountId,
+		AccessKeyId: identity.AccessKeyId,
+		InvokedBy:   identity.InvokedBy,
+	}
+
+	switch source.Type {
+	case SourceIdentityAWSService:
+		// Services don't have a principal, the service name is in invokedBy.
+	case SourceIdentityWebIdentityUser, SourceIdentitySAMLUser:
+		source.PrincipalId = identity.PrincipalId
+		source.IdentityProvider = identity.IdentityProvider
+		source.UserName = identity.UserName
+	case SourceIdentityRoot:
+		source.PrincipalId = identity.PrincipalId
+		source.PrincipalArn = identity.Arn
+	case SourceIdentityAssumedRole:
+		source.PrincipalId, source.SessionName, _ = strings.Cut(identity.PrincipalId, ":")
+		source.PrincipalArn = identity.SessionContext.SessionIssuer.Arn
+	case SourceIdentityFederatedUser:
+		// The principal ID is the account ID followed by the federated user name, the IAM user that called
+		// GetFederationToken is the session issuer.
+		_, source.SessionName, _ = strings.Cut(identity.PrincipalId, ":")
+		source.PrincipalId = identity.SessionContext.SessionIssuer.PrincipalId
+		source.PrincipalArn = identity.SessionContext.SessionIssuer.Arn
+		source.FederatedUserArn = identity.Arn
+	default:
+		// IAMUser, AWSAccount and anything we don't know about, the session name is only there for assumed roles.
+		source.PrincipalId, source.SessionName, _ = strings.Cut(identity.PrincipalId, ":")
+		if source.Type == SourceIdentityIAMUser {
+			source.PrincipalArn = identity.Arn
+		}
+	}
+
+	// The root user's principal ID is its account ID, cross-account events show it as AWSAccount. Federated users have
+	// their issuer's ID instead, which is only an account ID when root called GetFederationToken.
+	if source.IsIAMPrincipal() && source.Type != SourceIdentityFederatedUser && accountIdPattern.MatchString(source.PrincipalId) {
+		if source.Type == SourceIdentityAWSAccount {
+			source.Type = SourceIdentityRoot
+		}
+		source.AccountId = source.PrincipalId
+		source.PrincipalArn = "arn:aws:iam::" + source.PrincipalId + ":root"
+	} else if source.IsIAMPrincipal() {
+		if id, err := DecodeUniqueId(source.PrincipalId); err == nil {
+			source.PrincipalIdType = id.Type
+		}
+	}
+
+	if source.AccountId == "" {
+		source.AccountId = AccessKeyAccountId(source.AccessKeyId)
+	}
+
+	return source
+}
+
+// ResolvablePrincipalId returns the ID to look up with a PrincipalResolver, or an empty string when the ARN is already
+// known or the caller isn't an IAM user or role.
+func (s SourceIdentity) ResolvablePrincipalId() string {
+	if !s.IsIAMPrincipal() || s.PrincipalArn != "" {
+		return ""
+	} else if !strings.HasPrefix(s.PrincipalId, "AIDA") && !strings.HasPrefix(s.PrincipalId, "AROA") {
+		return ""
+	}
+
+	return s.PrincipalId
+}
+
+// IsIAMPrincipal reports whether the caller is an IAM principal, rather than a service or an identity from an
+// external provider.
+func (s SourceIdentity) IsIAMPrincipal() bool {
+	switch s.Type {
+	case SourceIdentityAWSService, SourceIdentityWebIdentityUser, SourceIdentitySAMLUser:
+		return false
+	default:
+		return true
+	}
+}
+
+// Resolve fills in PrincipalArn from principals, which should contain ResolvablePrincipalId when there is one, and
+// returns where the ARN came from.
+func (s *SourceIdentity) Resolve(principals map[string]ResolvedPrincipal) ResolvedPrincipal {
+	if principalId := s.ResolvablePrincipalId(); principalId != "" {
+		principal := principals[principalId]
+		s.PrincipalArn = principal.Arn
+		return principal
+	}
+
+	if s.PrincipalArn != "" {
+		return ResolvedPrincipal{Arn: s.PrincipalArn, Resolution: PrincipalResolutionEvent}
+	}
+	return ResolvedPrincipal{Resolution: PrincipalResolutionNone}
+}
@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the requested item doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Store persists what we know about generated roles so it outlives both the role and CloudTrail's lookup window.
+type Store interface {
+	PutRole(ctx *Context, role *RoleRecord) error
+	GetRole(ctx *Context, roleId string) (*RoleRecord, error)
+	ListRoles(ctx *Context) ([]RoleRecord, error)
+
+	// UpdateRole calls update with the stored role and stores the result, without losing an update made concurrently.
+	// ErrNotFound is returned when there's no stored role.
+	UpdateRole(ctx *Context, roleId string, update func(role *RoleRecord) error) error
+
+	// PutEvents adds or replaces the events for the role, keyed by their EventId.
+	PutEvents(ctx *Context, roleId string, events []AssumeRoleEvent) error
+	GetEvents(ctx *Context, roleId string) ([]AssumeRoleEvent, error)
+
+	// PutAttempts adds or replaces the failed AssumeRole calls for the role, keyed by their EventId.
+	PutAttempts(ctx *Context, roleId string, attempts []AssumeRoleAttempt) error
+	GetAttempts(ctx *Context, roleId string) ([]AssumeRoleAttempt, error)
+
+	// PutDelivery adds or replaces the webhook delivery for the role, keyed by its EventId.
+	PutDelivery(ctx *Context, roleId string, delivery WebhookDelivery) error
+	GetDeliveries(ctx *Context, roleId string) ([]WebhookDelivery, error)
+
+	PutPrincipal(ctx *Context, entry *PrincipalEntry) error
+	GetPrincipal(ctx *Context, principalId string) (*PrincipalEntry, error)
+
+	Close() error
+}
+
+// RoleRecord is the stored copy of a generated role.
+type RoleRecord struct {
+	RoleId     string    `json:"role_id"`
+	RoleName   string    `json:"role_name"`
+	RoleArn    string    `json:"role_arn"`
+	CreateDate time.Time `json:"create_date"`
+
+	// Expires is when the role should be deleted, see Expiry.
+	Expires time.Time `json:"expires"`
+
+	Webhook *Webhook `json:"webhook,omitempty"`
+
+	// TokensRevokedAt is set when the owner deleted the role, see Revokes.
+	TokensRevokedAt time.Time `json:"tokens_revoked_at"`
+}
+
+// Revokes returns whether token was revoked when the role was deleted by its owner. Every owner token is, only viewer
+// tokens issued afterward are still accepted.
+func (r *RoleRecord) Revokes(token *RoleToken) bool {
+	if r.TokensRevokedAt.IsZero() {
+		return false
+	} else if token.Scope != RoleTokenScopeViewer {
+		return true
+	}
+	return token.IssuedAt.Before(r.TokensRevokedAt)
+}
+
+// MergeEvents combines stored and freshly polled events, preferring the fresh copy, oldest first.
+func MergeEvents(stored, fresh []AssumeRoleEvent) []AssumeRoleEvent {
+	return mergeById(stored, fresh, func(event AssumeRoleEvent) (string, time.Time) {
+		return event.EventId, event.Time
+	})
+}
+
+// MergeAttempts combines stored and freshly polled attempts, preferring the fresh copy, oldest first.
+func MergeAttempts(stored, fresh []AssumeRoleAttempt) []AssumeRoleAttempt {
+	return mergeById(stored, fresh, func(attempt AssumeRoleAttempt) (string, time.Time) {
+		return attempt.EventId, attempt.Time
+	})
+}
+
+func mergeById[T any](stored, fresh []T, key func(T) (string, time.Time)) []T {
+	byId := map[string]T{}
+	for _, v := range stored {
+		id, _ := key(v)
+		byId[id] = v
+	}
+	for _, v := range fresh {
+		id, _ := key(v)
+		byId[id] = v
+	}
+
+	results := make([]T, 0, len(byId))
+	for _, v := range byId {
+		results = append(results, v)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		_, a := key(results[i])
+		_, b := key(results[j])
+		return a.Before(b)
+	})
+
+	return results
+}
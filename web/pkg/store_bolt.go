@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	boltRolesBucket      = []byte("roles")
+	boltEventsBucket     = []byte("events")
+	boltAttemptsBucket   = []byte("attempts")
+	boltPrincipalsBucket = []byte("principals")
+	boltDeliveriesBucket = []byte("deliveries")
+)
+
+// NewBoltStore opens, or creates, a Store in a local bbolt database, this is used when running outside of lambda.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltRolesBucket, boltEventsBucket, boltAttemptsBucket, boltPrincipalsBucket, boltDeliveriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("creating bucket %s: %w", name, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// BoltStore keys events and attempts by "<role id>/<event id>" so a role's events can be read with a prefix scan.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func (s *BoltStore) PutRole(ctx *Context, role *RoleRecord) error {
+	return s.put(boltRolesBucket, role.RoleId, role)
+}
+
+func (s *BoltStore) GetRole(ctx *Context, roleId string) (*RoleRecord, error) {
+	role := &RoleRecord{}
+	if err := s.get(boltRolesBucket, roleId, role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (s *BoltStore) UpdateRole(ctx *Context, roleId string, update func(role *RoleRecord) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRolesBucket)
+		data := bucket.Get([]byte(roleId))
+		if data == nil {
+			return fmt.Errorf("%w: %s/%s", ErrNotFound, boltRolesBucket, roleId)
+		}
+
+		role := &RoleRecord{}
+		if err := json.Unmarshal(data, role); err != nil {
+			return fmt.Errorf("unmarshalling %s: %w", roleId, err)
+		} else if err := update(role); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(role)
+		if err != nil {
+			return fmt.Errorf("marshalling %s: %w", roleId, err)
+		}
+		return bucket.Put([]byte(roleId), data)
+	})
+}
+
+func (s *BoltStore) ListRoles(ctx *Context) ([]RoleRecord, error) {
+	var roles []RoleRecord
+	err := s.scan(boltRolesBucket, "", func(k, v []byte) error {
+		role := RoleRecord{}
+		if err := json.Unmarshal(v, &role); err != nil {
+			return fmt.Errorf("unmarshalling %s: %w", k, err)
+		}
+		roles = append(roles, role)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+func (s *BoltStore) PutEvents(ctx *Context, roleId string, events []AssumeRoleEvent) error {
+	for _, event := range events {
+		if err := s.put(boltEventsBucket, roleId+"/"+event.EventId, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) GetEvents(ctx *Context, roleId string) ([]AssumeRoleEvent, error) {
+	var events []AssumeRoleEvent
+	err := s.scan(boltEventsBucket, roleId+"/", func(k, v []byte) error {
+		event := AssumeRoleEvent{}
+		if err := json.Unmarshal(v, &event); err != nil {
+			return fmt.Errorf("unmarshalling %s: %w", k, err)
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s *BoltStore) PutAttempts(ctx *Context, roleId string, attempts []AssumeRoleAttempt) error {
+	for _, attempt := range attempts {
+		if err := s.put(boltAttemptsBucket, roleId+"/"+attempt.EventId, attempt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) GetAttempts(ctx *Context, roleId string) ([]AssumeRoleAttempt, error) {
+	var attempts []AssumeRoleAttempt
+	err := s.scan(boltAttemptsBucket, roleId+"/", func(k, v []byte) error {
+		attempt := AssumeRoleAttempt{}
+		if err := json.Unmarshal(v, &attempt); err != nil {
+			return fmt.Errorf("unmarshalling %s: %w", k, err)
+		}
+		attempts = append(attempts, attempt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+func (s *BoltStore) PutDelivery(ctx *Context, roleId string, delivery WebhookDelivery) error {
+	return s.put(boltDeliveriesBucket, roleId+"/"+delivery.EventId, delivery)
+}
+
+func (s *BoltStore) GetDeliveries(ctx *Context, roleId string) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := s.scan(boltDeliveriesBucket, roleId+"/", func(k, v []byte) error {
+		delivery := WebhookDelivery{}
+		if err := json.Unmarshal(v, &delivery); err != nil {
+			return fmt.Errorf("unmarshalling %s: %w", k, err)
+		}
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *BoltStore) PutPrincipal(ctx *Context, entry *PrincipalEntry) error {
+	return s.put(boltPrincipalsBucket, entry.PrincipalId, entry)
+}
+
+func (s *BoltStore) GetPrincipal(ctx *Context, principalId string) (*PrincipalEntry, error) {
+	entry := &PrincipalEntry{}
+	if err := s.get(boltPrincipalsBucket, principalId, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) put(bucket []byte, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshalling %s: %w", key, err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// scan calls fn with each key and value in bucket starting with prefix.
+func (s *BoltStore) scan(bucket []byte, prefix string, fn func(k, v []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) get(bucket []byte, key string, v any) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return fmt.Errorf("%w: %s/%s", ErrNotFound, bucket, key)
+		}
+
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("unmarshalling %s: %w", key, err)
+		}
+		return nil
+	})
+}
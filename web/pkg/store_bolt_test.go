@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	ctx := NewContext(context.Background())
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore() error = %v", err)
+	}
+	defer store.Close()
+
+	role := &RoleRecord{
+		RoleId:     "AROAEXAMPLE",
+		RoleName:   "example",
+		RoleArn:    "arn:aws:iam::123456789012:role/example",
+		CreateDate: time.Now().UTC().Truncate(time.Second),
+	}
+	if err := store.PutRole(ctx, role); err != nil {
+		t.Fatalf("PutRole() error = %v", err)
+	}
+	if got, err := store.GetRole(ctx, role.RoleId); err != nil {
+		t.Errorf("GetRole() error = %v", err)
+	} else if *got != *role {
+		t.Errorf("GetRole() got = %v, want %v", got, role)
+	}
+	if _, err := store.GetRole(ctx, "AROAMISSING"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetRole() missing role error = %v, want ErrNotFound", err)
+	}
+
+	revokedAt := time.Now().UTC().Truncate(time.Second)
+	if err := store.UpdateRole(ctx, role.RoleId, func(r *RoleRecord) error {
+		r.TokensRevokedAt = revokedAt
+		return nil
+	}); err != nil {
+		t.Errorf("UpdateRole() error = %v", err)
+	}
+	if got, err := store.GetRole(ctx, role.RoleId); err != nil || !got.TokensRevokedAt.Equal(revokedAt) || got.RoleName != role.RoleName {
+		t.Errorf("GetRole() after update got = %v, %v", got, err)
+	}
+	if err := store.UpdateRole(ctx, "AROAMISSING", func(r *RoleRecord) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateRole() missing role error = %v, want ErrNotFound", err)
+	}
+
+	events := []AssumeRoleEvent{{EventId: "1"}, {EventId: "2"}}
+	if err := store.PutEvents(ctx, role.RoleId, events); err != nil {
+		t.Fatalf("PutEvents() error = %v", err)
+	}
+	if err := store.PutEvents(ctx, "AROAEXAMPLE2", []AssumeRoleEvent{{EventId: "3"}}); err != nil {
+		t.Fatalf("PutEvents() error = %v", err)
+	}
+	if got, err := store.GetEvents(ctx, role.RoleId); err != nil {
+		t.Errorf("GetEvents() error = %v", err)
+	} else if len(got) != 2 {
+		t.Errorf("GetEvents() got %d events, want 2", len(got))
+	}
+
+	principal := &PrincipalEntry{
+		PrincipalId: "AIDAEXAMPLE",
+		Arn:         "arn:aws:iam::123456789012:user/example",
+		Status:      PrincipalStatusResolved,
+		Expires:     time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	if err := store.PutPrincipal(ctx, principal); err != nil {
+		t.Fatalf("PutPrincipal() error = %v", err)
+	}
+	if got, err := store.GetPrincipal(ctx, "AIDAEXAMPLE"); err != nil || *got != *principal {
+		t.Errorf("GetPrincipal() got = %v, %v", got, err)
+	}
+}
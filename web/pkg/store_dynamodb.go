@@ -0,0 +1,420 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"strconv"
+	"time"
+)
+
+// dynamoDBUpdateAttempts is how many times UpdateRole tries before giving up on concurrent updates.
+const dynamoDBUpdateAttempts = 5
+
+// DynamoDBLiveRolesIndex is the global secondary index ListRoles queries, it's keyed by the "live" string attribute,
+// which is "role" on every role item, and the "expires_at" number attribute.
+const DynamoDBLiveRolesIndex = "live-roles"
+
+// NewDynamoDBStore returns a Store backed by a DynamoDB table with a string partition key "pk" and sort key "sk", TTL
+// enabled on the "expires_at" attribute and the DynamoDBLiveRolesIndex index.
+func NewDynamoDBStore(client *dynamodb.Client, tableName string) *DynamoDBStore {
+	return &DynamoDBStore{
+		client:    client,
+		TableName: tableName,
+	}
+}
+
+// DynamoDBStore keeps everything in a single table, each item's JSON is stored in the "data" attribute. Roles also have
+// a "rev" number attribute counting their updates, see UpdateRole.
+//
+// Role items and the items under them have an "expires_at" attribute, the epoch seconds RoleTokenLifetime after the
+// role expires, once no token can read them DynamoDB's TTL deletes them.
+//
+//	role:      pk=role#<role id>       sk=role
+//	event:     pk=role#<role id>       sk=event#<event id>
+//	attempt:   pk=role#<role id>       sk=attempt#<event id>
+//	delivery:  pk=role#<role id>       sk=delivery#<event id>
+//	principal: pk=principal#<id>       sk=principal
+type DynamoDBStore struct {
+	client    *dynamodb.Client
+	TableName string
+}
+
+func (s *DynamoDBStore) PutRole(ctx *Context, role *RoleRecord) error {
+	return s.put(ctx, "role#"+role.RoleId, "role", role, roleAttributes(role))
+}
+
+func (s *DynamoDBStore) GetRole(ctx *Context, roleId string) (*RoleRecord, error) {
+	role := &RoleRecord{}
+	if err := s.get(ctx, "role#"+roleId, "role", role); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// UpdateRole only stores the role if its rev hasn't changed since it was read, otherwise it reads it again and retries.
+func (s *DynamoDBStore) UpdateRole(ctx *Context, roleId string, update func(role *RoleRecord) error) error {
+	pk := "role#" + roleId
+	key := map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: pk},
+		"sk": &types.AttributeValueMemberS{Value: "role"},
+	}
+
+	for range dynamoDBUpdateAttempts {
+		resp, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.TableName),
+			Key:            key,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("getting %s: %w", pk, err)
+		} else if resp.Item == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, pk)
+		}
+
+		role := &RoleRecord{}
+		if err := unmarshalItem(resp.Item, role); err != nil {
+			return err
+		} else if err := update(role); err != nil {
+			return err
+		}
+		data, err := json.Marshal(role)
+		if err != nil {
+			return fmt.Errorf("marshalling %s: %w", pk, err)
+		}
+
+		// Roles stored before rev was added, or only by PutRole, don't have one yet.
+		rev := 0
+		condition := "attribute_exists(pk) AND attribute_not_exists(rev)"
+		values := map[string]types.AttributeValue{}
+		if attr, ok := resp.Item["rev"].(*types.AttributeValueMemberN); ok {
+			if rev, err = strconv.Atoi(attr.Value); err != nil {
+				return fmt.Errorf("parsing rev of %s: %w", pk, err)
+			}
+			condition = "rev = :rev"
+			values[":rev"] = attr
+		}
+
+		item := map[string]types.AttributeValue{
+			"pk":   key["pk"],
+			"sk":   key["sk"],
+			"data": &types.AttributeValueMemberS{Value: string(data)},
+			"rev":  &types.AttributeValueMemberN{Value: strconv.Itoa(rev + 1)},
+		}
+		attributes := roleAttributes(role)
+		for name, value := range attributes {
+			item[name] = value
+		}
+		input := &dynamodb.PutItemInput{
+			TableName:           aws.String(s.TableName),
+			Item:                item,
+			ConditionExpression: aws.String(condition),
+		}
+		if len(values) > 0 {
+			input.ExpressionAttributeValues = values
+		}
+
+		_, err = s.client.PutItem(ctx, input)
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			ctx.Debug.Printf("retrying concurrent update of %s", pk)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("putting %s: %w", pk, err)
+		}
+
+		// Extending a role keeps the items under it around for as long.
+		previous, _ := resp.Item["expires_at"].(*types.AttributeValueMemberN)
+		current := attributes["expires_at"].(*types.AttributeValueMemberN)
+		if previous == nil || previous.Value != current.Value {
+			return s.extendChildren(ctx, pk, current)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("updating %s: gave up after %d concurrent updates", pk, dynamoDBUpdateAttempts)
+}
+
+// ListRoles queries DynamoDBLiveRolesIndex for the roles that haven't reached their expires_at, TTL deletion can lag
+// by a day or two so those that have are skipped. Roles stored before expires_at was added aren't listed until they're
+// next updated.
+func (s *DynamoDBStore) ListRoles(ctx *Context) ([]RoleRecord, error) {
+	var roles []RoleRecord
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.TableName),
+		IndexName:              aws.String(DynamoDBLiveRolesIndex),
+		KeyConditionExpression: aws.String("live = :live AND expires_at > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":live": &types.AttributeValueMemberS{Value: "role"},
+			":now":  expiresAtAttribute(time.Now()),
+		},
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("querying roles: %w", err)
+		}
+
+		for _, item := range resp.Items {
+			role := RoleRecord{}
+			if err := unmarshalItem(item, &role); err != nil {
+				return nil, err
+			}
+			roles = append(roles, role)
+		}
+	}
+
+	return roles, nil
+}
+
+func (s *DynamoDBStore) PutEvents(ctx *Context, roleId string, events []AssumeRoleEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	attributes, err := s.childAttributes(ctx, roleId)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := s.put(ctx, "role#"+roleId, "event#"+event.EventId, event, attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DynamoDBStore) GetEvents(ctx *Context, roleId string) ([]AssumeRoleEvent, error) {
+	var events []AssumeRoleEvent
+	err := s.query(ctx, "role#"+roleId, "event#", func(item map[string]types.AttributeValue) error {
+		event := AssumeRoleEvent{}
+		if err := unmarshalItem(item, &event); err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (s *DynamoDBStore) PutAttempts(ctx *Context, roleId string, attempts []AssumeRoleAttempt) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+	attributes, err := s.childAttributes(ctx, roleId)
+	if err != nil {
+		return err
+	}
+
+	for _, attempt := range attempts {
+		if err := s.put(ctx, "role#"+roleId, "attempt#"+attempt.EventId, attempt, attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DynamoDBStore) GetAttempts(ctx *Context, roleId string) ([]AssumeRoleAttempt, error) {
+	var attempts []AssumeRoleAttempt
+	err := s.query(ctx, "role#"+roleId, "attempt#", func(item map[string]types.AttributeValue) error {
+		attempt := AssumeRoleAttempt{}
+		if err := unmarshalItem(item, &attempt); err != nil {
+			return err
+		}
+		attempts = append(attempts, attempt)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+func (s *DynamoDBStore) PutDelivery(ctx *Context, roleId string, delivery WebhookDelivery) error {
+	attributes, err := s.childAttributes(ctx, roleId)
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, "role#"+roleId, "delivery#"+delivery.EventId, delivery, attributes)
+}
+
+func (s *DynamoDBStore) GetDeliveries(ctx *Context, roleId string) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := s.query(ctx, "role#"+roleId, "delivery#", func(item map[string]types.AttributeValue) error {
+		delivery := WebhookDelivery{}
+		if err := unmarshalItem(item, &delivery); err != nil {
+			return err
+		}
+		deliveries = append(deliveries, delivery)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *DynamoDBStore) PutPrincipal(ctx *Context, entry *PrincipalEntry) error {
+	return s.put(ctx, "principal#"+entry.PrincipalId, "principal", entry, nil)
+}
+
+func (s *DynamoDBStore) GetPrincipal(ctx *Context, principalId string) (*PrincipalEntry, error) {
+	entry := &PrincipalEntry{}
+	if err := s.get(ctx, "principal#"+principalId, "principal", entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *DynamoDBStore) Close() error {
+	return nil
+}
+
+// put stores v as the data of the item, along with any other attributes.
+func (s *DynamoDBStore) put(ctx *Context, pk, sk string, v any, attributes map[string]types.AttributeValue) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshalling %s: %w", pk, err)
+	}
+
+	item := map[string]types.AttributeValue{
+		"pk":   &types.AttributeValueMemberS{Value: pk},
+		"sk":   &types.AttributeValueMemberS{Value: sk},
+		"data": &types.AttributeValueMemberS{Value: string(data)},
+	}
+	for name, value := range attributes {
+		item[name] = value
+	}
+
+	if _, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.TableName),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("putting %s: %w", pk, err)
+	}
+
+	return nil
+}
+
+// childAttributes returns the expires_at of the stored role for the items under it. When the role isn't stored, or was
+// stored before expires_at was added, they expire RoleTokenLifetime from now.
+func (s *DynamoDBStore) childAttributes(ctx *Context, roleId string) (map[string]types.AttributeValue, error) {
+	pk := "role#" + roleId
+	resp, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: pk},
+			"sk": &types.AttributeValueMemberS{Value: "role"},
+		},
+		ProjectionExpression: aws.String("expires_at"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting expiry of %s: %w", pk, err)
+	}
+
+	expiresAt, ok := resp.Item["expires_at"]
+	if !ok {
+		expiresAt = expiresAtAttribute(time.Now().Add(RoleTokenLifetime))
+	}
+	return map[string]types.AttributeValue{"expires_at": expiresAt}, nil
+}
+
+// extendChildren sets the expires_at of each item under the role to expiresAt.
+func (s *DynamoDBStore) extendChildren(ctx *Context, pk string, expiresAt types.AttributeValue) error {
+	return s.query(ctx, pk, "", func(item map[string]types.AttributeValue) error {
+		if sk, ok := item["sk"].(*types.AttributeValueMemberS); !ok || sk.Value == "role" {
+			return nil
+		}
+
+		if _, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(s.TableName),
+			Key:                       map[string]types.AttributeValue{"pk": item["pk"], "sk": item["sk"]},
+			UpdateExpression:          aws.String("SET expires_at = :expires_at"),
+			ConditionExpression:       aws.String("attribute_exists(pk)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":expires_at": expiresAt},
+		}); err != nil {
+			var gone *types.ConditionalCheckFailedException
+			if !errors.As(err, &gone) {
+				return fmt.Errorf("extending %s: %w", pk, err)
+			}
+		}
+		return nil
+	})
+}
+
+// roleAttributes puts the role in DynamoDBLiveRolesIndex until RoleTokenLifetime after it expires, when its tokens no
+// longer work and it's deleted.
+func roleAttributes(role *RoleRecord) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"live":       &types.AttributeValueMemberS{Value: "role"},
+		"expires_at": expiresAtAttribute(role.Expiry().Add(RoleTokenLifetime)),
+	}
+}
+
+func expiresAtAttribute(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+func (s *DynamoDBStore) get(ctx *Context, pk, sk string, v any) error {
+	resp, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.TableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: pk},
+			"sk": &types.AttributeValueMemberS{Value: sk},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("getting %s: %w", pk, err)
+	} else if resp.Item == nil {
+		return fmt.Errorf("%w: %s", ErrNotFound, pk)
+	}
+
+	return unmarshalItem(resp.Item, v)
+}
+
+// query calls fn with each item under pk with a sort key starting with prefix.
+func (s *DynamoDBStore) query(ctx *Context, pk, prefix string, fn func(item map[string]types.AttributeValue) error) error {
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.TableName),
+		KeyConditionExpression: aws.String("pk = :pk AND begins_with(sk, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk":     &types.AttributeValueMemberS{Value: pk},
+			":prefix": &types.AttributeValueMemberS{Value: prefix},
+		},
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("querying %s: %w", pk, err)
+		}
+
+		for _, item := range resp.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func unmarshalItem(item map[string]types.AttributeValue, v any) error {
+	data, ok := item["data"].(*types.AttributeValueMemberS)
+	if !ok {
+		return fmt.Errorf("item is missing data attribute")
+	}
+
+	if err := json.Unmarshal([]byte(data.Value), v); err != nil {
+		return fmt.Errorf("unmarshalling item: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudtrail"
+	cloudtrailTypes "github.com/aws/aws-sdk-go-v2/service/cloudtrail/types"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SweepInterval is the minimum time between two sweeps of CloudTrail.
+const SweepInterval = 15 * time.Second
+
+// SweepOverlap is how far before the previous sweep each sweep starts, CloudTrail can take a while to deliver events.
+const SweepOverlap = 15 * time.Minute
+
+// SweepTimeout bounds a single sweep, it doesn't depend on the request that started it.
+const SweepTimeout = 30 * time.Second
+
+// SweepBackfillChunk is how much of the lookback before the first sweep each later sweep indexes, so starting up doesn't
+// page through all of it at once. The index is only held in memory, so this happens after every start.
+const SweepBackfillChunk = 6 * time.Hour
+
+type NewSweeperInput struct {
+	CloudTrail map[string]*cloudtrail.Client
+	Interval   time.Duration
+	Lookback   time.Duration
+}
+
+func NewSweeper(input *NewSweeperInput) *Sweeper {
+	sweeper := &Sweeper{
+		cloudtrail: input.CloudTrail,
+		Interval:   SweepInterval,
+		Lookback:   KeepRolesFor,
+		index:      map[string][]Event{},
+		attempts:   map[string][]Event{},
+		seen:       map[string]time.Time{},
+		regions:    map[string]*sweepState{},
+	}
+	if input.Interval != 0 {
+		sweeper.Interval = input.Interval
+	}
+	if input.Lookback != 0 {
+		sweeper.Lookback = input.Lookback
+	}
+
+	return sweeper
+}
+
+// Sweeper pages through the events in AssumeRoleEventNames in each region and indexes them by the ID of the assumed
+// role, or by the requested role ARN for failed calls.
+//
+// This keeps the number of LookupEvents calls constant per region no matter how many roles are being polled.
+type Sweeper struct {
+	cloudtrail map[string]*cloudtrail.Client
+	Interval   time.Duration
+	Lookback   time.Duration
+
+	// sweepMu ensures only one sweep runs at a time, callers arriving mid-sweep wait for its results.
+	sweepMu   sync.Mutex
+	lastSweep time.Time
+
+	mu    sync.Mutex
+	index map[string][]Event
+	// attempts holds failed AssumeRole calls, these don't include the role ID so are indexed by the role ARN.
+	attempts map[string][]Event
+	seen     map[string]time.Time
+	regions  map[string]*sweepState
+}
+
+type sweepState struct {
+	// since is where the next sweep of this region starts from.
+	since time.Time
+
+	// backfill is where the part of the lookback that hasn't been indexed yet ends, the events before it are swept a
+	// SweepBackfillChunk at a time.
+	backfill time.Time
+
+	// backfilled is set once the whole lookback has been indexed.
+	backfilled bool
+
+	result RegionResult
+}
+
+// Run sweeps every Interval until ctx is done.
+func (s *Sweeper) Run(ctx *Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.Refresh(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh sweeps CloudTrail unless the last sweep happened less than Interval ago.
+//
+// The sweep isn't cancelled along with ctx, callers waiting on it would otherwise all fail with the one that started
+// it, instead it's bounded by SweepTimeout.
+func (s *Sweeper) Refresh(ctx *Context) {
+	s.sweepMu.Lock()
+	defer s.sweepMu.Unlock()
+
+	if time.Since(s.lastSweep) < s.Interval {
+		return
+	}
+
+	sweepCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), SweepTimeout)
+	defer cancel()
+
+	s.sweep(ctx.WithContext(sweepCtx))
+	s.lastSweep = time.Now()
+}
+
+func (s *Sweeper) sweep(ctx *Context) {
+	now := time.Now().UTC()
+	oldest := now.Add(-s.Lookback)
+
+	wg := &sync.WaitGroup{}
+	for region, client := range s.cloudtrail {
+		wg.Add(1)
+
+		go func(region string, client *cloudtrail.Client) {
+			defer wg.Done()
+
+			s.mu.Lock()
+			state, ok := s.regions[region]
+			if !ok {
+				// The first sweep of a region starts now, the rest of the lookback is backfilled by later sweeps.
+				state = &sweepState{since: now, backfill: now.Add(-SweepOverlap)}
+				s.regions[region] = state
+			}
+			start := state.since.Add(-SweepOverlap)
+			backfill := state.backfill
+			s.mu.Unlock()
+
+			if start.Before(oldest) {
+				start = oldest
+			}
+
+			count, err := s.sweepRegion(ctx, client, start, nil)
+			if err != nil {
+				ctx.Error.Printf("sweeping %s: %v", region, err)
+			} else {
+				ctx.Debug.Printf("swept %d events in %s since %s", count, region, start)
+			}
+
+			var backfillErr error
+			if err == nil && backfill.After(oldest) {
+				chunk := backfill.Add(-SweepBackfillChunk)
+				if chunk.Before(oldest) {
+					chunk = oldest
+				}
+
+				var n int
+				n, backfillErr = s.sweepRegion(ctx, client, chunk, aws.Time(backfill))
+				count += n
+				if backfillErr != nil {
+					ctx.Error.Printf("backfilling %s: %v", region, backfillErr)
+				} else {
+					ctx.Debug.Printf("backfilled %d events in %s from %s to %s", n, region, chunk, backfill)
+					backfill = chunk
+				}
+			}
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			// Only move forward once everything since the previous start was read.
+			if err == nil {
+				state.since = now
+			}
+			state.backfill = backfill
+			state.backfilled = !backfill.After(oldest)
+			state.result = RegionResult{
+				Status: GetRegionStatus(errors.Join(err, backfillErr)),
+				Events: count,
+			}
+		}(region, client)
+	}
+	wg.Wait()
+
+	s.prune(oldest)
+}
+
+// sweepRegion indexes each of AssumeRoleEventNames since start, and before end if it's set, returning the number of
+// events found.
+func (s *Sweeper) sweepRegion(ctx *Context, client *cloudtrail.Client, start time.Time, end *time.Time) (int, error) {
+	count := 0
+
+	// LookupEvents only takes a single lookup attribute, so each event name is looked up separately.
+	for _, eventName := range AssumeRoleEventNames {
+		n, err := s.sweepEvents(ctx, client, eventName, start, end)
+		count += n
+		if err != nil {
+			return count, fmt.Errorf("sweeping %s: %w", eventName, err)
+		}
+	}
+
+	return count, nil
+}
+
+// sweepEvents indexes the events named eventName since start, and before end if it's set, returning the number of events
+// found.
+func (s *Sweeper) sweepEvents(ctx *Context, client *cloudtrail.Client, eventName string, start time.Time, end *time.Time) (int, error) {
+	count := 0
+
+	var nextToken *string
+	for {
+		resp, err := client.LookupEvents(ctx, &cloudtrail.LookupEventsInput{
+			StartTime: aws.Time(start),
+			EndTime:   end,
+			LookupAttributes: []cloudtrailTypes.LookupAttribute{
+				{
+					AttributeKey:   cloudtrailTypes.LookupAttributeKeyEventName,
+					AttributeValue: aws.String(eventName),
+				},
+			},
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return count, fmt.Errorf("looking up events: %w", err)
+		}
+
+		for _, event := range resp.Events {
+			assumeRoleEvent := &Event{}
+			if err := json.Unmarshal([]byte(*event.CloudTrailEvent), assumeRoleEvent); err != nil {
+				return count, fmt.Errorf("unmarshalling event %s: %w", *event.EventId, err)
+			}
+
+			s.add(assumeRoleEvent)
+			count++
+		}
+
+		if resp.NextToken == nil || *resp.NextToken == "" {
+			break
+		}
+
+		nextToken = resp.NextToken
+
+		ctx.Debug.Printf("looking up events with next Token %s", TryMarshal(nextToken))
+	}
+
+	return count, nil
+}
+
+// add indexes the event by the ID of the role that was assumed, or by the requested role ARN if the call failed.
+func (s *Sweeper) add(event *Event) {
+	roleId := strings.Split(event.ResponseElements.AssumedRoleUser.AssumedRoleId, ":")[0]
+	roleArn := event.RequestParameters.RoleArn
+	if event.ErrorCode == "" && roleId == "" || event.ErrorCode != "" && roleArn == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.seen[event.EventID]; ok {
+		return
+	}
+	s.seen[event.EventID] = event.EventTime
+
+	if event.ErrorCode != "" {
+		s.attempts[roleArn] = append(s.attempts[roleArn], *event)
+	} else {
+		s.index[roleId] = append(s.index[roleId], *event)
+	}
+}
+
+// prune drops events older than cutoff.
+func (s *Sweeper) prune(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.seen {
+		if t.Before(cutoff) {
+			delete(s.seen, id)
+		}
+	}
+
+	for _, index := range []map[string][]Event{s.index, s.attempts} {
+		for key, events := range index {
+			var kept []Event
+			for _, event := range events {
+				if !event.EventTime.Before(cutoff) {
+					kept = append(kept, event)
+				}
+			}
+
+			if len(kept) == 0 {
+				delete(index, key)
+			} else {
+				index[key] = kept
+			}
+		}
+	}
+}
+
+// Events returns the indexed AssumeRole events for the role ID since start, oldest first.
+func (s *Sweeper) Events(roleId string, start time.Time) []Event {
+	return s.since(s.index, roleId, start)
+}
+
+// Attempts returns the failed AssumeRole events for the role ARN since start, oldest first.
+func (s *Sweeper) Attempts(roleArn string, start time.Time) []Event {
+	return s.since(s.attempts, roleArn, start)
+}
+
+func (s *Sweeper) since(index map[string][]Event, key string, start time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []Event
+	for _, event := range index[key] {
+		if !event.EventTime.Before(start) {
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventTime.Before(events[j].EventTime)
+	})
+
+	return events
+}
+
+// Regions returns the outcome of the last sweep of each region, regions that haven't indexed the whole lookback yet
+// are RegionStatusBackfilling.
+func (s *Sweeper) Regions() map[string]RegionResult {
+	return s.RegionsSince(time.Time{})
+}
+
+// RegionsSince is Regions for events since start, regions are only RegionStatusBackfilling when the part of the
+// lookback that hasn't been indexed yet is after start.
+func (s *Sweeper) RegionsSince(start time.Time) map[string]RegionResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := map[string]RegionResult{}
+	for region, state := range s.regions {
+		result := state.result
+		if result.Status == RegionStatusOk && !state.backfilled && start.Before(state.backfill) {
+			result.Status = RegionStatusBackfilling
+		}
+		results[region] = result
+	}
+	return results
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestAssumeRoleEvent(id, assumedRoleId string, t time.Time) *Event {
+	event := &Event{EventID: id, EventTime: t}
+	event.ResponseElements.AssumedRoleUser.AssumedRoleId = assumedRoleId
+	return event
+}
+
+func TestSweeperIndex(t *testing.T) {
+	now := time.Now().UTC()
+	s := NewSweeper(&NewSweeperInput{})
+
+	s.add(newTestAssumeRoleEvent("2", "AROAEXAMPLE:session", now.Add(-time.Minute)))
+	s.add(newTestAssumeRoleEvent("1", "AROAEXAMPLE:session", now.Add(-time.Hour)))
+	s.add(newTestAssumeRoleEvent("1", "AROAEXAMPLE:session", now.Add(-time.Hour)))
+	s.add(newTestAssumeRoleEvent("3", "AROAOTHER:session", now))
+	s.add(newTestAssumeRoleEvent("4", "", now))
+
+	attempt := newTestAssumeRoleEvent("5", "", now)
+	attempt.ErrorCode = "AccessDenied"
+	attempt.RequestParameters.RoleArn = "arn:aws:iam::123456789012:role/example"
+	s.add(attempt)
+
+	events := s.Events("AROAEXAMPLE", now.Add(-2*time.Hour))
+	if len(events) != 2 {
+		t.Fatalf("Events() got %d events, want 2", len(events))
+	}
+	if events[0].EventID != "1" || events[1].EventID != "2" {
+		t.Errorf("Events() got %s, %s, want oldest first", events[0].EventID, events[1].EventID)
+	}
+
+	if events := s.Events("AROAEXAMPLE", now.Add(-30*time.Minute)); len(events) != 1 {
+		t.Errorf("Events() since 30m ago got %d events, want 1", len(events))
+	}
+
+	if attempts := s.Attempts("arn:aws:iam::123456789012:role/example", now.Add(-time.Hour)); len(attempts) != 1 {
+		t.Errorf("Attempts() got %d attempts, want 1", len(attempts))
+	}
+
+	s.prune(now.Add(-30 * time.Minute))
+	if events := s.Events("AROAEXAMPLE", time.Time{}); len(events) != 1 {
+		t.Errorf("Events() after prune got %d events, want 1", len(events))
+	}
+	if _, ok := s.seen["1"]; ok {
+		t.Errorf("prune() kept pruned event in seen")
+	}
+}
+
+func TestSweeperRegionsSince(t *testing.T) {
+	now := time.Now().UTC()
+	s := NewSweeper(&NewSweeperInput{})
+	s.regions = map[string]*sweepState{
+		"us-east-1": {backfill: now.Add(-time.Hour), result: RegionResult{Status: RegionStatusOk}},
+		"us-west-2": {backfill: now.Add(-time.Hour), backfilled: true, result: RegionResult{Status: RegionStatusOk}},
+		"eu-west-1": {backfill: now.Add(-time.Hour), result: RegionResult{Status: RegionStatusThrottled}},
+	}
+
+	tests := []struct {
+		name  string
+		start time.Time
+		want  map[string]RegionStatus
+	}{
+		{
+			name:  "Before the indexed range",
+			start: now.Add(-2 * time.Hour),
+			want:  map[string]RegionStatus{"us-east-1": RegionStatusBackfilling, "us-west-2": RegionStatusOk, "eu-west-1": RegionStatusThrottled},
+		},
+		{
+			name:  "Within the indexed range",
+			start: now.Add(-time.Minute),
+			want:  map[string]RegionStatus{"us-east-1": RegionStatusOk, "us-west-2": RegionStatusOk, "eu-west-1": RegionStatusThrottled},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for region, result := range s.RegionsSince(tt.start) {
+				if result.Status != tt.want[region] {
+					t.Errorf("RegionsSince() %s got = %s, want %s", region, result.Status, tt.want[region])
+				}
+			}
+		})
+	}
+}
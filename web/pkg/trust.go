@@ -0,0 +1,452 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidTrustPolicy is returned when a trust template or its parameters aren't valid.
+var ErrInvalidTrustPolicy = errors.New("invalid trust policy")
+
+// DefaultTrustTemplate trusts any AWS principal, this is what roles used before templates existed.
+const DefaultTrustTemplate = "public"
+
+// TrustPolicyInput selects a trust template and the parameters to fill it in with.
+type TrustPolicyInput struct {
+	Template string            `json:"template"`
+	Params   map[string]string `json:"params,omitempty"`
+}
+
+// TrustOptions are the operator's limits on what trust policies can refer to.
+type TrustOptions struct {
+	// AccountId is the sandbox account's ID, identity providers are created in it.
+	AccountId string
+
+	// OIDCIssuers are the issuers the oidc template accepts, a provider is created for each one that doesn't have one
+	// yet.
+	OIDCIssuers []string
+
+	// MaxSAMLProviders is how many SAML providers the saml template can have created at once, new ones are refused
+	// with ErrProviderLimit until the reaper deletes unused ones.
+	MaxSAMLProviders int
+}
+
+// TrustParam is a parameter accepted by a TrustTemplate.
+type TrustParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+
+	// Pattern is what the value must match, lists are checked per comma separated item.
+	Pattern *regexp.Regexp `json:"-"`
+	List    bool           `json:"list,omitempty"`
+
+	// Check is called with the value after it matches Pattern, it's optional.
+	Check func(value string) error `json:"-"`
+}
+
+// TrustTemplate builds the trust policy statement for a generated role.
+type TrustTemplate struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Params      []TrustParam `json:"params"`
+
+	statement func(params map[string]string, opts *TrustOptions) PolicyStatement2
+
+	// check validates the params against the operator's options after Validate, it's optional.
+	check func(params map[string]string, opts *TrustOptions) error
+
+	// setup creates anything the trust policy refers to, like identity providers, it's optional.
+	setup func(ctx *Context, client *iam.Client, params map[string]string, opts *TrustOptions) error
+}
+
+var (
+	boolPattern           = regexp.MustCompile(`^(true|false)$`)
+	externalIdPattern     = regexp.MustCompile(`^[\w+=,.@:/-]{2,}$`)
+	sourceIdentityPattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+	accountIdPattern      = regexp.MustCompile(`^\d{12}$`)
+	orgIdPattern          = regexp.MustCompile(`^o-[a-z0-9]{10,32}$`)
+	tagKeyPattern         = regexp.MustCompile(`^[\w.:/=+@-]{1,128}$`)
+	servicePattern        = regexp.MustCompile(`^[a-z0-9.-]+\.amazonaws\.com(\.cn)?$`)
+	oidcIssuerPattern     = regexp.MustCompile(`^[a-z0-9.-]+\.[a-z]{2,}(/[\w.-]+)*$`)
+	oidcAudiencePattern   = regexp.MustCompile(`^[\w.:/-]{1,255}$`)
+	oidcSubjectPattern    = regexp.MustCompile(`^[\w.:/*?@=+,-]{1,255}$`)
+	base64Pattern         = regexp.MustCompile(`^[A-Za-z0-9+/_-]+=*$`)
+)
+
+// awsPrincipalParams are accepted by every template trusting AWS principals.
+var awsPrincipalParams = []TrustParam{
+	{
+		Name:        "external_id",
+		Description: "ExternalId the caller must pass.",
+		Pattern:     externalIdPattern,
+	},
+	{
+		Name:        "tag_session",
+		Description: "Allow sts:TagSession, true or false.",
+		Pattern:     boolPattern,
+	},
+	{
+		Name:        "set_source_identity",
+		Description: "Allow sts:SetSourceIdentity, true or false.",
+		Pattern:     boolPattern,
+	},
+}
+
+// TrustTemplates are the trust policies roles can be created with, keyed by name.
+var TrustTemplates = map[string]*TrustTemplate{
+	"public": {
+		Name:        "public",
+		Description: "Any AWS principal.",
+		Params:      awsPrincipalParams,
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			return assumeRoleStatement("*")
+		},
+	},
+	"external-id": {
+		Name:        "external-id",
+		Description: "Any AWS principal passing an ExternalId, any value is accepted unless external_id is set.",
+		Params:      awsPrincipalParams,
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			statement := assumeRoleStatement("*")
+			if params["external_id"] == "" {
+				statement.Condition.Add("Null", "sts:ExternalId", "false")
+				statement.Condition.Add("StringNotEquals", "sts:ExternalId", "PurposefullyIncorrectExternalID")
+			}
+			return statement
+		},
+	},
+	"account": {
+		Name:        "account",
+		Description: "Principals in a single AWS account.",
+		Params: append([]TrustParam{
+			{
+				Name:        "account",
+				Description: "ID of the trusted account.",
+				Required:    true,
+				Pattern:     accountIdPattern,
+			},
+		}, awsPrincipalParams...),
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			return assumeRoleStatement(fmt.Sprintf("arn:aws:iam::%s:root", params["account"]))
+		},
+	},
+	"org": {
+		Name:        "org",
+		Description: "Principals in a single AWS Organization.",
+		Params: append([]TrustParam{
+			{
+				Name:        "org_id",
+				Description: "ID of the trusted organization.",
+				Required:    true,
+				Pattern:     orgIdPattern,
+			},
+		}, awsPrincipalParams...),
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			statement := assumeRoleStatement("*")
+			statement.Condition.Add("StringEquals", "aws:PrincipalOrgID", params["org_id"])
+			return statement
+		},
+	},
+	"source-identity": {
+		Name:        "source-identity",
+		Description: "Any AWS principal setting a source identity, any value is accepted unless source_identity is set.",
+		Params: append([]TrustParam{
+			{
+				Name:        "source_identity",
+				Description: "Source identity the caller must set.",
+				Pattern:     sourceIdentityPattern,
+			},
+		}, awsPrincipalParams...),
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			statement := assumeRoleStatement("*")
+			statement.Action = append(statement.Action, "sts:SetSourceIdentity")
+			if v := params["source_identity"]; v != "" {
+				statement.Condition.Add("StringEquals", "sts:SourceIdentity", v)
+			} else {
+				statement.Condition.Add("Null", "sts:SourceIdentity", "false")
+			}
+			return statement
+		},
+	},
+	"session-tags": {
+		Name:        "session-tags",
+		Description: "Any AWS principal passing each of the given session tags.",
+		Params: append([]TrustParam{
+			{
+				Name:        "tag_keys",
+				Description: "Comma separated session tag keys the caller must pass.",
+				Required:    true,
+				Pattern:     tagKeyPattern,
+				List:        true,
+			},
+		}, awsPrincipalParams...),
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			statement := assumeRoleStatement("*")
+			statement.Action = append(statement.Action, "sts:TagSession")
+			for _, key := range strings.Split(params["tag_keys"], ",") {
+				statement.Condition.Add("Null", "aws:RequestTag/"+key, "false")
+			}
+			return statement
+		},
+	},
+	"service": {
+		Name:        "service",
+		Description: "An AWS service principal.",
+		Params: []TrustParam{
+			{
+				Name:        "service",
+				Description: "Service principal, e.g. ec2.amazonaws.com.",
+				Required:    true,
+				Pattern:     servicePattern,
+			},
+		},
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			return PolicyStatement2{
+				Sid:       "AllowAssumeRole",
+				Effect:    "Allow",
+				Principal: &PolicyPrincipal{Service: []string{params["service"]}},
+				Action:    []string{"sts:AssumeRole"},
+				Condition: PolicyCondition{},
+			}
+		},
+	},
+	"oidc": {
+		Name:        "oidc",
+		Description: "Web identities from an OIDC provider, any subject and audience are accepted unless subject or audience are set.",
+		Params: []TrustParam{
+			{
+				Name:        "issuer",
+				Description: "Issuer without the https:// prefix, " + DefaultOIDCIssuer + " (GitHub Actions) by default.",
+				Pattern:     oidcIssuerPattern,
+			},
+			{
+				Name:        "audience",
+				Description: "Audience (aud) the token must have, it must be one of the provider's client IDs.",
+				Pattern:     oidcAudiencePattern,
+			},
+			{
+				Name:        "subject",
+				Description: "Subject (sub) the token must match, may contain * and ? wildcards, e.g. repo:octo-org/*.",
+				Pattern:     oidcSubjectPattern,
+			},
+		},
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			issuer := OIDCIssuer(params)
+			statement := PolicyStatement2{
+				Sid:       "AllowAssumeRoleWithWebIdentity",
+				Effect:    "Allow",
+				Principal: &PolicyPrincipal{Federated: OIDCProviderArn(opts.AccountId, issuer)},
+				Action:    []string{"sts:AssumeRoleWithWebIdentity"},
+				Condition: PolicyCondition{},
+			}
+			if v := params["audience"]; v != "" {
+				statement.Condition.Add("StringEquals", issuer+":aud", v)
+			}
+			if v := params["subject"]; v != "" {
+				statement.Condition.Add("StringLike", issuer+":sub", v)
+			}
+			return statement
+		},
+		check: func(params map[string]string, opts *TrustOptions) error {
+			if issuer := OIDCIssuer(params); !slices.Contains(opts.OIDCIssuers, issuer) {
+				return fmt.Errorf("%w: issuer %s isn't allowed, expected one of %s", ErrInvalidTrustPolicy, issuer, strings.Join(opts.OIDCIssuers, ", "))
+			}
+			return nil
+		},
+		setup: func(ctx *Context, client *iam.Client, params map[string]string, opts *TrustOptions) error {
+			return EnsureOIDCProvider(ctx, client, opts.AccountId, OIDCIssuer(params), OIDCAudience(params))
+		},
+	},
+	"saml": {
+		Name:        "saml",
+		Description: "Users of a SAML IdP, any subject is accepted unless subject is set.",
+		Params: []TrustParam{
+			{
+				Name:        "metadata",
+				Description: "The IdP's metadata XML, base64 encoded, or the raw XML as the body of a POST. A SAML provider is created for it in the sandbox account.",
+				Required:    true,
+				Pattern:     base64Pattern,
+				Check: func(value string) error {
+					metadata, err := DecodeSAMLMetadata(value)
+					if err != nil {
+						return fmt.Errorf("decoding metadata: %w", err)
+					}
+					_, err = ParseSAMLMetadata(metadata)
+					return err
+				},
+			},
+			{
+				Name:        "audience",
+				Description: "Audience (SAML:aud) the assertion must have, e.g. " + DefaultSAMLAudience + ".",
+				Pattern:     oidcAudiencePattern,
+			},
+			{
+				Name:        "subject",
+				Description: "NameID (saml:sub) the assertion must match, may contain * and ? wildcards.",
+				Pattern:     oidcSubjectPattern,
+			},
+		},
+		statement: func(params map[string]string, opts *TrustOptions) PolicyStatement2 {
+			metadata, _ := DecodeSAMLMetadata(params["metadata"])
+			statement := PolicyStatement2{
+				Sid:       "AllowAssumeRoleWithSAML",
+				Effect:    "Allow",
+				Principal: &PolicyPrincipal{Federated: SAMLProviderArn(opts.AccountId, SAMLProviderName(metadata))},
+				Action:    []string{"sts:AssumeRoleWithSAML"},
+				Condition: PolicyCondition{},
+			}
+			if v := params["audience"]; v != "" {
+				statement.Condition.Add("StringEquals", "SAML:aud", v)
+			}
+			if v := params["subject"]; v != "" {
+				statement.Condition.Add("StringLike", "saml:sub", v)
+			}
+			return statement
+		},
+		setup: func(ctx *Context, client *iam.Client, params map[string]string, opts *TrustOptions) error {
+			metadata, err := DecodeSAMLMetadata(params["metadata"])
+			if err != nil {
+				return fmt.Errorf("%w: decoding metadata: %w", ErrInvalidTrustPolicy, err)
+			}
+			return EnsureSAMLProvider(ctx, client, metadata, opts.MaxSAMLProviders)
+		},
+	},
+}
+
+// Add appends values to the key under operator.
+func (c PolicyCondition) Add(operator, key string, values ...string) {
+	if c[operator] == nil {
+		c[operator] = map[string][]string{}
+	}
+	c[operator][key] = append(c[operator][key], values...)
+}
+
+func assumeRoleStatement(principal string) PolicyStatement2 {
+	return PolicyStatement2{
+		Sid:       "AllowAssumeRole",
+		Effect:    "Allow",
+		Principal: &PolicyPrincipal{AWS: principal},
+		Action:    []string{"sts:AssumeRole"},
+		Condition: PolicyCondition{},
+	}
+}
+
+// BuildTrustPolicy validates the input against its template and opts and returns the trust policy.
+func BuildTrustPolicy(input *TrustPolicyInput, opts *TrustOptions) (*PolicyDocument2, error) {
+	template, ok := TrustTemplates[input.Template]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown template %q", ErrInvalidTrustPolicy, input.Template)
+	}
+
+	if err := template.Validate(input.Params); err != nil {
+		return nil, err
+	}
+	if template.check != nil {
+		if err := template.check(input.Params, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	statement := template.statement(input.Params, opts)
+	if v := input.Params["external_id"]; v != "" {
+		statement.Condition.Add("StringEquals", "sts:ExternalId", v)
+	}
+	if input.Params["tag_session"] == "true" && !slices.Contains(statement.Action, "sts:TagSession") {
+		statement.Action = append(statement.Action, "sts:TagSession")
+	}
+	if input.Params["set_source_identity"] == "true" && !slices.Contains(statement.Action, "sts:SetSourceIdentity") {
+		statement.Action = append(statement.Action, "sts:SetSourceIdentity")
+	}
+
+	return &PolicyDocument2{
+		Version:   "2012-10-17",
+		Statement: []PolicyStatement2{statement},
+	}, nil
+}
+
+// SetupTrustPolicy creates anything the input's trust template refers to within the limits of opts, it should be called
+// after BuildTrustPolicy.
+func SetupTrustPolicy(ctx *Context, client *iam.Client, input *TrustPolicyInput, opts *TrustOptions) error {
+	template, ok := TrustTemplates[input.Template]
+	if !ok {
+		return fmt.Errorf("%w: unknown template %q", ErrInvalidTrustPolicy, input.Template)
+	} else if template.setup == nil {
+		return nil
+	}
+
+	if err := template.setup(ctx, client, input.Params, opts); err != nil {
+		return fmt.Errorf("setting up trust template %s: %w", template.Name, err)
+	}
+	return nil
+}
+
+// Validate checks for unknown, missing and malformed parameters.
+func (t *TrustTemplate) Validate(params map[string]string) error {
+	known := map[string]TrustParam{}
+	for _, param := range t.Params {
+		known[param.Name] = param
+	}
+
+	names := Keys(params)
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if _, ok := known[name]; !ok {
+			errs = append(errs, fmt.Errorf("%w: template %s doesn't take parameter %s", ErrInvalidTrustPolicy, t.Name, name))
+		}
+	}
+
+	for _, param := range t.Params {
+		value := params[param.Name]
+		if value == "" {
+			if param.Required {
+				errs = append(errs, fmt.Errorf("%w: template %s requires parameter %s", ErrInvalidTrustPolicy, t.Name, param.Name))
+			}
+			continue
+		}
+
+		values := []string{value}
+		if param.List {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if !param.Pattern.MatchString(v) {
+				errs = append(errs, fmt.Errorf("%w: parameter %s doesn't match %s", ErrInvalidTrustPolicy, param.Name, param.Pattern))
+			} else if param.Check == nil {
+				continue
+			} else if err := param.Check(v); err != nil {
+				errs = append(errs, fmt.Errorf("%w: parameter %s: %w", ErrInvalidTrustPolicy, param.Name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// TrustPolicyFromQuery reads the template from the "trust" query parameter and its parameters from the parameters of
+// the same name, it returns nil when no template was requested.
+func TrustPolicyFromQuery(query url.Values) *TrustPolicyInput {
+	name := query.Get("trust")
+	if name == "" {
+		return nil
+	}
+
+	input := &TrustPolicyInput{Template: name, Params: map[string]string{}}
+	if template, ok := TrustTemplates[name]; ok {
+		for _, param := range template.Params {
+			if v := query.Get(param.Name); v != "" {
+				input.Params[param.Name] = v
+			}
+		}
+	}
+
+	return input
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+var testTrustOptions = &TrustOptions{
+	AccountId:        testSandboxAccountId,
+	OIDCIssuers:      []string{DefaultOIDCIssuer},
+	MaxSAMLProviders: DefaultMaxSAMLProviders,
+}
+
+func TestBuildTrustPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   *TrustPolicyInput
+		opts    *TrustOptions
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "Public",
+			input: &TrustPolicyInput{Template: "public"},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"*"},"Action":["sts:AssumeRole"]}]}`,
+		},
+		{
+			name:  "Any external id",
+			input: &TrustPolicyInput{Template: "external-id"},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"*"},"Action":["sts:AssumeRole"],"Condition":{"Null":{"sts:ExternalId":["false"]},"StringNotEquals":{"sts:ExternalId":["PurposefullyIncorrectExternalID"]}}}]}`,
+		},
+		{
+			name:  "Specific external id",
+			input: &TrustPolicyInput{Template: "external-id", Params: map[string]string{"external_id": "abc123"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"*"},"Action":["sts:AssumeRole"],"Condition":{"StringEquals":{"sts:ExternalId":["abc123"]}}}]}`,
+		},
+		{
+			name:  "Account with tag session",
+			input: &TrustPolicyInput{Template: "account", Params: map[string]string{"account": "123456789012", "tag_session": "true"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"arn:aws:iam::123456789012:root"},"Action":["sts:AssumeRole","sts:TagSession"]}]}`,
+		},
+		{
+			name:  "Org",
+			input: &TrustPolicyInput{Template: "org", Params: map[string]string{"org_id": "o-abcdefghij"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"*"},"Action":["sts:AssumeRole"],"Condition":{"StringEquals":{"aws:PrincipalOrgID":["o-abcdefghij"]}}}]}`,
+		},
+		{
+			name:  "Source identity",
+			input: &TrustPolicyInput{Template: "source-identity", Params: map[string]string{"set_source_identity": "true"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"*"},"Action":["sts:AssumeRole","sts:SetSourceIdentity"],"Condition":{"Null":{"sts:SourceIdentity":["false"]}}}]}`,
+		},
+		{
+			name:  "Session tags",
+			input: &TrustPolicyInput{Template: "session-tags", Params: map[string]string{"tag_keys": "team,project"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"AWS":"*"},"Action":["sts:AssumeRole","sts:TagSession"],"Condition":{"Null":{"aws:RequestTag/project":["false"],"aws:RequestTag/team":["false"]}}}]}`,
+		},
+		{
+			name:  "Service",
+			input: &TrustPolicyInput{Template: "service", Params: map[string]string{"service": "ec2.amazonaws.com"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRole","Effect":"Allow","Principal":{"Service":["ec2.amazonaws.com"]},"Action":["sts:AssumeRole"]}]}`,
+		},
+		{
+			name:  "Any GitHub repository",
+			input: &TrustPolicyInput{Template: "oidc"},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRoleWithWebIdentity","Effect":"Allow","Principal":{"Federated":"arn:aws:iam::137068222704:oidc-provider/token.actions.githubusercontent.com"},"Action":["sts:AssumeRoleWithWebIdentity"]}]}`,
+		},
+		{
+			name:  "OIDC subject and audience",
+			input: &TrustPolicyInput{Template: "oidc", Params: map[string]string{"issuer": "gitlab.com", "audience": "https://gitlab.com", "subject": "project_path:group/*"}},
+			opts:  &TrustOptions{AccountId: testSandboxAccountId, OIDCIssuers: []string{DefaultOIDCIssuer, "gitlab.com"}},
+			want:  `{"Version":"2012-10-17","Statement":[{"Sid":"AllowAssumeRoleWithWebIdentity","Effect":"Allow","Principal":{"Federated":"arn:aws:iam::137068222704:oidc-provider/gitlab.com"},"Action":["sts:AssumeRoleWithWebIdentity"],"Condition":{"StringEquals":{"gitlab.com:aud":["https://gitlab.com"]},"StringLike":{"gitlab.com:sub":["project_path:group/*"]}}}]}`,
+		},
+		{
+			name:    "OIDC issuer not allowed",
+			input:   &TrustPolicyInput{Template: "oidc", Params: map[string]string{"issuer": "gitlab.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "OIDC issuer with scheme",
+			input:   &TrustPolicyInput{Template: "oidc", Params: map[string]string{"issuer": "https://gitlab.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "SAML without metadata",
+			input:   &TrustPolicyInput{Template: "saml"},
+			wantErr: true,
+		},
+		{
+			name:    "SAML metadata that isn't an IdP",
+			input:   &TrustPolicyInput{Template: "saml", Params: map[string]string{"metadata": "PGZvby8+"}},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown template",
+			input:   &TrustPolicyInput{Template: "nope"},
+			wantErr: true,
+		},
+		{
+			name:    "Missing required parameter",
+			input:   &TrustPolicyInput{Template: "account"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid parameter",
+			input:   &TrustPolicyInput{Template: "account", Params: map[string]string{"account": "12345"}},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid list item",
+			input:   &TrustPolicyInput{Template: "session-tags", Params: map[string]string{"tag_keys": "team,\"}"}},
+			wantErr: true,
+		},
+		{
+			name:    "Unknown parameter",
+			input:   &TrustPolicyInput{Template: "service", Params: map[string]string{"service": "ec2.amazonaws.com", "external_id": "abc123"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts == nil {
+				opts = testTrustOptions
+			}
+			got, err := BuildTrustPolicy(tt.input, opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BuildTrustPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidTrustPolicy) {
+					t.Errorf("BuildTrustPolicy() error = %v, want ErrInvalidTrustPolicy", err)
+				}
+				return
+			}
+
+			if b := string(Must(json.Marshal(got))); b != tt.want {
+				t.Errorf("BuildTrustPolicy() got = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustPolicyFromQuery(t *testing.T) {
+	query := url.Values{
+		"trust":   {"org"},
+		"org_id":  {"o-abcdefghij"},
+		"owner":   {"secret"},
+		"service": {"ec2.amazonaws.com"},
+	}
+
+	got := TrustPolicyFromQuery(query)
+	if got.Template != "org" || len(got.Params) != 1 || got.Params["org_id"] != "o-abcdefghij" {
+		t.Errorf("TrustPolicyFromQuery() got = %+v", got)
+	}
+
+	if got := TrustPolicyFromQuery(url.Values{}); got != nil {
+		t.Errorf("TrustPolicyFromQuery() got = %+v, want nil", got)
+	}
+}
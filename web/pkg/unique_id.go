@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrInvalidUniqueId is returned by DecodeUniqueId for values that don't look like an AWS unique ID or access key ID.
+var ErrInvalidUniqueId = errors.New("invalid unique id")
+
+// UniqueIdType is the kind of resource a unique ID belongs to, going by its prefix.
+type UniqueIdType string
+
+const (
+	UniqueIdBearerToken       UniqueIdType = "sts-bearer-token"
+	UniqueIdContextCredential UniqueIdType = "context-specific-credential"
+	UniqueIdGroup             UniqueIdType = "group"
+	UniqueIdUser              UniqueIdType = "user"
+	UniqueIdInstanceProfile   UniqueIdType = "instance-profile"
+	UniqueIdAccessKey         UniqueIdType = "access-key"
+	UniqueIdManagedPolicy     UniqueIdType = "managed-policy"
+	UniqueIdPolicyVersion     UniqueIdType = "managed-policy-version"
+	UniqueIdPublicKey         UniqueIdType = "public-key"
+	UniqueIdRole              UniqueIdType = "role"
+	UniqueIdCertificate       UniqueIdType = "certificate"
+	UniqueIdTemporaryKey      UniqueIdType = "temporary-access-key"
+)
+
+// UniqueIdPrefixes maps the documented unique ID prefixes to the type of resource they're used for.
+//
+// See: https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_identifiers.html#identifiers-unique-ids
+var UniqueIdPrefixes = map[string]UniqueIdType{
+	"ABIA": UniqueIdBearerToken,
+	"ACCA": UniqueIdContextCredential,
+	"AGPA": UniqueIdGroup,
+	"AIDA": UniqueIdUser,
+	"AIPA": UniqueIdInstanceProfile,
+	"AKIA": UniqueIdAccessKey,
+	"ANPA": UniqueIdManagedPolicy,
+	"ANVA": UniqueIdPolicyVersion,
+	"APKA": UniqueIdPublicKey,
+	"AROA": UniqueIdRole,
+	"ASCA": UniqueIdCertificate,
+	"ASIA": UniqueIdTemporaryKey,
+}
+
+var uniqueIdPattern = regexp.MustCompile(`^A[A-Z0-9]{15,127}$`)
+
+// UniqueId is a decoded unique ID or access key ID.
+type UniqueId struct {
+	Value  string       `json:"value"`
+	Prefix string       `json:"prefix"`
+	Type   UniqueIdType `json:"type"`
+
+	// AccountId is only set for access key IDs, it's empty for keys created before the account was encoded in them.
+	AccountId string `json:"account_id,omitempty"`
+}
+
+// DecodeUniqueId classifies a unique ID by its prefix, and for access key IDs decodes the account ID they belong to.
+// Unknown prefixes are returned with an empty Type.
+func DecodeUniqueId(value string) (*UniqueId, error) {
+	if !uniqueIdPattern.MatchString(value) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidUniqueId, value)
+	}
+
+	id := &UniqueId{
+		Value:  value,
+		Prefix: value[:4],
+		Type:   UniqueIdPrefixes[value[:4]],
+	}
+
+	if id.Type == UniqueIdAccessKey || id.Type == UniqueIdTemporaryKey {
+		id.AccountId = AccessKeyAccountId(value)
+	}
+
+	return id, nil
+}
+
+// AccessKeyAccountId returns the account ID encoded in an access key ID, or an empty string for older keys that don't
+// have one (these start with AKIAI or AKIAJ).
+//
+// The 16 characters after the prefix are base32, the account ID is in bits 1 to 40 of the decoded value.
+//
+// See: https://medium.com/@TalBeerySec/a-short-note-on-aws-key-id-f88cc4317489
+func AccessKeyAccountId(accessKeyId string) string {
+	if len(accessKeyId) < 20 || accessKeyId[4] == 'I' || accessKeyId[4] == 'J' {
+		return ""
+	}
+
+	decoded, err := base32.StdEncoding.DecodeString(accessKeyId[4:20])
+	if err != nil {
+		return ""
+	}
+
+	// Only the first 6 of the 10 decoded bytes are needed, pad them out to read as a uint64.
+	value := binary.BigEndian.Uint64(append([]byte{0, 0}, decoded[:6]...))
+	return fmt.Sprintf("%012d", (value&0x7fffffffff80)>>7)
+}
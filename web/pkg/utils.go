@@ -3,10 +3,12 @@ package pkg
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"io"
 	"log"
 	"math/rand"
@@ -55,6 +57,13 @@ type Context struct {
 	Debug    *log.Logger
 }
 
+// WithContext returns a copy of ctx that shares its loggers but is bound to parent's deadline and cancellation.
+func (ctx *Context) WithContext(parent context.Context) *Context {
+	c := *ctx
+	c.Context = parent
+	return &c
+}
+
 func (ctx *Context) SetLoggingLevel(level LogLevel) Context {
 	ctx.LogLevel = level
 
@@ -118,35 +127,94 @@ func Must[T any](v T, err error) T {
 	return v
 }
 
+// DeleteRole removes everything attached to the role and deletes it, a role that's already gone isn't an error.
+//
+// Attached and inline policies and instance profiles all have to be removed first or IAM refuses to delete the role.
+// Tags are left alone, if the delete fails the role keeps its owner and expiry so it can still be reclaimed or reaped.
 func DeleteRole(ctx *Context, client *iam.Client, name string) error {
-	resp, err := client.ListAttachedRolePolicies(ctx, &iam.ListAttachedRolePoliciesInput{
+	attached := iam.NewListAttachedRolePoliciesPaginator(client, &iam.ListAttachedRolePoliciesInput{
 		RoleName: aws.String(name),
 	})
-	if err != nil {
-		return fmt.Errorf("listing attached policies %s: %w", name, err)
+	for attached.HasMorePages() {
+		resp, err := attached.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("listing attached policies %s: %w", name, err)
+		}
+
+		for _, policy := range resp.AttachedPolicies {
+			if _, err := client.DetachRolePolicy(ctx, &iam.DetachRolePolicyInput{
+				RoleName:  aws.String(name),
+				PolicyArn: policy.PolicyArn,
+			}); err != nil && !isNoSuchEntity(err) {
+				return fmt.Errorf("detaching policy %s: %w", *policy.PolicyArn, err)
+			}
+		}
 	}
 
-	for _, policy := range resp.AttachedPolicies {
-		if _, err := client.DetachRolePolicy(ctx, &iam.DetachRolePolicyInput{
-			RoleName:  aws.String(name),
-			PolicyArn: policy.PolicyArn,
-		}); err != nil {
-			return fmt.Errorf("detaching policy %s: %w", *policy.PolicyArn, err)
+	inline := iam.NewListRolePoliciesPaginator(client, &iam.ListRolePoliciesInput{
+		RoleName: aws.String(name),
+	})
+	for inline.HasMorePages() {
+		resp, err := inline.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing inline policies %s: %w", name, err)
+		}
+
+		for _, policyName := range resp.PolicyNames {
+			if _, err := client.DeleteRolePolicy(ctx, &iam.DeleteRolePolicyInput{
+				RoleName:   aws.String(name),
+				PolicyName: aws.String(policyName),
+			}); err != nil && !isNoSuchEntity(err) {
+				return fmt.Errorf("deleting inline policy %s: %w", policyName, err)
+			}
+		}
+	}
+
+	profiles := iam.NewListInstanceProfilesForRolePaginator(client, &iam.ListInstanceProfilesForRoleInput{
+		RoleName: aws.String(name),
+	})
+	for profiles.HasMorePages() {
+		resp, err := profiles.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing instance profiles %s: %w", name, err)
+		}
+
+		for _, profile := range resp.InstanceProfiles {
+			if _, err := client.RemoveRoleFromInstanceProfile(ctx, &iam.RemoveRoleFromInstanceProfileInput{
+				RoleName:            aws.String(name),
+				InstanceProfileName: profile.InstanceProfileName,
+			}); err != nil && !isNoSuchEntity(err) {
+				return fmt.Errorf("removing role from instance profile %s: %w", *profile.InstanceProfileName, err)
+			}
 		}
 	}
 
 	if _, err := client.DeleteRole(ctx, &iam.DeleteRoleInput{
 		RoleName: aws.String(name),
-	}); err != nil {
-		return fmt.Errorf("deleting role: %v", err)
+	}); err != nil && !isNoSuchEntity(err) {
+		return fmt.Errorf("deleting role: %w", err)
 	}
 	return nil
 }
 
-func MustGetenv(name string) string {
-	v := os.Getenv(name)
-	if v == "" {
-		panic(fmt.Sprintf("missing env var: %s", name))
+func listRoleTags(ctx *Context, client *iam.Client, name string) ([]types.Tag, error) {
+	var tags []types.Tag
+	paginator := iam.NewListRoleTagsPaginator(client, &iam.ListRoleTagsInput{
+		RoleName: aws.String(name),
+	})
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, resp.Tags...)
 	}
-	return v
+	return tags, nil
+}
+
+func isNoSuchEntity(err error) bool {
+	var notFoundErr *types.NoSuchEntityException
+	return errors.As(err, &notFoundErr)
 }
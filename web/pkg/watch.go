@@ -0,0 +1,228 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WatchPollInterval is how often WatchEvents polls for new events.
+const WatchPollInterval = 10 * time.Second
+
+// WatchHeartbeatInterval is how often a comment is sent to keep idle connections open.
+const WatchHeartbeatInterval = 15 * time.Second
+
+// watchDeadlineMargin is how long before the request deadline the stream is closed, so it ends cleanly and the
+// client reconnects with Last-Event-ID rather than seeing the connection dropped.
+const watchDeadlineMargin = 3 * time.Second
+
+const (
+	WatchEventAssumeRole = "assume-role"
+	WatchEventSession    = "session"
+	WatchEventEnd        = "end"
+)
+
+// NewEventStream writes the headers for a Server-Sent Events response.
+func NewEventStream(w http.ResponseWriter) *EventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	return &EventStream{w: w, rc: http.NewResponseController(w)}
+}
+
+// EventStream writes Server-Sent Events.
+type EventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// Send writes a single event with data marshalled as JSON.
+func (s *EventStream) Send(id, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshalling %s event: %w", event, err)
+	}
+
+	if _, err := fmt.Fprintf(s.w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, b); err != nil {
+		return fmt.Errorf("writing %s event: %w", event, err)
+	}
+	return s.flush()
+}
+
+// Heartbeat writes a comment, which clients ignore.
+func (s *EventStream) Heartbeat() error {
+	if _, err := fmt.Fprint(s.w, ": heartbeat\n\n"); err != nil {
+		return fmt.Errorf("writing heartbeat: %w", err)
+	}
+	return s.flush()
+}
+
+func (s *EventStream) flush() error {
+	// The lambda response stream isn't buffered so it doesn't support flushing.
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return fmt.Errorf("flushing: %w", err)
+	}
+	return nil
+}
+
+type WatchEventsInput struct {
+	*PollEventsInput
+
+	// LastEventId is the id of the last event the client received, from the Last-Event-ID header.
+	LastEventId string
+}
+
+// WatchEvents streams each new AssumeRole event, and any session API calls made since it was last sent, until the
+// role expires or is deleted, the client disconnects or the request deadline is near.
+//
+// Event ids have the form "<event id>/<session event count>" so a reconnecting client only gets what it missed.
+func WatchEvents(ctx *Context, params *WatchEventsInput, stream *EventStream) error {
+	// roleExpires is left zero when the role is already gone, the first poll will end the stream.
+	var roleExpires time.Time
+	if role, err := GetRoleFromToken(ctx, params.Iam, params.Store, params.Token, params.Keyring); err == nil {
+		roleExpires = RoleExpiry(*role.Role)
+	} else if !errors.Is(err, ErrRoleNotFound) {
+		return fmt.Errorf("getting role from Token: %w", err)
+	}
+
+	streamEnds := roleExpires
+	if deadline, ok := ctx.Deadline(); ok && (streamEnds.IsZero() || deadline.Add(-watchDeadlineMargin).Before(streamEnds)) {
+		streamEnds = deadline.Add(-watchDeadlineMargin)
+	}
+
+	var end <-chan time.Time
+	if !streamEnds.IsZero() {
+		timer := time.NewTimer(time.Until(streamEnds))
+		defer timer.Stop()
+		end = timer.C
+	}
+
+	heartbeat := time.NewTicker(WatchHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	poll := time.NewTicker(WatchPollInterval)
+	defer poll.Stop()
+
+	cursor := NewWatchCursor(params.LastEventId)
+	for {
+		result, err := PollEvents(ctx, params.PollEventsInput)
+		if err != nil {
+			return fmt.Errorf("polling events: %w", err)
+		}
+
+		for _, update := range cursor.Pending(result.Results) {
+			if err := stream.Send(cursor.Id(update.Event), update.Name, update.Event); err != nil {
+				return err
+			}
+		}
+
+		if result.RoleDeleted {
+			return stream.Send(cursor.LastId, WatchEventEnd, map[string]string{"reason": "role deleted"})
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				ctx.Debug.Printf("watch client went away: %v", ctx.Err())
+				return nil
+			case <-end:
+				if !roleExpires.IsZero() && !time.Now().Before(roleExpires) {
+					return stream.Send(cursor.LastId, WatchEventEnd, map[string]string{"reason": "role expired"})
+				}
+				return nil
+			case <-heartbeat.C:
+				if err := stream.Heartbeat(); err != nil {
+					return err
+				}
+			case <-poll.C:
+				break wait
+			}
+		}
+	}
+}
+
+// NewWatchCursor resumes from a Last-Event-ID, an empty id starts from the beginning.
+func NewWatchCursor(lastEventId string) *WatchCursor {
+	cursor := &WatchCursor{
+		LastId: lastEventId,
+		sent:   map[string]int{},
+	}
+
+	if lastEventId != "" {
+		id, count, _ := strings.Cut(lastEventId, "/")
+		cursor.resumeId = id
+		cursor.resumeCount, _ = strconv.Atoi(count)
+	}
+
+	return cursor
+}
+
+// WatchCursor tracks what has been sent to a client.
+type WatchCursor struct {
+	LastId string
+
+	// sent holds the number of session events sent for each AssumeRole event.
+	sent map[string]int
+
+	// resumeId is the event the client last received before reconnecting, cleared after the first poll.
+	resumeId    string
+	resumeCount int
+}
+
+// WatchUpdate is an event the client hasn't seen yet, or has seen with fewer session events.
+type WatchUpdate struct {
+	Name  string
+	Event AssumeRoleEvent
+}
+
+// Pending returns the updates to send for events, which must be ordered oldest first.
+func (c *WatchCursor) Pending(events []AssumeRoleEvent) []WatchUpdate {
+	if c.resumeId != "" {
+		c.resume(events)
+	}
+
+	var updates []WatchUpdate
+	for _, event := range events {
+		sent, ok := c.sent[event.EventId]
+		if !ok {
+			updates = append(updates, WatchUpdate{Name: WatchEventAssumeRole, Event: event})
+		} else if len(event.Events) > sent {
+			updates = append(updates, WatchUpdate{Name: WatchEventSession, Event: event})
+		} else {
+			continue
+		}
+		c.sent[event.EventId] = len(event.Events)
+	}
+
+	return updates
+}
+
+// resume marks everything up to the resumed event as sent, if it isn't found everything is sent again.
+func (c *WatchCursor) resume(events []AssumeRoleEvent) {
+	for i, event := range events {
+		if event.EventId != c.resumeId {
+			continue
+		}
+
+		for _, sent := range events[:i] {
+			c.sent[sent.EventId] = len(sent.Events)
+		}
+		c.sent[event.EventId] = c.resumeCount
+		break
+	}
+
+	c.resumeId = ""
+}
+
+// Id returns the SSE id for an update that is being sent and records it as the last id.
+func (c *WatchCursor) Id(event AssumeRoleEvent) string {
+	c.LastId = fmt.Sprintf("%s/%d", event.EventId, len(event.Events))
+	return c.LastId
+}
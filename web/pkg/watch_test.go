@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestWatchCursor(t *testing.T) {
+	events := []AssumeRoleEvent{
+		{EventId: "1", Events: []SessionEvent{{EventName: "GetCallerIdentity"}}},
+		{EventId: "2"},
+		{EventId: "3", Events: []SessionEvent{{EventName: "GetCallerIdentity"}, {EventName: "ListBuckets"}}},
+	}
+
+	names := func(updates []WatchUpdate) []string {
+		var names []string
+		for _, update := range updates {
+			names = append(names, update.Event.EventId+":"+update.Name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name        string
+		lastEventId string
+		want        []string
+	}{
+		{
+			name:        "New client",
+			lastEventId: "",
+			want:        []string{"1:assume-role", "2:assume-role", "3:assume-role"},
+		},
+		{
+			name:        "Resume after second event",
+			lastEventId: "2/0",
+			want:        []string{"3:assume-role"},
+		},
+		{
+			name:        "Resume with missed session events",
+			lastEventId: "3/1",
+			want:        []string{"3:session"},
+		},
+		{
+			name:        "Resume from unknown event",
+			lastEventId: "unknown/0",
+			want:        []string{"1:assume-role", "2:assume-role", "3:assume-role"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor := NewWatchCursor(tt.lastEventId)
+
+			got := names(cursor.Pending(events))
+			if len(got) != len(tt.want) {
+				t.Fatalf("Pending() got = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Pending() got = %v, want %v", got, tt.want)
+				}
+			}
+
+			if again := cursor.Pending(events); len(again) != 0 {
+				t.Errorf("Pending() second call got = %v, want nothing", names(again))
+			}
+		})
+	}
+}
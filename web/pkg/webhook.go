@@ -0,0 +1,545 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrInvalidWebhook is returned when creating a role with a webhook we won't deliver to.
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+const (
+	WebhookMaxAttempts    = 4
+	WebhookInitialBackoff = time.Second
+	WebhookTimeout        = 10 * time.Second
+
+	// WebhookPollInterval is how often RunWebhooks polls roles with webhooks.
+	WebhookPollInterval = time.Minute
+
+	// WebhookConcurrency is how many roles NotifyWebhooks polls at once, and how many workers Notifier.Run starts.
+	WebhookConcurrency = 8
+
+	// WebhookBacklog is how many roles can wait for a Notifier.Run worker, Enqueue drops any more.
+	WebhookBacklog = 64
+
+	// WebhookSignatureHeader holds "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>" using the webhook
+	// secret, the timestamp is in WebhookTimestampHeader.
+	WebhookSignatureHeader = "X-Assume-Role-Id-Signature"
+	WebhookTimestampHeader = "X-Assume-Role-Id-Timestamp"
+	WebhookDeliveryHeader  = "X-Assume-Role-Id-Delivery"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryStatusDelivered DeliveryStatus = "delivered"
+
+	// DeliveryStatusFailed is the dead-letter status, these aren't retried by later polls.
+	DeliveryStatusFailed DeliveryStatus = "failed"
+
+	// DeliveryStatusQueued deliveries failed and are being retried from the notifier's queue, see Redeliver.
+	DeliveryStatusQueued DeliveryStatus = "queued"
+)
+
+// Webhook is where notifications about a role are sent.
+type Webhook struct {
+	URL string `json:"url"`
+
+	// Secret is only ever held in memory, EncryptedSecret is what's stored, see Seal.
+	Secret          string `json:"-"`
+	EncryptedSecret string `json:"encrypted_secret,omitempty"`
+}
+
+// Seal returns a copy of the webhook to store for the role, with the secret encrypted by the keyring and bound to the
+// role's ID.
+func (w *Webhook) Seal(roleId string, keyring *Keyring) (*Webhook, error) {
+	sealed := &Webhook{URL: w.URL}
+	if w.Secret == "" {
+		return sealed, nil
+	}
+
+	encrypted, err := EncryptWithAdditionalData(w.Secret, []byte("webhook."+roleId), keyring)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting webhook secret: %w", err)
+	}
+	sealed.EncryptedSecret = encrypted
+	return sealed, nil
+}
+
+// Open returns a copy of a webhook stored by Seal with its secret decrypted.
+func (w *Webhook) Open(roleId string, keyring *Keyring) (*Webhook, error) {
+	opened := &Webhook{URL: w.URL}
+	if w.EncryptedSecret == "" {
+		return opened, nil
+	}
+
+	secret, err := DecryptWithAdditionalData(w.EncryptedSecret, []byte("webhook."+roleId), keyring)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting webhook secret: %w", err)
+	}
+	opened.Secret = secret
+	return opened, nil
+}
+
+// Validate checks the webhook is an absolute https URL.
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	} else if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute https url", ErrInvalidWebhook)
+	} else if u.User != nil {
+		return fmt.Errorf("%w: url must not contain credentials", ErrInvalidWebhook)
+	}
+	return nil
+}
+
+// WebhookPayload is the body POSTed to a webhook, Type is either WatchEventAssumeRole for a new AssumeRole event or
+// WatchEventSession when the session made more API calls, in which case SessionEvents only holds the new ones.
+type WebhookPayload struct {
+	Type          string          `json:"type"`
+	RoleArn       string          `json:"role_arn"`
+	Event         AssumeRoleEvent `json:"event"`
+	SessionEvents []SessionEvent  `json:"session_events"`
+}
+
+// WebhookDelivery records the outcome of sending a notification for a CloudTrail event, it's keyed by the EventId of
+// either the AssumeRole event or the session event.
+type WebhookDelivery struct {
+	EventId   string         `json:"event_id"`
+	Status    DeliveryStatus `json:"status"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+func NewNotifier(store Store, keyring *Keyring) *Notifier {
+	return &Notifier{
+		Client:      NewWebhookClient(),
+		Store:       store,
+		Keyring:     keyring,
+		MaxAttempts: WebhookMaxAttempts,
+		Backoff:     WebhookInitialBackoff,
+		jobs:        make(chan notifyJob, WebhookBacklog),
+		sending:     map[string]bool{},
+	}
+}
+
+// Notifier delivers webhooks for new events, each CloudTrail event is sent at most once per role.
+type Notifier struct {
+	Client      *http.Client
+	Store       Store
+	MaxAttempts int
+	Backoff     time.Duration
+
+	// Keyring decrypts the stored webhook secrets, see Webhook.Seal.
+	Keyring *Keyring
+
+	// Failed deliveries are sent to the SQS queue at QueueUrl when it's set, rather than being dead-lettered straight
+	// away.
+	Sqs      *sqs.Client
+	QueueUrl string
+
+	jobs    chan notifyJob
+	running atomic.Bool
+
+	// sending holds the "<role id>/<event id>" of deliveries in progress, so concurrent notifications for the same role
+	// don't both send them. Across instances deliveries may still be repeated.
+	sending map[string]bool
+	mu      sync.Mutex
+}
+
+type notifyJob struct {
+	role   *RoleRecord
+	events []AssumeRoleEvent
+}
+
+// Run starts WebhookConcurrency workers which send what Enqueue is given, until ctx is done.
+func (n *Notifier) Run(ctx *Context) {
+	n.running.Store(true)
+	defer n.running.Store(false)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < WebhookConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-n.jobs:
+					if err := n.Notify(ctx, job.role, job.events); err != nil {
+						ctx.Error.Printf("sending webhooks for %s: %v", job.role.RoleName, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Enqueue hands the events to a Run worker without waiting for them to be sent. It does nothing when Run isn't
+// running, as in lambda, or when the backlog is full, whatever isn't sent is picked up by the next NotifyWebhooks.
+func (n *Notifier) Enqueue(ctx *Context, role *RoleRecord, events []AssumeRoleEvent) {
+	if role.Webhook == nil || !n.running.Load() {
+		return
+	}
+
+	select {
+	case n.jobs <- notifyJob{role: role, events: events}:
+	default:
+		ctx.Info.Printf("webhook backlog full, leaving %s for the next run", role.RoleName)
+	}
+}
+
+// NewWebhookClient returns a client which refuses to connect to private, loopback or link-local addresses.
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: WebhookTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				return fmt.Errorf("refusing to connect to %s", host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: WebhookTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: WebhookTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Notify sends a notification for each event, and its session events, that wasn't already delivered or isn't being
+// sent by another call.
+func (n *Notifier) Notify(ctx *Context, role *RoleRecord, events []AssumeRoleEvent) error {
+	if role.Webhook == nil {
+		return nil
+	}
+	webhook, err := role.Webhook.Open(role.RoleId, n.Keyring)
+	if err != nil {
+		return err
+	}
+
+	delivered, err := n.claim(ctx, role.RoleId, events)
+	if err != nil {
+		return err
+	}
+	defer n.release(role.RoleId, events)
+
+	var errs []error
+	for _, event := range events {
+		payload := &WebhookPayload{
+			Type:          WatchEventAssumeRole,
+			RoleArn:       role.RoleArn,
+			Event:         event,
+			SessionEvents: []SessionEvent{},
+		}
+		if delivered[event.EventId] {
+			payload.Type = WatchEventSession
+		}
+
+		ids := []string{}
+		if !delivered[event.EventId] {
+			ids = append(ids, event.EventId)
+		}
+		for _, sessionEvent := range event.Events {
+			if !delivered[sessionEvent.EventId] {
+				ids = append(ids, sessionEvent.EventId)
+				payload.SessionEvents = append(payload.SessionEvents, sessionEvent)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		// With a queue only one attempt is made here, the queue backs off between the rest.
+		attempts := n.MaxAttempts
+		if n.QueueUrl != "" {
+			attempts = 1
+		}
+
+		delivery, retryable := n.send(ctx, webhook, ids[0], payload, attempts)
+		if delivery.Status == DeliveryStatusFailed && ctx.Err() != nil {
+			// The poll ran out of time, leave it for the next one rather than dead-lettering it.
+			return errors.Join(append(errs, fmt.Errorf("delivering %s: %w", event.EventId, ctx.Err()))...)
+		}
+		if delivery.Status == DeliveryStatusFailed && retryable && n.QueueUrl != "" {
+			if err := n.enqueue(ctx, &WebhookRetry{
+				RoleId:   role.RoleId,
+				EventIds: ids,
+				Attempts: delivery.Attempts,
+				Payload:  payload,
+			}); err != nil {
+				errs = append(errs, fmt.Errorf("queueing %s: %w", event.EventId, err))
+			} else {
+				ctx.Info.Printf("queued webhook for %s: %s", event.EventId, delivery.LastError)
+				delivery.Status = DeliveryStatusQueued
+			}
+		}
+		for _, id := range ids {
+			delivery.EventId = id
+			if err := n.Store.PutDelivery(ctx, role.RoleId, delivery); err != nil {
+				errs = append(errs, fmt.Errorf("storing delivery %s: %w", id, err))
+			}
+		}
+		if delivery.Status == DeliveryStatusFailed {
+			errs = append(errs, fmt.Errorf("delivering %s: %s", event.EventId, delivery.LastError))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// claim returns the ids of the events and session events Notify shouldn't send, either because they were delivered
+// or another call is sending them, and marks the rest as being sent until release is called. The lock is only held
+// here and in release, not while sending.
+func (n *Notifier) claim(ctx *Context, roleId string, events []AssumeRoleEvent) (map[string]bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	stored, err := n.Store.GetDeliveries(ctx, roleId)
+	if err != nil {
+		return nil, fmt.Errorf("getting deliveries: %w", err)
+	}
+	skip := map[string]bool{}
+	for _, delivery := range stored {
+		skip[delivery.EventId] = true
+	}
+
+	for _, id := range eventIds(events) {
+		if skip[id] || n.sending[roleId+"/"+id] {
+			skip[id] = true
+			continue
+		}
+		n.sending[roleId+"/"+id] = true
+	}
+	return skip, nil
+}
+
+// release clears what claim marked as being sent, deliveries have been stored by then.
+func (n *Notifier) release(roleId string, events []AssumeRoleEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, id := range eventIds(events) {
+		delete(n.sending, roleId+"/"+id)
+	}
+}
+
+func eventIds(events []AssumeRoleEvent) []string {
+	var ids []string
+	for _, event := range events {
+		ids = append(ids, event.EventId)
+		for _, sessionEvent := range event.Events {
+			ids = append(ids, sessionEvent.EventId)
+		}
+	}
+	return ids
+}
+
+// send POSTs the payload up to maxAttempts times, retrying with exponential backoff on network errors, 429s and 5xx
+// responses. It also returns whether a failed delivery is worth retrying later.
+func (n *Notifier) send(ctx *Context, webhook *Webhook, id string, payload *WebhookPayload, maxAttempts int) (WebhookDelivery, bool) {
+	delivery := WebhookDelivery{Status: DeliveryStatusFailed}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		delivery.LastError = fmt.Sprintf("marshalling payload: %v", err)
+		delivery.Time = time.Now().UTC()
+		return delivery, false
+	}
+
+	retry := false
+	backoff := n.Backoff
+	for delivery.Attempts < maxAttempts {
+		if delivery.Attempts > 0 {
+			select {
+			case <-ctx.Done():
+				delivery.LastError = ctx.Err().Error()
+				delivery.Time = time.Now().UTC()
+				return delivery, true
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		delivery.Attempts++
+
+		retry, err = n.post(ctx, webhook, id, body)
+		if err == nil {
+			delivery.Status = DeliveryStatusDelivered
+			delivery.LastError = ""
+			break
+		}
+
+		ctx.Info.Printf("webhook attempt %d for %s: %v", delivery.Attempts, id, err)
+		delivery.LastError = err.Error()
+		if !retry {
+			break
+		}
+	}
+
+	delivery.Time = time.Now().UTC()
+	return delivery, retry
+}
+
+// post sends a single request, returning whether it's worth retrying if it failed.
+func (n *Notifier) post(ctx *Context, webhook *Webhook, id string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookDeliveryHeader, id)
+	if webhook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, timestamp, body))
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return !errors.Is(err, context.Canceled), fmt.Errorf("posting: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for body sent at timestamp.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RunWebhooks polls every stored role with a webhook each interval until ctx is done, so notifications are sent
+// without anyone having the page open.
+func RunWebhooks(ctx *Context, params *PollEventsInput, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := NotifyWebhooks(ctx, params); err != nil {
+			ctx.Error.Printf("notifying webhooks: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NotifyWebhooks polls each stored role that has a webhook and hasn't expired or been deleted by its owner,
+// WebhookConcurrency at a time, and sends their notifications. Roles not started before ctx is done are left for
+// the next run.
+func NotifyWebhooks(ctx *Context, params *PollEventsInput) error {
+	roles, err := params.Store.ListRoles(ctx)
+	if err != nil {
+		return fmt.Errorf("listing roles: %w", err)
+	}
+
+	now := time.Now().UTC()
+
+	mu := sync.Mutex{}
+	var errs []error
+	wg := &sync.WaitGroup{}
+	sem := make(chan struct{}, WebhookConcurrency)
+	for _, role := range roles {
+		if role.Webhook == nil || !now.Before(role.Expiry()) || !role.TokensRevokedAt.IsZero() {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return errors.Join(append(errs, ctx.Err())...)
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(role RoleRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := notifyRole(ctx, params, &role); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}
+		}(role)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// notifyRole polls the role with a short lived viewer token and waits for its notifications to be sent.
+func notifyRole(ctx *Context, params *PollEventsInput, role *RoleRecord) error {
+	token, err := CreateRoleToken(&CreateRoleTokenInput{
+		RoleName: role.RoleName,
+		RoleArn:  role.RoleArn,
+		RoleId:   role.RoleId,
+		Scope:    RoleTokenScopeViewer,
+		Lifetime: time.Hour,
+		Keyring:  params.Keyring,
+	})
+	if err != nil {
+		return fmt.Errorf("creating token for %s: %w", role.RoleName, err)
+	}
+
+	input := *params
+	input.Token = token
+	input.Notifier = nil
+	result, err := PollEvents(ctx, &input)
+	if err != nil {
+		return fmt.Errorf("polling %s: %w", role.RoleName, err)
+	}
+	if result.RoleDeleted {
+		return nil
+	}
+	if err := params.Notifier.Notify(ctx, role, result.Results); err != nil {
+		return fmt.Errorf("sending webhooks for %s: %w", role.RoleName, err)
+	}
+	return nil
+}
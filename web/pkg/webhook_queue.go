@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"strconv"
+	"time"
+)
+
+// WebhookQueueMaxReceives is how many times a queued delivery is tried before it's dead-lettered.
+const WebhookQueueMaxReceives = 5
+
+// WebhookQueueDelay is how long a failed delivery waits on the queue before it's first retried, later retries wait for
+// the queue's visibility timeout.
+const WebhookQueueDelay = time.Minute
+
+// WebhookRetry is the queue message for a delivery that failed, the webhook itself is looked up from the stored role
+// so its secret isn't put on the queue.
+type WebhookRetry struct {
+	RoleId   string          `json:"role_id"`
+	EventIds []string        `json:"event_ids"`
+	Attempts int             `json:"attempts"`
+	Payload  *WebhookPayload `json:"payload"`
+}
+
+// enqueue sends a failed delivery to the notifier's queue to be retried by Redeliver.
+func (n *Notifier) enqueue(ctx *Context, retry *WebhookRetry) error {
+	body, err := json.Marshal(retry)
+	if err != nil {
+		return fmt.Errorf("marshalling retry: %w", err)
+	}
+
+	if _, err := n.Sqs.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(n.QueueUrl),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: int32(WebhookQueueDelay.Seconds()),
+	}); err != nil {
+		return fmt.Errorf("sending message: %w", err)
+	}
+	return nil
+}
+
+// Redeliver makes one attempt at a delivery queued by Notify, receives is the number of times the message has been
+// received.
+//
+// An error means the message should be retried later, once it's been received WebhookQueueMaxReceives times or the
+// webhook responds with a status that isn't worth retrying the delivery is stored as failed instead. Messages that
+// can't be parsed are dropped.
+func (n *Notifier) Redeliver(ctx *Context, body string, receives int) error {
+	retry := &WebhookRetry{}
+	if err := json.Unmarshal([]byte(body), retry); err != nil || len(retry.EventIds) == 0 || retry.Payload == nil {
+		ctx.Error.Printf("dropping invalid webhook retry: %v", err)
+		return nil
+	}
+
+	role, err := n.Store.GetRole(ctx, retry.RoleId)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("getting stored role: %w", err)
+	} else if role.Webhook == nil {
+		return nil
+	}
+
+	// The secret won't decrypt any later, so there's no point retrying.
+	webhook, err := role.Webhook.Open(role.RoleId, n.Keyring)
+	if err != nil {
+		ctx.Error.Printf("dropping webhook retry for %s: %v", retry.RoleId, err)
+		return nil
+	}
+
+	delivery, retryable := n.send(ctx, webhook, retry.EventIds[0], retry.Payload, 1)
+	// Earlier receives each made one attempt too.
+	delivery.Attempts += retry.Attempts + max(receives-1, 0)
+	if delivery.Status == DeliveryStatusFailed && retryable && receives < WebhookQueueMaxReceives {
+		return fmt.Errorf("delivering %s: %s", retry.EventIds[0], delivery.LastError)
+	}
+
+	var errs []error
+	for _, id := range retry.EventIds {
+		delivery.EventId = id
+		if err := n.Store.PutDelivery(ctx, role.RoleId, delivery); err != nil {
+			errs = append(errs, fmt.Errorf("storing delivery %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunWebhookQueue redelivers messages from the notifier's queue until ctx is done, in lambda the queue invokes the
+// function instead.
+func RunWebhookQueue(ctx *Context, n *Notifier) {
+	for ctx.Err() == nil {
+		resp, err := n.Sqs.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(n.QueueUrl),
+			MaxNumberOfMessages:         10,
+			WaitTimeSeconds:             20,
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		if err != nil {
+			ctx.Error.Printf("receiving webhook retries: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(WebhookPollInterval):
+			}
+			continue
+		}
+
+		for _, message := range resp.Messages {
+			receives, _ := strconv.Atoi(message.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+			if err := n.Redeliver(ctx, aws.ToString(message.Body), receives); err != nil {
+				ctx.Info.Printf("redelivering webhook: %v", err)
+				continue
+			}
+
+			if _, err := n.Sqs.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(n.QueueUrl),
+				ReceiptHandle: message.ReceiptHandle,
+			}); err != nil {
+				ctx.Error.Printf("deleting webhook retry: %v", err)
+			}
+		}
+	}
+}